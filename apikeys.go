@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nexus-im/nexus/policy"
+	"github.com/nexus-im/nexus/store/apikey"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// maxAPIKeyNameLength matches the api_keys.name column.
+const maxAPIKeyNameLength = 100
+
+// maxAPIKeyTTL is the longest expires_in a key can be created with. Keys
+// that should live longer are created without an expiry.
+const maxAPIKeyTTL = 365 * 24 * time.Hour
+
+// apiKeyScopes are the scopes a key can be created with.
+var apiKeyScopes = map[string]bool{scopeRead: true, scopeWrite: true}
+
+// newAPIKeyResponse is returned once when a key is created. It is the only
+// time the key itself is shown.
+type newAPIKeyResponse struct {
+	*apikey.Key
+	Secret string `json:"key"`
+}
+
+// handleCreateBot creates a bot user owned by the authenticated user. Bots
+// have no password; they authenticate with API keys their owner creates.
+func handleCreateBot(w http.ResponseWriter, r *http.Request) {
+	_, owner, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Username = policy.NormalizeUsername(req.Username)
+	if violations := accountPolicy.CheckUsername(req.Username); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	now := time.Now()
+	bot := &user.User{
+		Username:  req.Username,
+		IsBot:     true,
+		OwnerID:   owner.ID,
+		CreatedAt: now,
+		LastSeen:  now,
+	}
+	if err := userStore.Create(r.Context(), bot); err != nil {
+		if errors.Is(err, user.ErrDuplicateUsername) {
+			http.Error(w, "Username already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("Error creating bot: %v", err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, bot)
+}
+
+// handleCreateAPIKey creates an API key for the authenticated user, or for
+// one of their bots when the body names its user_id.
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		UserID    string   `json:"user_id"`
+		ExpiresIn int      `json:"expires_in"` // Seconds; zero for a key that does not expire
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength {
+		http.Error(w, "Name is too long", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !apiKeyScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	// Checked in seconds, since the duration itself could overflow.
+	if req.ExpiresIn < 0 || req.ExpiresIn > int(maxAPIKeyTTL/time.Second) {
+		http.Error(w, fmt.Sprintf("expires_in must be between 0 and %d", int(maxAPIKeyTTL/time.Second)), http.StatusBadRequest)
+		return
+	}
+
+	target, err := managedUser(r.Context(), u, req.UserID)
+	if err != nil {
+		writeManagedUserError(w, err)
+		return
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create key", http.StatusInternalServerError)
+		return
+	}
+	key := &apikey.Key{
+		UserID:    target.ID,
+		Name:      req.Name,
+		Token:     apikey.Prefix + token,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresIn > 0 {
+		expires := key.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		key.ExpiresAt = &expires
+	}
+	if err := apiKeyStore.Create(r.Context(), key); err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Failed to create key", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIKeyResponse{Key: key, Secret: key.Token})
+}
+
+// handleListAPIKeys lists the keys of the authenticated user, or of one of
+// their bots given as the user_id query parameter. Keys themselves are never
+// shown again after creation.
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	target, err := managedUser(r.Context(), u, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeManagedUserError(w, err)
+		return
+	}
+
+	keys, err := apiKeyStore.ListByUser(r.Context(), target.ID)
+	if err != nil {
+		log.Printf("Error listing API keys of %s: %v", target.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []*apikey.Key{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// handleRevokeAPIKey deletes a key of the authenticated user or of one of
+// their bots, and closes the websockets opened with it.
+func handleRevokeAPIKey(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	// Unknown IDs and other users' keys are indistinguishable to the caller.
+	key, err := apiKeyStore.GetByID(r.Context(), r.PathValue("id"))
+	if err == nil {
+		_, err = managedUser(r.Context(), u, key.UserID)
+	}
+	if errors.Is(err, apikey.ErrKeyNotFound) || errors.Is(err, user.ErrUserNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error looking up API key: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := apiKeyStore.Delete(r.Context(), key.ID); err != nil {
+		if errors.Is(err, apikey.ErrKeyNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting API key %s: %v", key.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hub.revoke <- revocation{userID: key.UserID, sessionID: key.ID}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// managedUser returns the user whose keys u may manage: u itself when userID
+// is empty or u's own ID, otherwise a bot owned by u. Anything else yields
+// user.ErrUserNotFound.
+func managedUser(ctx context.Context, u *user.User, userID string) (*user.User, error) {
+	if userID == "" || userID == u.ID {
+		return u, nil
+	}
+	target, err := userStore.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !target.IsBot || target.OwnerID != u.ID {
+		return nil, user.ErrUserNotFound
+	}
+	return target, nil
+}
+
+func writeManagedUserError(w http.ResponseWriter, err error) {
+	if errors.Is(err, user.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Error looking up user: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nexus-im/nexus/store/apikey"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+func TestBotAPIKeys(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/bots", "token-phone", `{"username":"deploybot"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var bot user.User
+	if err := json.NewDecoder(resp.Body).Decode(&bot); err != nil {
+		t.Fatal(err)
+	}
+	if !bot.IsBot || bot.OwnerID != "alice" {
+		t.Fatalf("expected a bot owned by alice, got %+v", bot)
+	}
+
+	// Only the owner manages the bot's keys.
+	body := `{"name":"ci","scopes":["read"],"user_id":"` + bot.ID + `"}`
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/keys", "token-bob", body); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for someone else's bot, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/keys", "token-phone", `{"name":"ci","scopes":["admin"]}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown scope, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/keys", "token-phone", body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var created struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, apikey.Prefix) {
+		t.Fatalf("expected key with prefix %q, got %q", apikey.Prefix, created.Key)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/users/me", created.Key, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var me user.User
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil || me.ID != bot.ID {
+		t.Errorf("expected to act as %s, got %+v (%v)", bot.ID, me, err)
+	}
+
+	// Keys cannot manage accounts, not even their own.
+	for _, path := range []string{"/api/sessions", "/api/keys"} {
+		if resp := doRequest(t, http.MethodGet, srv.URL+path, created.Key, ""); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for API key, got %d", path, resp.StatusCode)
+		}
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + created.Key}}
+	conn, _, err := (&websocket.Dialer{HandshakeTimeout: time.Second}).Dial(wsURL(srv), header)
+	if err != nil {
+		t.Fatalf("expected handshake with API key to succeed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	readEvent(t, conn) // Connected
+	readEvent(t, conn) // Unread summary
+	readEvent(t, conn) // Presence of the bot joining
+	readEvent(t, conn) // Updated user_list
+
+	// A read-only key cannot send, nor move its read markers and cursors.
+	for _, event := range []map[string]interface{}{
+		{"type": eventCreateRoom, "payload": CreateRoomPayload{Name: "ops"}},
+		{"type": eventMarkRead, "payload": MarkReadPayload{RoomID: "general", Seq: 1}},
+		{"type": eventAck, "payload": AckPayload{RoomID: "general", Seq: 1}},
+	} {
+		if err := conn.WriteJSON(event); err != nil {
+			t.Fatal(err)
+		}
+		if env := readEvent(t, conn); env.Type != eventError || !strings.Contains(string(env.Payload), "write scope") {
+			t.Errorf("%s: expected write scope error, got %s %s", event["type"], env.Type, env.Payload)
+		}
+	}
+
+	// Revoking the key closes the websocket and locks the bot out.
+	if resp := doRequest(t, http.MethodDelete, srv.URL+"/api/keys/"+created.ID, "token-bob", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 revoking someone else's key, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodDelete, srv.URL+"/api/keys/"+created.ID, "token-laptop", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	expectCloseCode(t, conn, websocket.ClosePolicyViolation)
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/users/me", created.Key, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked key to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIKeyValidation(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	// Large values would overflow the expiry instead of being rejected.
+	for _, expiresIn := range []string{"-1", "31536001", "9223372036854775807"} {
+		body := `{"name":"ci","scopes":["read"],"expires_in":` + expiresIn + `}`
+		if resp := doRequest(t, http.MethodPost, srv.URL+"/api/keys", "token-phone", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expires_in %s: expected 400, got %d", expiresIn, resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/keys", "token-phone", `{"name":"ci","scopes":["read","write","read"],"expires_in":31536000}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var created apikey.Key
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(created.Scopes, ",") != "read,write" {
+		t.Errorf("expected scopes to be deduplicated, got %v", created.Scopes)
+	}
+	if created.ExpiresAt == nil || created.ExpiresAt.Sub(created.CreatedAt) != maxAPIKeyTTL {
+		t.Errorf("expected key to expire after %v, got %v", maxAPIKeyTTL, created.ExpiresAt)
+	}
+}
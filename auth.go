@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nexus-im/nexus/store/apikey"
+	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// errUnauthorized is returned when a request carries no valid credentials.
+var errUnauthorized = errors.New("unauthorized")
+
+// errForbidden is returned when an API key lacks the scope a request needs.
+var errForbidden = errors.New("forbidden")
+
+// Scopes an API key can grant. Sessions are not limited by scope.
+const (
+	scopeRead  = "read"  // Connect websockets, receive messages, read rooms, history and profiles
+	scopeWrite = "write" // Send messages, create, join and leave rooms
+)
+
+// apiKeyTouchInterval limits how often the last use of an API key is written
+// back, so busy bots do not cause a write per request.
+const apiKeyTouchInterval = time.Minute
+
+// resolveToken looks up the session for token and the user it belongs to.
+// Unknown and expired tokens, as well as sessions of deleted users, yield
+// errUnauthorized.
+func resolveToken(ctx context.Context, token string) (*session.Session, *user.User, error) {
+	if token == "" {
+		return nil, nil, errUnauthorized
+	}
+
+	sess, err := sessionStore.GetByToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, session.ErrSessionExpired) || errors.Is(err, session.ErrSessionNotFound) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	u, err := userStore.GetByID(ctx, sess.UserID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	return sess, u, nil
+}
+
+// resolveTicket redeems a websocket ticket and returns the session it was
+// minted for along with its user. Unknown, used and expired tickets yield
+// errUnauthorized.
+func resolveTicket(ctx context.Context, ticket string) (*session.Session, *user.User, error) {
+	if ticket == "" {
+		return nil, nil, errUnauthorized
+	}
+
+	sess, err := sessionStore.RedeemTicket(ctx, ticket)
+	if err != nil {
+		if errors.Is(err, session.ErrTicketNotFound) || errors.Is(err, session.ErrTicketExpired) ||
+			errors.Is(err, session.ErrSessionExpired) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	u, err := userStore.GetByID(ctx, sess.UserID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	return sess, u, nil
+}
+
+// resolveAPIKey looks up an API key and the user it acts for. Unknown and
+// expired keys, as well as keys of deleted users, yield errUnauthorized.
+func resolveAPIKey(ctx context.Context, token string) (*apikey.Key, *user.User, error) {
+	key, err := apiKeyStore.GetByToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, apikey.ErrKeyNotFound) || errors.Is(err, apikey.ErrKeyExpired) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	u, err := userStore.GetByID(ctx, key.UserID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return nil, nil, errUnauthorized
+		}
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		if err := apiKeyStore.Touch(ctx, key.ID, now); err != nil {
+			log.Printf("Error recording use of API key %s: %v", key.ID, err)
+		}
+	}
+
+	return key, u, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// requireAuth authenticates an API request by its bearer token, which must be
+// a session token: account management is not open to API keys. On failure it
+// writes the error response and returns ok == false.
+func requireAuth(w http.ResponseWriter, r *http.Request) (sess *session.Session, u *user.User, ok bool) {
+	token := bearerToken(r)
+	if strings.HasPrefix(token, apikey.Prefix) {
+		http.Error(w, "Forbidden: API keys cannot be used here", http.StatusForbidden)
+		return nil, nil, false
+	}
+
+	sess, u, err := resolveToken(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, nil, false
+		}
+		log.Printf("Error authenticating request: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return sess, u, true
+}
+
+// requireScope authenticates an API request made on behalf of a user, by a
+// session token or by an API key granting scope. On failure it writes the
+// error response and returns ok == false.
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) (u *user.User, ok bool) {
+	token := bearerToken(r)
+	if !strings.HasPrefix(token, apikey.Prefix) {
+		_, u, ok := requireAuth(w, r)
+		return u, ok
+	}
+
+	key, u, err := resolveAPIKey(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, false
+		}
+		log.Printf("Error authenticating request: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !key.HasScope(scope) {
+		http.Error(w, "Forbidden: API key lacks the "+scope+" scope", http.StatusForbidden)
+		return nil, false
+	}
+	return u, true
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("response write error: %v", err)
+	}
+}
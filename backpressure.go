@@ -0,0 +1,187 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Policies for clients whose send buffer is full, chosen with -slow-consumer.
+const (
+	// slowConsumerDisconnect closes the connection with a "try again later"
+	// close frame. Clients reconnect and catch up from history.
+	slowConsumerDisconnect = "disconnect"
+
+	// slowConsumerDropOldest discards the oldest queued message to make room.
+	slowConsumerDropOldest = "drop-oldest"
+
+	// slowConsumerDropNewest discards the message that did not fit.
+	slowConsumerDropNewest = "drop-newest"
+
+	// slowConsumerSpill queues messages that do not fit in a per-client
+	// overflow queue, disconnecting the client once it holds more than
+	// -slow-consumer-spill-bytes.
+	slowConsumerSpill = "spill"
+)
+
+// slowConsumerStats counts what the policies did, keyed by policy and
+// outcome, e.g. "drop-newest.messages".
+var slowConsumerStats = expvar.NewMap("slow_consumer")
+
+// slowConsumerCloseFrame is sent to clients dropped for not keeping up.
+var slowConsumerCloseFrame = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+
+// slowConsumerPolicy decides what happens to a message for a client whose
+// send buffer is full. It runs on the hub goroutine and must never block, so
+// one stuck connection cannot stall delivery to everyone else.
+type slowConsumerPolicy interface {
+	// overflow handles message, which did not fit in c's send buffer. It
+	// returns false if the hub must drop c.
+	overflow(c *Client, message []byte) bool
+}
+
+// newSlowConsumerPolicy returns the policy called name. spillBytes bounds the
+// overflow queue of each client under the spill policy.
+func newSlowConsumerPolicy(name string, spillBytes int) (slowConsumerPolicy, error) {
+	switch name {
+	case slowConsumerDisconnect:
+		return disconnectPolicy{}, nil
+	case slowConsumerDropOldest:
+		return dropOldestPolicy{}, nil
+	case slowConsumerDropNewest:
+		return dropNewestPolicy{}, nil
+	case slowConsumerSpill:
+		if spillBytes <= 0 {
+			return nil, fmt.Errorf("spill limit must be positive, got %d", spillBytes)
+		}
+		return spillPolicy{maxBytes: spillBytes}, nil
+	}
+	return nil, fmt.Errorf("unknown slow consumer policy %q", name)
+}
+
+type disconnectPolicy struct{}
+
+func (disconnectPolicy) overflow(c *Client, message []byte) bool {
+	slowConsumerStats.Add("disconnect.clients", 1)
+	c.closeFrame = slowConsumerCloseFrame
+	return false
+}
+
+type dropOldestPolicy struct{}
+
+func (dropOldestPolicy) overflow(c *Client, message []byte) bool {
+	// writePump drains the buffer concurrently, so neither step may block:
+	// the buffer can have room again by the time we look.
+	select {
+	case <-c.send:
+		c.dropped.Add(1)
+		slowConsumerStats.Add("drop-oldest.messages", 1)
+	default:
+	}
+	select {
+	case c.send <- message:
+	default:
+		c.dropped.Add(1)
+		slowConsumerStats.Add("drop-oldest.messages", 1)
+	}
+	return true
+}
+
+type dropNewestPolicy struct{}
+
+func (dropNewestPolicy) overflow(c *Client, message []byte) bool {
+	c.dropped.Add(1)
+	slowConsumerStats.Add("drop-newest.messages", 1)
+	return true
+}
+
+type spillPolicy struct {
+	maxBytes int
+}
+
+func (p spillPolicy) overflow(c *Client, message []byte) bool {
+	if !c.overflow.push(message, p.maxBytes) {
+		slowConsumerStats.Add("spill.disconnects", 1)
+		c.closeFrame = slowConsumerCloseFrame
+		return false
+	}
+	slowConsumerStats.Add("spill.messages", 1)
+	slowConsumerStats.Add("spill.bytes", int64(len(message)))
+	return true
+}
+
+// overflowQueue holds, in order, the messages the spill policy could not fit
+// in a client's send buffer until writePump catches up. While it is not empty
+// the hub spills every message for the client, so none overtakes another.
+// A nil queue is always empty.
+type overflowQueue struct {
+	mu       sync.Mutex
+	messages [][]byte
+	bytes    int
+
+	// Signalled when a message is pushed, to wake writePump.
+	ready chan struct{}
+}
+
+func newOverflowQueue() *overflowQueue {
+	return &overflowQueue{ready: make(chan struct{}, 1)}
+}
+
+// push appends message unless that would make the queue hold more than max
+// bytes.
+func (q *overflowQueue) push(message []byte, max int) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	if q.bytes+len(message) > max {
+		q.mu.Unlock()
+		return false
+	}
+	q.messages = append(q.messages, message)
+	q.bytes += len(message)
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop removes and returns the first message.
+func (q *overflowQueue) pop() ([]byte, bool) {
+	if q == nil {
+		return nil, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.messages) == 0 {
+		return nil, false
+	}
+	message := q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	q.bytes -= len(message)
+	return message, true
+}
+
+func (q *overflowQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// wait returns a channel that receives after messages are pushed. It is nil,
+// and so never ready, for a nil queue.
+func (q *overflowQueue) wait() <-chan struct{} {
+	if q == nil {
+		return nil
+	}
+	return q.ready
+}
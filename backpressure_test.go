@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// newSlowConsumerHub starts a hub using policy with a registered client whose
+// send buffer has been filled with "m0" to "m15", and an idle client used to
+// wait for the hub.
+func newSlowConsumerHub(t *testing.T, policy slowConsumerPolicy) (h *Hub, slow, idle *Client) {
+	t.Helper()
+	h = newHub(nil, nil)
+	h.slowConsumer = policy
+	go h.run()
+
+	slow = newTestClient(h, "slow")
+	if _, ok := policy.(spillPolicy); ok {
+		slow.overflow = newOverflowQueue()
+	}
+	idle = newTestClient(h, "idle")
+	register(t, h, slow, idle)
+
+	for i := 0; i < cap(slow.send); i++ {
+		h.deliver <- delivery{client: slow, message: []byte(fmt.Sprintf("m%d", i))}
+	}
+	return h, slow, idle
+}
+
+// drain returns everything queued for c, and whether its send channel was
+// closed.
+func drain(c *Client) (got []string, closed bool) {
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return got, true
+			}
+			got = append(got, string(msg))
+		default:
+			return got, false
+		}
+	}
+}
+
+func expectQueued(t *testing.T, c *Client, want []string, wantClosed bool) {
+	t.Helper()
+	got, closed := drain(c)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v queued, got %v", want, got)
+	}
+	if closed != wantClosed {
+		t.Errorf("expected closed %v, got %v", wantClosed, closed)
+	}
+}
+
+func seq(from, to int) []string {
+	var s []string
+	for i := from; i < to; i++ {
+		s = append(s, fmt.Sprintf("m%d", i))
+	}
+	return s
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	h, slow, idle := newSlowConsumerHub(t, disconnectPolicy{})
+
+	h.deliver <- delivery{client: slow, message: []byte("x")}
+	settle(t, h, idle)
+
+	expectQueued(t, slow, seq(0, 16), true)
+	if !bytes.Equal(slow.closeFrame, slowConsumerCloseFrame) {
+		t.Errorf("expected slow consumer close frame, got %q", slow.closeFrame)
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	h, slow, idle := newSlowConsumerHub(t, dropOldestPolicy{})
+
+	h.deliver <- delivery{client: slow, message: []byte("x")}
+	h.deliver <- delivery{client: slow, message: []byte("y")}
+	settle(t, h, idle)
+
+	expectQueued(t, slow, append(seq(2, 16), "x", "y"), false)
+	if n := slow.dropped.Load(); n != 2 {
+		t.Errorf("expected 2 dropped, got %d", n)
+	}
+}
+
+func TestSlowConsumerDropNewest(t *testing.T) {
+	h, slow, idle := newSlowConsumerHub(t, dropNewestPolicy{})
+
+	h.deliver <- delivery{client: slow, message: []byte("x")}
+	h.deliver <- delivery{client: slow, message: []byte("y")}
+	settle(t, h, idle)
+
+	expectQueued(t, slow, seq(0, 16), false)
+	if n := slow.dropped.Load(); n != 2 {
+		t.Errorf("expected 2 dropped, got %d", n)
+	}
+}
+
+func TestSlowConsumerSpill(t *testing.T) {
+	h, slow, idle := newSlowConsumerHub(t, spillPolicy{maxBytes: 4})
+
+	h.deliver <- delivery{client: slow, message: []byte("ab")}
+	settle(t, h, idle)
+	<-slow.send
+	// There is room again, but "ab" is still waiting and must go first.
+	h.deliver <- delivery{client: slow, message: []byte("cd")}
+	settle(t, h, idle)
+
+	if n := len(slow.send); n != 15 {
+		t.Fatalf("expected 15 queued, got %d", n)
+	}
+	for _, want := range []string{"ab", "cd"} {
+		got, ok := slow.overflow.pop()
+		if !ok || string(got) != want {
+			t.Fatalf("expected %q spilled, got %q", want, got)
+		}
+	}
+
+	// With nothing spilled the buffer is used again, and spilling more than
+	// the limit drops the client.
+	h.deliver <- delivery{client: slow, message: []byte("n")}
+	h.deliver <- delivery{client: slow, message: []byte("abc")}
+	h.deliver <- delivery{client: slow, message: []byte("de")}
+	settle(t, h, idle)
+
+	expectQueued(t, slow, append(seq(1, 16), "n"), true)
+	if !bytes.Equal(slow.closeFrame, slowConsumerCloseFrame) {
+		t.Errorf("expected slow consumer close frame, got %q", slow.closeFrame)
+	}
+}
+
+func TestNewSlowConsumerPolicy(t *testing.T) {
+	for _, name := range []string{slowConsumerDisconnect, slowConsumerDropOldest, slowConsumerDropNewest, slowConsumerSpill} {
+		if _, err := newSlowConsumerPolicy(name, 1024); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := newSlowConsumerPolicy("block", 1024); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	if _, err := newSlowConsumerPolicy(slowConsumerSpill, 0); err == nil {
+		t.Error("expected error for spill without a limit")
+	}
+}
+
+// TestWritePending checks that spilled messages and the messages_dropped
+// notice reach the peer, in that order, once the send buffer is empty.
+func TestWritePending(t *testing.T) {
+	conn, peer := wsPair(t)
+	c := &Client{
+		conn:     conn,
+		send:     make(chan []byte, 1),
+		user:     &user.User{ID: "alice"},
+		overflow: newOverflowQueue(),
+	}
+
+	c.overflow.push([]byte(`{"type":"one"}`), 1024)
+	c.overflow.push([]byte(`{"type":"two"}`), 1024)
+	c.dropped.Store(3)
+
+	c.send <- []byte("queued")
+	if err := c.writePending(); err != nil {
+		t.Fatal(err)
+	}
+	if c.overflow.len() != 2 || c.dropped.Load() != 3 {
+		t.Fatal("expected nothing written while the send buffer is not empty")
+	}
+
+	<-c.send
+	if err := c.writePending(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two", eventMessagesDropped} {
+		env := readEvent(t, peer)
+		if env.Type != want {
+			t.Fatalf("expected %s, got %s", want, env.Type)
+		}
+		if want == eventMessagesDropped {
+			var p MessagesDroppedPayload
+			if err := json.Unmarshal(env.Payload, &p); err != nil || p.Count != 3 {
+				t.Errorf("expected count 3, got %+v (%v)", p, err)
+			}
+		}
+	}
+	if c.dropped.Load() != 0 {
+		t.Error("expected dropped count to be reset")
+	}
+}
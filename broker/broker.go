@@ -0,0 +1,26 @@
+// Package broker distributes hub traffic between nexus nodes so that clients
+// connected to different instances see each other's messages.
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned when publishing on a closed broker.
+var ErrClosed = errors.New("broker closed")
+
+// Broker fans payloads out to every node subscribed to it, including the node
+// that published them. Delivery is best effort and unordered across
+// publishers; receivers are expected to dedupe.
+type Broker interface {
+	// Publish sends payload to all nodes.
+	Publish(ctx context.Context, payload []byte) error
+
+	// Messages returns the channel on which payloads published by any node
+	// are received. It is closed when the broker is closed.
+	Messages() <-chan []byte
+
+	// Close stops receiving and releases the broker's resources.
+	Close() error
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Bus is an in-process message bus. Each Broker obtained from Join behaves
+// like a separate node, which makes it useful for tests and for running
+// several hubs in one process.
+type Bus struct {
+	mu      sync.Mutex
+	members map[*Memory]bool
+}
+
+// NewBus creates an empty Bus.
+func NewBus() *Bus {
+	return &Bus{members: make(map[*Memory]bool)}
+}
+
+// Join returns a new Broker attached to the bus. Its buffer holds up to
+// buffer undelivered payloads; further payloads are dropped for that member.
+func (b *Bus) Join(buffer int) *Memory {
+	m := &Memory{bus: b, messages: make(chan []byte, buffer)}
+	b.mu.Lock()
+	b.members[m] = true
+	b.mu.Unlock()
+	return m
+}
+
+// Memory is a Broker backed by a Bus.
+type Memory struct {
+	bus      *Bus
+	messages chan []byte
+}
+
+func (m *Memory) Publish(_ context.Context, payload []byte) error {
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+
+	if !m.bus.members[m] {
+		return ErrClosed
+	}
+	for member := range m.bus.members {
+		select {
+		case member.messages <- payload:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Messages() <-chan []byte {
+	return m.messages
+}
+
+func (m *Memory) Close() error {
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+
+	if m.bus.members[m] {
+		delete(m.bus.members, m)
+		close(m.messages)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBusDeliversToAllMembers(t *testing.T) {
+	bus := NewBus()
+	a := bus.Join(4)
+	b := bus.Join(4)
+	ctx := context.Background()
+
+	if err := a.Publish(ctx, []byte("hello")); err != nil {
+		t.Fatalf("error was not expected while publishing: %s", err)
+	}
+
+	for name, m := range map[string]*Memory{"a": a, "b": b} {
+		select {
+		case got := <-m.Messages():
+			if string(got) != "hello" {
+				t.Errorf("%s: expected hello, got %q", name, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: timed out waiting for message", name)
+		}
+	}
+}
+
+func TestBusClose(t *testing.T) {
+	bus := NewBus()
+	a := bus.Join(4)
+	b := bus.Join(4)
+	ctx := context.Background()
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("error was not expected while closing: %s", err)
+	}
+	if _, ok := <-b.Messages(); ok {
+		t.Errorf("expected messages channel to be closed")
+	}
+	if err := b.Publish(ctx, []byte("late")); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	// Publishing after another member left must not panic.
+	if err := a.Publish(ctx, []byte("still here")); err != nil {
+		t.Errorf("error was not expected while publishing: %s", err)
+	}
+}
@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres NOTIFY payloads must be shorter than 8000 bytes.
+const maxNotifyPayload = 7999
+
+// Idle time after which the listener connection is pinged to detect a dead
+// connection early.
+const listenerPingInterval = 90 * time.Second
+
+// Postgres is a Broker built on Postgres LISTEN/NOTIFY. Every node listens on
+// the same channel, and publishing is a pg_notify on that channel through the
+// regular connection pool.
+type Postgres struct {
+	db       *sql.DB
+	channel  string
+	listener *pq.Listener
+	messages chan []byte
+	done     chan struct{}
+}
+
+// NewPostgres starts listening on channel using a dedicated connection to
+// connStr. Notifications are published through db.
+func NewPostgres(db *sql.DB, connStr, channel string) (*Postgres, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("broker: listener event %d: %v", ev, err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	p := &Postgres{
+		db:       db,
+		channel:  channel,
+		listener: listener,
+		messages: make(chan []byte, 256),
+		done:     make(chan struct{}),
+	}
+	go p.receive()
+	return p, nil
+}
+
+func (p *Postgres) Publish(ctx context.Context, payload []byte) error {
+	if len(payload) > maxNotifyPayload {
+		return &PayloadTooLargeError{Size: len(payload), Max: maxNotifyPayload}
+	}
+	select {
+	case <-p.done:
+		return ErrClosed
+	default:
+	}
+	_, err := p.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, p.channel, string(payload))
+	return err
+}
+
+func (p *Postgres) Messages() <-chan []byte {
+	return p.messages
+}
+
+func (p *Postgres) Close() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	close(p.done)
+	return p.listener.Close()
+}
+
+func (p *Postgres) receive() {
+	defer close(p.messages)
+	for {
+		select {
+		case n, ok := <-p.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The listener reconnected; anything sent while it was
+				// down is lost.
+				log.Printf("broker: listener reconnected, notifications may have been missed")
+				continue
+			}
+			select {
+			case p.messages <- []byte(n.Extra):
+			case <-p.done:
+				return
+			}
+		case <-time.After(listenerPingInterval):
+			go func() {
+				if err := p.listener.Ping(); err != nil {
+					log.Printf("broker: listener ping failed: %v", err)
+				}
+			}()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// PayloadTooLargeError is returned when a payload exceeds what Postgres
+// accepts in a single NOTIFY.
+type PayloadTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("broker: payload of %d bytes exceeds limit of %d", e.Size, e.Max)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nexus-im/nexus/store/apikey"
 	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
 
 	"github.com/gorilla/websocket"
 )
@@ -25,9 +32,19 @@ const (
 	maxMessageSize = 512
 )
 
+// wsSubprotocol is selected whenever a client offers it. Browsers fail the
+// handshake if they offer subprotocols and none is selected, so clients
+// passing a ticket as a subprotocol must offer this one as well.
+const wsSubprotocol = "nexus"
+
+// ticketProtocolPrefix marks the offered subprotocol that carries a ticket,
+// e.g. "Sec-WebSocket-Protocol: nexus, ticket.<ticket>".
+const ticketProtocolPrefix = "ticket."
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{wsSubprotocol},
 	// Allow all origins for development purposes
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -43,6 +60,42 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// The authenticated user and the session or API key the connection was
+	// opened with. Exactly one of session and apiKey is set.
+	user    *user.User
+	session *session.Session
+	apiKey  *apikey.Key
+
+	// Names the delivery stream acks are recorded on; see resume.go.
+	resumeID string
+
+	// How outbound events are packed into frames; see framing.go.
+	framing framing
+
+	// IDs of the rooms this connection receives messages for. Written by the
+	// hub, read by event handlers, hence the mutex.
+	mu    sync.Mutex
+	rooms map[string]bool
+
+	// Close frame sent when the hub closes the send channel. Set by the hub
+	// before closing; nil sends an empty close frame.
+	closeFrame []byte
+
+	// Messages the slow consumer policy held back because send was full:
+	// spilled ones waiting to be written, and a count of discarded ones
+	// reported with a messages_dropped event. overflow is nil unless the hub
+	// uses the spill policy.
+	overflow *overflowQueue
+	dropped  atomic.Int64
+
+	// Live messages held back while the connection replays; see resume.go.
+	hold *replayHold
+
+	// Typing indicators the connection has started and their expiry timers;
+	// see ephemeral.go. Timers fire on their own goroutines, hence the mutex.
+	typingMu sync.Mutex
+	typing   map[typingTarget]*typingTimer
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -52,6 +105,7 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
+		c.stopAllTyping()
 		c.hub.unregister <- c
 		if err := c.conn.Close(); err != nil {
 			log.Printf("error closing connection: %v", err)
@@ -77,10 +131,71 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		// For now, simply broadcast the raw message.
-		// Later we will parse JSON and handle events.
-		c.hub.broadcast <- message
+		c.hub.events.Dispatch(c, message)
+	}
+}
+
+// sendEvent delivers an event to this client only.
+func (c *Client) sendEvent(eventType string, payload interface{}) error {
+	msg, err := encodeEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	c.hub.deliver <- delivery{client: c, message: msg}
+	return nil
+}
+
+// sendError reports a rejected event back to this client only.
+func (c *Client) sendError(evErr *EventError) {
+	if err := c.sendEvent(eventError, evErr); err != nil {
+		log.Printf("error encoding error event: %v", err)
+	}
+}
+
+// credentialID identifies the session or API key the connection was opened
+// with, so revoking either closes it.
+func (c *Client) credentialID() string {
+	switch {
+	case c.session != nil:
+		return c.session.ID
+	case c.apiKey != nil:
+		return c.apiKey.ID
+	}
+	return ""
+}
+
+// allows reports whether the connection may act within scope. Connections
+// opened with a session are not limited.
+func (c *Client) allows(scope string) bool {
+	return c.apiKey == nil || c.apiKey.HasScope(scope)
+}
+
+func (c *Client) inRoom(roomID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[roomID]
+}
+
+func (c *Client) addRoom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rooms[roomID] = true
+}
+
+func (c *Client) removeRoom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms, roomID)
+}
+
+func (c *Client) roomIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.rooms))
+	for id := range c.rooms {
+		ids = append(ids, id)
 	}
+	return ids
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -99,41 +214,31 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("error setting write deadline: %v", err)
-				return
-			}
 			if !ok {
 				// The hub closed the channel.
-				if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-					log.Printf("error writing close message: %v", err)
-				}
+				c.writeClose()
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			closed, err := c.writeBatches(message)
 			if err != nil {
+				log.Printf("error writing message: %v", err)
 				return
 			}
-			if _, err := w.Write(message); err != nil {
-				log.Printf("error writing message: %v", err)
+			if closed {
+				c.writeClose()
 				return
 			}
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				if _, err := w.Write(<-c.send); err != nil {
-					log.Printf("error writing queued message: %v", err)
-					return
-				}
+			if err := c.writePending(); err != nil {
+				log.Printf("error writing pending messages: %v", err)
+				return
 			}
-
-			if err := w.Close(); err != nil {
+		case <-c.overflow.wait():
+			if err := c.writePending(); err != nil {
+				log.Printf("error writing pending messages: %v", err)
 				return
 			}
 		case <-ticker.C:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := c.setWriteDeadline(); err != nil {
 				log.Printf("error setting write deadline: %v", err)
 				return
 			}
@@ -144,21 +249,142 @@ func (c *Client) writePump() {
 	}
 }
 
-// serveWs handles websocket requests from the peer.
+// writePending writes what the slow consumer policy held back, once the send
+// buffer has drained so the order of messages is kept: spilled messages first,
+// then a messages_dropped event if any were discarded. Only as many spilled
+// messages as are queued on entry are written, so pings are not starved.
+func (c *Client) writePending() error {
+	if len(c.send) > 0 {
+		return nil
+	}
+	for n := c.overflow.len(); n > 0; n-- {
+		message, ok := c.overflow.pop()
+		if !ok {
+			break
+		}
+		if err := c.write(message); err != nil {
+			return err
+		}
+	}
+	if n := c.dropped.Swap(0); n > 0 {
+		msg, err := encodeEvent(eventMessagesDropped, MessagesDroppedPayload{
+			Count:     n,
+			Timestamp: time.Now().UTC(),
+		})
+		if err != nil {
+			log.Printf("error encoding messages dropped notice: %v", err)
+			return nil
+		}
+		return c.write(msg)
+	}
+	return nil
+}
+
+// write sends message in a frame of its own, framed as the client asked.
+func (c *Client) write(message []byte) error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	return c.writeFrame([][]byte{message})
+}
+
+// writeClose sends the close frame the hub chose, or an empty one.
+func (c *Client) writeClose() {
+	if err := c.setWriteDeadline(); err != nil {
+		log.Printf("error setting write deadline: %v", err)
+		return
+	}
+	frame := c.closeFrame
+	if frame == nil {
+		frame = []byte{}
+	}
+	if err := c.conn.WriteMessage(websocket.CloseMessage, frame); err != nil {
+		log.Printf("error writing close message: %v", err)
+	}
+}
+
+func (c *Client) setWriteDeadline() error {
+	return c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+}
+
+// handshakeCredentials returns the ticket, session token or API key sent with
+// the upgrade request, if any. Clients that are not browsers, such as bots,
+// can send an Authorization header. Tokens are never read from the URL, where
+// they would leak into logs; see parseConnOptions.
+func handshakeCredentials(r *http.Request) (ticket, token string) {
+	for _, p := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(p, ticketProtocolPrefix) {
+			return strings.TrimPrefix(p, ticketProtocolPrefix), ""
+		}
+	}
+	if token := bearerToken(r); token != "" {
+		return "", token
+	}
+	return r.URL.Query().Get("ticket"), ""
+}
+
+// resolveConnCredentials resolves the credentials a websocket presented. API
+// keys need the read scope to connect.
+func resolveConnCredentials(ctx context.Context, ticket, token string) (*session.Session, *apikey.Key, *user.User, error) {
+	if ticket != "" {
+		sess, u, err := resolveTicket(ctx, ticket)
+		return sess, nil, u, err
+	}
+	if !strings.HasPrefix(token, apikey.Prefix) {
+		sess, u, err := resolveToken(ctx, token)
+		return sess, nil, u, err
+	}
+
+	key, u, err := resolveAPIKey(ctx, token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !key.HasScope(scopeRead) {
+		return nil, nil, nil, errForbidden
+	}
+	return nil, key, u, nil
+}
+
+// serveWs handles websocket requests from the peer. Credentials sent with the
+// handshake are checked before upgrading. Without any, the connection is
+// upgraded and must authenticate with its first event.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	tokenString := r.URL.Query().Get("token")
-	if tokenString == "" {
-		http.Error(w, "Unauthorized: missing token", http.StatusUnauthorized)
+	opts, err := parseConnOptions(r)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ticket, token := handshakeCredentials(r)
+	if ticket == "" && token == "" {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go authenticateConn(hub, conn, opts)
 		return
 	}
 
-	sess, err := sessionStore.GetByToken(r.Context(), tokenString)
+	sess, key, u, err := resolveConnCredentials(r.Context(), ticket, token)
 	if err != nil {
-		if errors.Is(err, session.ErrSessionExpired) || errors.Is(err, session.ErrSessionNotFound) {
+		if errors.Is(err, errUnauthorized) {
 			http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
 			return
 		}
-		http.Error(w, "Unauthorized: invalid token", http.StatusUnauthorized)
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "Forbidden: API key lacks the read scope", http.StatusForbidden)
+			return
+		}
+		log.Printf("Error authenticating websocket: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	rooms, err := loadRooms(r.Context(), u.ID)
+	if err != nil {
+		log.Printf("Error loading rooms for user %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -168,19 +394,178 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
+	startClient(hub, conn, sess, key, u, rooms, opts)
+}
+
+// authenticateConn waits for the auth event of a connection opened without
+// credentials and then starts it like any other. Until then the connection is
+// not registered with the hub and receives nothing. Connections that send
+// anything else, or nothing within -ws-auth-timeout, are closed with a policy
+// violation.
+func authenticateConn(hub *Hub, conn *websocket.Conn, opts connOptions) {
+	sess, key, u, rooms, err := readAuth(conn)
+	if err != nil {
+		code, reason := websocket.ClosePolicyViolation, "authentication failed"
+		if errors.Is(err, errForbidden) {
+			reason = "insufficient scope"
+		} else if !errors.Is(err, errUnauthorized) {
+			log.Printf("Error authenticating websocket: %v", err)
+			code, reason = websocket.CloseInternalServerErr, "internal error"
+		}
+		frame := websocket.FormatCloseMessage(code, reason)
+		if err := conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait)); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			log.Printf("error writing close message: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			log.Printf("error closing connection: %v", err)
+		}
+		return
+	}
+	startClient(hub, conn, sess, key, u, rooms, opts)
+}
+
+// readAuth reads the first event of conn, which must be an auth event, and
+// resolves the credentials it carries.
+func readAuth(conn *websocket.Conn) (*session.Session, *apikey.Key, *user.User, map[string]bool, error) {
+	conn.SetReadLimit(maxMessageSize)
+	if err := conn.SetReadDeadline(time.Now().Add(*wsAuthTimeout)); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		// Timed out or went away; either way there is nobody to serve.
+		return nil, nil, nil, nil, errUnauthorized
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != eventAuth {
+		return nil, nil, nil, nil, errUnauthorized
+	}
+	var p AuthPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		return nil, nil, nil, nil, errUnauthorized
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	sess, key, u, err := resolveConnCredentials(ctx, p.Ticket, p.Token)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	rooms, err := loadRooms(ctx, u.ID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return sess, key, u, rooms, nil
+}
+
+// loadRooms returns the IDs of the rooms userID is a member of.
+func loadRooms(ctx context.Context, userID string) (map[string]bool, error) {
+	memberOf, err := roomStore.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	rooms := make(map[string]bool, len(memberOf))
+	for _, rm := range memberOf {
+		rooms[rm.ID] = true
+	}
+	return rooms, nil
+}
+
+// connOptions are the query parameters a websocket may be opened with.
+type connOptions struct {
+	// Resume ID of an earlier connection whose unacknowledged messages are
+	// replayed first, from resume_from.
+	resumeFrom string
+
+	// Framing of outbound events, from batch.
+	framing framing
+}
+
+// parseConnOptions reads the query parameters of a websocket request. The
+// token parameter older clients sent is refused rather than ignored, so they
+// fail fast instead of waiting for an auth event they never send.
+func parseConnOptions(r *http.Request) (connOptions, error) {
+	q := r.URL.Query()
+	if q.Has("token") {
+		return connOptions{}, errors.New("the token parameter is not accepted, use a ticket or an auth event")
+	}
+	f, err := parseFraming(q.Get("batch"))
+	if err != nil {
+		return connOptions{}, err
+	}
+	return connOptions{resumeFrom: q.Get("resume_from"), framing: f}, nil
+}
 
-	username := "unknown"
-	if u, err := userStore.GetByID(r.Context(), sess.UserID); err == nil {
-		username = u.Username
+// startClient registers an authenticated connection with the hub and starts
+// serving it.
+func startClient(hub *Hub, conn *websocket.Conn, sess *session.Session, key *apikey.Key, u *user.User, rooms map[string]bool, opts connOptions) {
+	log.Printf("Client connected: %s (%s)", u.Username, u.ID)
+
+	resumeID, resumed, cursors, err := resumeStream(u.ID, opts.resumeFrom)
+	if err != nil {
+		log.Printf("error starting delivery stream for %s: %v", u.ID, err)
+		if err := conn.Close(); err != nil {
+			log.Printf("error closing connection: %v", err)
+		}
+		return
 	}
-	log.Printf("Client connected: %s (%s)", username, sess.UserID)
 
 	// Register new client
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client := &Client{
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		user:     u,
+		session:  sess,
+		apiKey:   key,
+		rooms:    rooms,
+		resumeID: resumeID,
+		framing:  opts.framing,
+		hold:     &replayHold{},
+	}
+	if _, ok := hub.slowConsumer.(spillPolicy); ok {
+		client.overflow = newOverflowQueue()
+	}
 	client.hub.register <- client
 
+	// Nothing else writes to the connection until writePump starts, so the
+	// replay, connected and unread_summary come first, followed by the live
+	// messages held meanwhile. If any of it fails the pumps still start,
+	// notice the broken connection and unregister the client.
+	replayed, err := client.replay(resumed, cursors, *resumeLimit)
+	if err != nil {
+		log.Printf("error replaying messages to %s: %v", u.ID, err)
+	} else if err := client.writeUnread(); err != nil {
+		log.Printf("error sending unread summary to %s: %v", u.ID, err)
+	} else if err := client.writeHeld(); err != nil {
+		log.Printf("error sending held messages to %s: %v", u.ID, err)
+	}
+	client.hold.release()
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
+
+	client.backfill(*historyBackfill, replayed)
+}
+
+// backfill sends the most recent messages of each of the client's rooms,
+// except those in skip, so a fresh connection starts with context. Messages
+// posted while the backfill is in flight may arrive before it; clients order
+// by sequence.
+func (c *Client) backfill(limit int, skip map[string]bool) {
+	if limit <= 0 {
+		return
+	}
+	for _, roomID := range c.roomIDs() {
+		if skip[roomID] {
+			continue
+		}
+		if err := sendHistory(c, roomID, 0, limit); err != nil {
+			log.Printf("error sending history for room %s to %s: %v", roomID, c.user.ID, err)
+		}
+	}
 }
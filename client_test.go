@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func newTicket(t *testing.T, srv *httptest.Server, token string) string {
+	t.Helper()
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/ws-ticket", token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Ticket == "" {
+		t.Fatalf("invalid ticket response: %v", err)
+	}
+	return body.Ticket
+}
+
+func dial(t *testing.T, url string, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	d := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: time.Second}
+	conn, resp, err := d.Dial(url, nil)
+	if conn != nil {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// dialToken opens a websocket to url, authenticating with token in the
+// Authorization header as non-browser clients do.
+func dialToken(t *testing.T, url, token string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	d := websocket.Dialer{HandshakeTimeout: time.Second}
+	conn, resp, err := d.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if conn != nil {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// wsPair returns the server and client ends of a websocket connection,
+// closed when the test ends.
+func wsPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			close(conns)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-conns
+	if !ok {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server, client
+}
+
+// readEvent reads the next event from conn, failing the test on error.
+func readEvent(t *testing.T, conn *websocket.Conn) Envelope {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("error reading event: %v", err)
+	}
+	return env
+}
+
+// expectCloseCode fails the test unless the server closes conn with code.
+func expectCloseCode(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != code {
+		t.Fatalf("expected close code %d, got %v", code, err)
+	}
+}
+
+func TestWsTicket(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/ws-ticket", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	// Tokens in the URL end up in logs and are refused outright.
+	_, resp, err := dial(t, wsURL(srv)+"?token=token-bob")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected token query parameter to be rejected with 400, got %v", err)
+	}
+
+	ticket := newTicket(t, srv, "token-bob")
+	conn, resp, err := dial(t, wsURL(srv), wsSubprotocol, ticketProtocolPrefix+ticket)
+	if err != nil {
+		t.Fatalf("expected handshake with ticket to succeed: %v", err)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != wsSubprotocol {
+		t.Errorf("expected subprotocol %q, got %q", wsSubprotocol, got)
+	}
+	if env := readEvent(t, conn); env.Type != eventConnected {
+		t.Errorf("expected connected, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUnreadSummary {
+		t.Errorf("expected unread_summary, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUserList {
+		t.Errorf("expected user_list, got %s", env.Type)
+	}
+
+	// Tickets are single use.
+	_, resp, err = dial(t, wsURL(srv), wsSubprotocol, ticketProtocolPrefix+ticket)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected redeemed ticket to be rejected with 401, got %v", err)
+	}
+
+	// The query parameter works too, since a used ticket is worthless.
+	ticket = newTicket(t, srv, "token-bob")
+	if _, _, err := dial(t, wsURL(srv)+"?ticket="+ticket); err != nil {
+		t.Errorf("expected handshake with ticket parameter to succeed: %v", err)
+	}
+}
+
+func TestWsFirstFrameAuth(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+
+	conn, _, err := dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatalf("expected handshake without credentials to succeed: %v", err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventAuth, "payload": AuthPayload{Token: "token-bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if env := readEvent(t, conn); env.Type != eventConnected {
+		t.Fatalf("expected connected once authenticated, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUnreadSummary {
+		t.Fatalf("expected unread_summary once authenticated, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUserList {
+		t.Fatalf("expected user_list once authenticated, got %s", env.Type)
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventAuth, "payload": AuthPayload{Token: "token-bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if env := readEvent(t, conn); env.Type != eventError {
+		t.Errorf("expected repeated auth to be rejected, got %s", env.Type)
+	}
+
+	// A ticket can be used in place of the token.
+	conn, _, err = dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := newTicket(t, srv, "token-bob")
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventAuth, "payload": AuthPayload{Ticket: ticket}}); err != nil {
+		t.Fatal(err)
+	}
+	if env := readEvent(t, conn); env.Type != eventConnected {
+		t.Fatalf("expected connected once authenticated, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUnreadSummary {
+		t.Fatalf("expected unread_summary once authenticated, got %s", env.Type)
+	}
+	if env := readEvent(t, conn); env.Type != eventUserList {
+		t.Fatalf("expected user_list once authenticated, got %s", env.Type)
+	}
+}
+
+func TestWsFirstFrameAuthRejected(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+
+	conn, _, err := dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventAuth, "payload": AuthPayload{Token: "bogus"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectCloseCode(t, conn, websocket.ClosePolicyViolation)
+
+	conn, _, err = dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventSendMessage, "payload": SendMessagePayload{RoomID: "r", Content: "hi"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectCloseCode(t, conn, websocket.ClosePolicyViolation)
+
+	timeout := *wsAuthTimeout
+	*wsAuthTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { *wsAuthTimeout = timeout })
+
+	conn, _, err = dial(t, wsURL(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCloseCode(t, conn, websocket.ClosePolicyViolation)
+}
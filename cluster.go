@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// Kinds of hub operations replicated to other nodes.
+const (
+	clusterAll    = "all"
+	clusterRoom   = "room"
+	clusterUsers  = "users"
+	clusterJoin   = "join"
+	clusterLeave  = "leave"
+	clusterRevoke = "revoke"
+
+	clusterEphemeral = "ephemeral"
+
+	// Users connected to the origin node, and a user whose last connection
+	// to it closed.
+	clusterPresence = "presence"
+	clusterOffline  = "offline"
+)
+
+// defaultPresenceInterval is how often each node announces its users to the
+// others. A node not heard from for presenceTTLFactor intervals is presumed
+// gone, along with its users.
+const (
+	defaultPresenceInterval = 30 * time.Second
+	presenceTTLFactor       = 3
+)
+
+// presenceChunk bounds the users announced per presence message, keeping it
+// well within the payload limit of the broker.
+const presenceChunk = 50
+
+// remotePresence is a user connected to another node.
+type remotePresence struct {
+	username  string
+	refreshed time.Time
+}
+
+// outboxSize bounds how many cluster messages may wait to be published before
+// the hub starts dropping them.
+const outboxSize = 1024
+
+// recentIDsSize is how many cluster message IDs each node remembers for
+// dedupe.
+const recentIDsSize = 4096
+
+// clusterMessage is a hub operation exchanged between nodes over the broker.
+// Every node applies it to its local clients exactly as if it had been
+// submitted to its own hub.
+type clusterMessage struct {
+	ID        string          `json:"id"`
+	Origin    string          `json:"origin"`
+	Kind      string          `json:"kind"`
+	RoomID    string          `json:"room_id,omitempty"`
+	UserIDs   []string        `json:"user_ids,omitempty"`
+	SessionID string          `json:"session_id,omitempty"`
+	From      string          `json:"from,omitempty"`
+	Message   json.RawMessage `json:"message,omitempty"`
+
+	// Which connections a revoke closes; see revocation.
+	FamilyID      string `json:"family_id,omitempty"`
+	KeepSessionID string `json:"keep_session_id,omitempty"`
+	KeepFamilyID  string `json:"keep_family_id,omitempty"`
+
+	// The names of the users of a presence message, in the order of
+	// UserIDs, and whether the origin recorded last_seen for an offline one.
+	Usernames []string `json:"usernames,omitempty"`
+	Recorded  bool     `json:"recorded,omitempty"`
+}
+
+// publish replicates an operation the hub has already applied locally. It
+// never blocks the hub: when the outbox is full the operation only reaches
+// local clients.
+func (h *Hub) publish(cm clusterMessage) {
+	if h.broker == nil {
+		return
+	}
+	h.nextID++
+	cm.ID = fmt.Sprintf("%s-%d", h.nodeID, h.nextID)
+	cm.Origin = h.nodeID
+
+	select {
+	case h.outbox <- cm:
+	default:
+		log.Printf("cluster: outbox full, dropping %s message %s", cm.Kind, cm.ID)
+	}
+}
+
+// publishLoop drains the outbox into the broker.
+func (h *Hub) publishLoop() {
+	for cm := range h.outbox {
+		data, err := json.Marshal(cm)
+		if err != nil {
+			log.Printf("cluster: error encoding message %s: %v", cm.ID, err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := h.broker.Publish(ctx, data); err != nil {
+			log.Printf("cluster: error publishing message %s: %v", cm.ID, err)
+		}
+		cancel()
+	}
+}
+
+// receive applies an operation published by another node. Messages this node
+// published itself were already applied locally and are skipped, as are
+// duplicates.
+func (h *Hub) receive(data []byte) {
+	var cm clusterMessage
+	if err := json.Unmarshal(data, &cm); err != nil {
+		log.Printf("cluster: dropping malformed message: %v", err)
+		return
+	}
+	if cm.Origin == h.nodeID || !h.seen.add(cm.ID) {
+		return
+	}
+	if _, ok := h.peers[cm.Origin]; !ok {
+		// A node that just started does not know who is connected here.
+		h.publishPresence(h.localUsers())
+	}
+	h.peers[cm.Origin] = time.Now()
+
+	switch cm.Kind {
+	case clusterAll:
+		h.sendAll(cm.Message)
+	case clusterRoom:
+		h.sendRoom(roomMessage{roomID: cm.RoomID, message: cm.Message})
+	case clusterUsers:
+		h.sendUsers(userMessage{userIDs: cm.UserIDs, message: cm.Message})
+	case clusterEphemeral:
+		h.sendEphemeral(ephemeralMessage{roomID: cm.RoomID, userIDs: cm.UserIDs, from: cm.From, message: cm.Message})
+	case clusterRevoke:
+		if len(cm.UserIDs) != 1 {
+			log.Printf("cluster: dropping %s message %s without user", cm.Kind, cm.ID)
+			return
+		}
+		h.disconnect(revocation{
+			userID:        cm.UserIDs[0],
+			familyID:      cm.FamilyID,
+			keepSessionID: cm.KeepSessionID,
+			keepFamilyID:  cm.KeepFamilyID,
+			sessionID:     cm.SessionID,
+		})
+	case clusterJoin, clusterLeave:
+		if len(cm.UserIDs) != 1 {
+			log.Printf("cluster: dropping %s message %s without user", cm.Kind, cm.ID)
+			return
+		}
+		m := membership{userID: cm.UserIDs[0], roomID: cm.RoomID, notice: cm.Message}
+		if cm.Kind == clusterJoin {
+			h.joinRoom(m)
+		} else {
+			h.leaveRoom(m)
+		}
+	case clusterPresence:
+		if len(cm.Usernames) != len(cm.UserIDs) {
+			log.Printf("cluster: dropping %s message %s with mismatched users", cm.Kind, cm.ID)
+			return
+		}
+		now := time.Now()
+		for i, userID := range cm.UserIDs {
+			if !h.online(userID) {
+				h.presence = append(h.presence, presenceChange{user: &user.User{ID: userID, Username: cm.Usernames[i]}, online: true})
+			}
+			if h.remote[userID] == nil {
+				h.remote[userID] = make(map[string]*remotePresence)
+			}
+			h.remote[userID][cm.Origin] = &remotePresence{username: cm.Usernames[i], refreshed: now}
+		}
+	case clusterOffline:
+		for _, userID := range cm.UserIDs {
+			// If the origin could not record last_seen because the user was
+			// still connected here, and the user has meanwhile gone from
+			// here too, it falls to this node.
+			h.dropRemote(userID, cm.Origin, !cm.Recorded && h.unrecorded[userID])
+		}
+	default:
+		log.Printf("cluster: dropping message %s of unknown kind %q", cm.ID, cm.Kind)
+	}
+}
+
+// online reports whether userID has a connection to any node.
+func (h *Hub) online(userID string) bool {
+	return len(h.users[userID]) > 0 || len(h.remote[userID]) > 0
+}
+
+// localUsers returns the users connected to this node.
+func (h *Hub) localUsers() []*user.User {
+	users := make([]*user.User, 0, len(h.users))
+	for _, clients := range h.users {
+		for client := range clients {
+			users = append(users, client.user)
+			break
+		}
+	}
+	return users
+}
+
+// publishPresence tells the other nodes that users are connected here. At
+// least one message is published, so an empty list still announces the node.
+func (h *Hub) publishPresence(users []*user.User) {
+	for start := 0; start == 0 || start < len(users); start += presenceChunk {
+		chunk := users[start:min(start+presenceChunk, len(users))]
+		cm := clusterMessage{Kind: clusterPresence, UserIDs: make([]string, len(chunk)), Usernames: make([]string, len(chunk))}
+		for i, u := range chunk {
+			cm.UserIDs[i] = u.ID
+			cm.Usernames[i] = u.Username
+		}
+		h.publish(cm)
+	}
+}
+
+// syncPresence refreshes this node's users on the other nodes and forgets
+// the users of nodes that stopped refreshing theirs, which are presumed gone.
+// Nobody else is left to record last_seen for those users, so this node does.
+func (h *Hub) syncPresence(now time.Time) {
+	h.publishPresence(h.localUsers())
+
+	cutoff := now.Add(-presenceTTLFactor * h.presenceInterval)
+	for userID, nodes := range h.remote {
+		for nodeID, p := range nodes {
+			if p.refreshed.Before(cutoff) {
+				h.dropRemote(userID, nodeID, true)
+			}
+		}
+	}
+	for nodeID, heard := range h.peers {
+		if heard.Before(cutoff) {
+			delete(h.peers, nodeID)
+		}
+	}
+}
+
+// dropRemote forgets that userID is connected to nodeID, announcing that the
+// user went offline if that was their last connection in the cluster.
+func (h *Hub) dropRemote(userID, nodeID string, recordLastSeen bool) {
+	p, ok := h.remote[userID][nodeID]
+	if !ok {
+		return
+	}
+	delete(h.remote[userID], nodeID)
+	if len(h.remote[userID]) == 0 {
+		delete(h.remote, userID)
+	}
+	if !h.online(userID) {
+		delete(h.unrecorded, userID)
+		h.presence = append(h.presence, presenceChange{user: &user.User{ID: userID, Username: p.username}, online: false, recordLastSeen: recordLastSeen})
+	}
+}
+
+// recentIDs is a fixed size set of the most recently seen message IDs.
+type recentIDs struct {
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ids: make(map[string]bool, size), order: make([]string, size)}
+}
+
+// add records id and reports whether it was new. The oldest ID is forgotten
+// once the set is full.
+func (r *recentIDs) add(id string) bool {
+	if r.ids[id] {
+		return false
+	}
+	if old := r.order[r.next]; old != "" {
+		delete(r.ids, old)
+	}
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.ids[id] = true
+	return true
+}
+
+// newNodeID returns a random identifier for this process.
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to something that is still unique enough per process.
+		return fmt.Sprintf("node-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// EventHandler processes the payload of a single inbound event.
+type EventHandler func(c *Client, payload json.RawMessage) error
+
+// Dispatcher routes inbound websocket frames to the handler registered for
+// their event type.
+type Dispatcher struct {
+	handlers map[string]EventHandler
+}
+
+func newDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[string]EventHandler)}
+}
+
+// Handle registers the handler for the given event type, replacing any
+// previous registration.
+func (d *Dispatcher) Handle(eventType string, h EventHandler) {
+	d.handlers[eventType] = h
+}
+
+// Dispatch decodes message as an Envelope and invokes the matching handler.
+// Malformed frames, unknown types and handler failures are reported back to
+// the client as "error" events.
+func (d *Dispatcher) Dispatch(c *Client, message []byte) {
+	var env Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		c.sendError(&EventError{Code: errCodeBadRequest, Message: "message is not a valid JSON envelope"})
+		return
+	}
+	if env.Type == "" {
+		c.sendError(&EventError{Code: errCodeBadRequest, Message: "missing event type"})
+		return
+	}
+
+	h, ok := d.handlers[env.Type]
+	if !ok {
+		c.sendError(&EventError{Code: errCodeUnknownType, Message: "unknown event type: " + env.Type})
+		return
+	}
+
+	if err := h(c, env.Payload); err != nil {
+		var evErr *EventError
+		if errors.As(err, &evErr) {
+			c.sendError(evErr)
+			return
+		}
+		log.Printf("error handling %s event: %v", env.Type, err)
+		c.sendError(&EventError{Code: errCodeInternal, Message: "internal server error"})
+	}
+}
+
+// decodePayload unmarshals an event payload, reporting failures as an
+// invalid_payload error.
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	if len(payload) == 0 {
+		return invalidPayload("missing payload")
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return invalidPayload("malformed payload")
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// dispatchAndReceive dispatches message from a fresh client and returns the
+// first frame the hub would deliver, either as a broadcast or as a direct
+// reply to the sender.
+func dispatchAndReceive(t *testing.T, message string) (Envelope, bool) {
+	t.Helper()
+
+	if messageStore == nil {
+		messageStore = &memMessageStore{}
+	}
+
+	hub := newHub(nil, nil)
+	client := &Client{
+		hub:   hub,
+		send:  make(chan []byte, 1),
+		user:  &user.User{ID: "user-123", Username: "Alice"},
+		rooms: map[string]bool{"room-1": true},
+	}
+
+	go hub.events.Dispatch(client, []byte(message))
+
+	var raw []byte
+	broadcast := false
+	select {
+	case raw = <-hub.broadcast:
+		broadcast = true
+	case m := <-hub.roomBroadcast:
+		raw = m.message
+		broadcast = true
+	case m := <-hub.userBroadcast:
+		raw = m.message
+		broadcast = true
+	case d := <-hub.deliver:
+		if d.client != client {
+			t.Fatalf("reply delivered to the wrong client")
+		}
+		raw = d.message
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatalf("hub received invalid JSON %q: %v", raw, err)
+	}
+	return env, broadcast
+}
+
+func TestDispatchSendMessage(t *testing.T) {
+	env, broadcast := dispatchAndReceive(t, `{"type":"send_message","payload":{"room_id":"room-1","username":"Mallory","content":"Hello everyone!"}}`)
+	if !broadcast {
+		t.Fatalf("expected message to be broadcast")
+	}
+	if env.Type != eventBroadcastMessage {
+		t.Fatalf("expected type %s, got %s", eventBroadcastMessage, env.Type)
+	}
+
+	var p BroadcastMessagePayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if p.RoomID != "room-1" || p.UserID != "user-123" || p.Username != "Alice" || p.Content != "Hello everyone!" {
+		t.Errorf("unexpected payload %+v", p)
+	}
+	if p.Timestamp.IsZero() {
+		t.Errorf("expected server timestamp to be set")
+	}
+	if p.ID == 0 {
+		t.Errorf("expected message to be persisted before broadcast")
+	}
+}
+
+func TestDispatchHistory(t *testing.T) {
+	store := &memMessageStore{}
+	messageStore = store
+	for _, content := range []string{"one", "two", "three"} {
+		_ = store.Create(context.Background(), &message.Message{RoomID: "room-1", Content: content})
+	}
+	_ = store.Create(context.Background(), &message.Message{RoomID: "room-2", Content: "elsewhere"})
+
+	env, broadcast := dispatchAndReceive(t, `{"type":"history","payload":{"room_id":"room-1","before":3,"limit":1}}`)
+	if broadcast {
+		t.Fatalf("expected history to be sent only to the requester")
+	}
+	if env.Type != eventMessageHistory {
+		t.Fatalf("expected type %s, got %s", eventMessageHistory, env.Type)
+	}
+
+	var p MessageHistoryPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if len(p.Messages) != 1 || p.Messages[0].Content != "two" {
+		t.Errorf("unexpected page %+v", p.Messages)
+	}
+	if !p.HasMore {
+		t.Errorf("expected has_more to be set")
+	}
+}
+
+func TestDispatchSendDirect(t *testing.T) {
+	messageStore = &memMessageStore{}
+	userStore = newMemUserStore(&user.User{ID: "user-456", Username: "Bob"})
+
+	env, broadcast := dispatchAndReceive(t, `{"type":"send_direct","payload":{"username":"Bob","content":"psst"}}`)
+	if !broadcast {
+		t.Fatalf("expected direct message to be fanned out")
+	}
+	if env.Type != eventDirectMessage {
+		t.Fatalf("expected type %s, got %s", eventDirectMessage, env.Type)
+	}
+
+	var p DirectMessagePayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if p.ID == 0 || p.SenderID != "user-123" || p.RecipientID != "user-456" || p.Content != "psst" {
+		t.Errorf("unexpected payload %+v", p)
+	}
+
+	env, _ = dispatchAndReceive(t, `{"type":"send_direct","payload":{"username":"Nobody","content":"hello?"}}`)
+	if env.Type != eventError {
+		t.Errorf("expected error for unknown recipient, got %s", env.Type)
+	}
+}
+
+func TestDispatchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		code    string
+	}{
+		{"not json", `hello`, errCodeBadRequest},
+		{"missing type", `{"payload":{}}`, errCodeBadRequest},
+		{"unknown type", `{"type":"launch_rockets","payload":{}}`, errCodeUnknownType},
+		{"server only type", `{"type":"broadcast_message","payload":{}}`, errCodeUnknownType},
+		{"missing payload", `{"type":"send_message"}`, errCodeInvalidPayload},
+		{"malformed payload", `{"type":"send_message","payload":"hi"}`, errCodeInvalidPayload},
+		{"missing room", `{"type":"send_message","payload":{"content":"hi"}}`, errCodeInvalidPayload},
+		{"empty content", `{"type":"send_message","payload":{"room_id":"room-1","content":"  "}}`, errCodeInvalidPayload},
+		{"not a member", `{"type":"send_message","payload":{"room_id":"room-2","content":"hi"}}`, errCodeForbidden},
+		{"history not a member", `{"type":"history","payload":{"room_id":"room-2"}}`, errCodeForbidden},
+		{"history limit", `{"type":"history","payload":{"room_id":"room-1","limit":1000}}`, errCodeInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, broadcast := dispatchAndReceive(t, tt.message)
+			if broadcast {
+				t.Fatalf("expected error reply, got broadcast")
+			}
+			if env.Type != eventError {
+				t.Fatalf("expected type %s, got %s", eventError, env.Type)
+			}
+			var p EventError
+			if err := json.Unmarshal(env.Payload, &p); err != nil {
+				t.Fatalf("invalid payload: %v", err)
+			}
+			if p.Code != tt.code {
+				t.Errorf("expected code %s, got %s", tt.code, p.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+)
+
+// maxTypingTargets bounds how many rooms and users a connection may be
+// typing to at once, and so how many expiry timers it holds.
+const maxTypingTargets = 32
+
+// ephemeralDropped counts ephemeral events not delivered because the
+// recipient had fallen behind.
+var ephemeralDropped = expvar.NewInt("ephemeral_dropped")
+
+// ephemeralMessage is a short-lived signal, such as a typing indicator, for
+// the members of a room or for every connection of a set of users. It is
+// never stored, so it is neither replayed nor part of history, and the
+// connections of the user it is from do not receive it. Recipients that have
+// fallen behind miss it instead of being subject to the slow consumer policy.
+type ephemeralMessage struct {
+	roomID  string
+	userIDs []string
+	from    string
+	message []byte
+}
+
+// sendEphemeral fans out m on this node.
+func (h *Hub) sendEphemeral(m ephemeralMessage) {
+	if m.roomID != "" {
+		for client := range h.rooms[m.roomID] {
+			h.offer(client, m.from, m.message)
+		}
+		return
+	}
+	for _, userID := range m.userIDs {
+		for client := range h.users[userID] {
+			h.offer(client, m.from, m.message)
+		}
+	}
+}
+
+// offer queues an ephemeral message for client if there is room for it right
+// away, unless the client belongs to the user it is from.
+func (h *Hub) offer(client *Client, from string, message []byte) {
+	if client.user.ID == from {
+		return
+	}
+	if client.overflow.len() == 0 {
+		select {
+		case client.send <- message:
+			return
+		default:
+		}
+	}
+	ephemeralDropped.Add(1)
+}
+
+// typingTarget is a room, or the user of a direct conversation, a connection
+// is typing to. Exactly one field is set.
+type typingTarget struct {
+	roomID string
+	userID string
+}
+
+// typingTimer expires a typing indicator the client did not renew.
+type typingTimer struct {
+	timer   *time.Timer
+	expires time.Time
+}
+
+// startTyping announces that c is typing to t, or extends the indicator if it
+// already is. Indicators expire after -typing-timeout unless renewed, so
+// clients that vanish without a typing_stop do not appear to type forever.
+func (c *Client) startTyping(t typingTarget) error {
+	c.typingMu.Lock()
+	expires := time.Now().Add(*typingTimeout)
+	if tt, ok := c.typing[t]; ok {
+		tt.expires = expires
+		tt.timer.Reset(*typingTimeout)
+		c.typingMu.Unlock()
+		return nil
+	}
+	if len(c.typing) >= maxTypingTargets {
+		c.typingMu.Unlock()
+		return &EventError{Code: errCodeBadRequest, Message: "typing in too many conversations"}
+	}
+	if c.typing == nil {
+		c.typing = make(map[typingTarget]*typingTimer)
+	}
+	c.typing[t] = &typingTimer{
+		timer:   time.AfterFunc(*typingTimeout, func() { c.expireTyping(t) }),
+		expires: expires,
+	}
+	c.typingMu.Unlock()
+
+	return c.announceTyping(eventTypingStart, t)
+}
+
+// stopTyping announces that c stopped typing to t. It does nothing if c was
+// not typing to t.
+func (c *Client) stopTyping(t typingTarget) error {
+	c.typingMu.Lock()
+	tt, ok := c.typing[t]
+	if ok {
+		tt.timer.Stop()
+		delete(c.typing, t)
+	}
+	c.typingMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return c.announceTyping(eventTypingStop, t)
+}
+
+// expireTyping runs when the timer of t fires. The indicator may have been
+// renewed while the timer was firing, in which case it was re-armed and is
+// kept.
+func (c *Client) expireTyping(t typingTarget) {
+	c.typingMu.Lock()
+	tt, ok := c.typing[t]
+	if !ok || time.Now().Before(tt.expires) {
+		c.typingMu.Unlock()
+		return
+	}
+	delete(c.typing, t)
+	c.typingMu.Unlock()
+
+	if err := c.announceTyping(eventTypingStop, t); err != nil {
+		log.Printf("error announcing expired typing indicator of %s: %v", c.user.ID, err)
+	}
+}
+
+// stopAllTyping ends every typing indicator of a connection that is going
+// away.
+func (c *Client) stopAllTyping() {
+	c.typingMu.Lock()
+	targets := make([]typingTarget, 0, len(c.typing))
+	for t, tt := range c.typing {
+		tt.timer.Stop()
+		targets = append(targets, t)
+	}
+	c.typing = nil
+	c.typingMu.Unlock()
+
+	for _, t := range targets {
+		if err := c.announceTyping(eventTypingStop, t); err != nil {
+			log.Printf("error announcing typing stop of %s: %v", c.user.ID, err)
+		}
+	}
+}
+
+// announceTyping fans out a typing event of c to the members of the room or
+// the other user of t.
+func (c *Client) announceTyping(eventType string, t typingTarget) error {
+	msg, err := encodeEvent(eventType, TypingIndicatorPayload{
+		RoomID:   t.roomID,
+		UserID:   c.user.ID,
+		Username: c.user.Username,
+	})
+	if err != nil {
+		return err
+	}
+	m := ephemeralMessage{roomID: t.roomID, from: c.user.ID, message: msg}
+	if t.userID != "" {
+		m.userIDs = []string{t.userID}
+	}
+	c.hub.ephemeral <- m
+	return nil
+}
+
+// decodeTypingTarget checks the payload of a typing event.
+func decodeTypingTarget(c *Client, payload json.RawMessage) (typingTarget, error) {
+	var p TypingPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return typingTarget{}, err
+	}
+	switch {
+	case p.RoomID != "" && p.UserID != "":
+		return typingTarget{}, invalidPayload("only one of room_id and user_id may be set")
+	case p.RoomID != "":
+	case p.UserID != "":
+		if p.UserID == c.user.ID {
+			return typingTarget{}, invalidPayload("cannot type to yourself")
+		}
+	default:
+		return typingTarget{}, invalidPayload("room_id or user_id is required")
+	}
+	return typingTarget{roomID: p.RoomID, userID: p.UserID}, nil
+}
+
+// handleTypingStart starts or renews a typing indicator. Typing events are not
+// answered; one addressed to a user ID that does not exist reaches nobody.
+func handleTypingStart(c *Client, payload json.RawMessage) error {
+	t, err := decodeTypingTarget(c, payload)
+	if err != nil {
+		return err
+	}
+	if t.roomID != "" && !c.inRoom(t.roomID) {
+		return &EventError{Code: errCodeForbidden, Message: "not a member of this room"}
+	}
+	return c.startTyping(t)
+}
+
+// handleTypingStop ends a typing indicator early. Membership is not checked,
+// so an indicator can still be stopped after leaving the room.
+func handleTypingStop(c *Client, payload json.RawMessage) error {
+	t, err := decodeTypingTarget(c, payload)
+	if err != nil {
+		return err
+	}
+	return c.stopTyping(t)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/broker"
+	"github.com/nexus-im/nexus/store/room"
+)
+
+func TestHubEphemeral(t *testing.T) {
+	h := newHub(nil, nil)
+	go h.run()
+
+	phone := newTestClient(h, "alice", "room-1")
+	laptop := newTestClient(h, "alice", "room-1")
+	bob := newTestClient(h, "bob", "room-1")
+	carol := newTestClient(h, "carol")
+	register(t, h, phone, laptop, bob, carol)
+
+	// The sender's own connections are skipped.
+	h.ephemeral <- ephemeralMessage{roomID: "room-1", from: "alice", message: []byte("typing")}
+	h.ephemeral <- ephemeralMessage{userIDs: []string{"carol"}, from: "alice", message: []byte("dm typing")}
+	expectMessage(t, bob, "typing")
+	expectMessage(t, carol, "dm typing")
+	settle(t, h, phone, laptop)
+
+	// A client that fell behind misses ephemeral events but is kept.
+	for i := 0; i < cap(bob.send); i++ {
+		h.deliver <- delivery{client: bob, message: []byte("backlog")}
+	}
+	dropped := ephemeralDropped.Value()
+	h.ephemeral <- ephemeralMessage{roomID: "room-1", from: "alice", message: []byte("missed")}
+	settle(t, h, carol)
+	if n := ephemeralDropped.Value() - dropped; n != 1 {
+		t.Errorf("expected 1 dropped, got %d", n)
+	}
+	for len(bob.send) > 0 {
+		if got := <-bob.send; string(got) != "backlog" {
+			t.Fatalf("unexpected message %q", got)
+		}
+	}
+	settle(t, h, bob)
+}
+
+func TestHubEphemeralClusterFanOut(t *testing.T) {
+	bus := broker.NewBus()
+	nodeA := newHub(nil, bus.Join(16))
+	nodeB := newHub(nil, bus.Join(16))
+	go nodeA.run()
+	go nodeB.run()
+
+	alice := newTestClient(nodeB, "alice", "room-1")
+	bob := newTestClient(nodeB, "bob", "room-1")
+	register(t, nodeB, alice, bob)
+
+	nodeA.ephemeral <- ephemeralMessage{roomID: "room-1", from: "alice", message: []byte(`"typing"`)}
+	expectMessage(t, bob, `"typing"`)
+	settle(t, nodeB, alice)
+}
+
+func expectTyping(t *testing.T, c *Client, wantType, wantRoom string) {
+	t.Helper()
+	env := nextEvent(t, c, eventTypingStart, eventTypingStop)
+	var p TypingIndicatorPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid typing payload: %v", err)
+	}
+	if env.Type != wantType || p.RoomID != wantRoom || p.UserID != "bob" || p.Username != "bob" {
+		t.Errorf("expected %s from bob in %q, got %s %+v", wantType, wantRoom, env.Type, p)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+	rooms := newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+	roomStore = rooms
+	if err := rooms.AddMember(context.Background(), "general", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	hub.join <- membership{userID: "alice", roomID: "general"}
+	alice := clients["alice-phone"]
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+	typing := func(eventType string, p TypingPayload) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventType, "payload": p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Renewing an indicator is not announced again.
+	typing(eventTypingStart, TypingPayload{RoomID: "general"})
+	expectTyping(t, alice, eventTypingStart, "general")
+	typing(eventTypingStart, TypingPayload{RoomID: "general"})
+	typing(eventTypingStop, TypingPayload{RoomID: "general"})
+	expectTyping(t, alice, eventTypingStop, "general")
+
+	// Indicators expire unless renewed.
+	defer func(d time.Duration) { *typingTimeout = d }(*typingTimeout)
+	*typingTimeout = 50 * time.Millisecond
+	typing(eventTypingStart, TypingPayload{UserID: "alice"})
+	expectTyping(t, alice, eventTypingStart, "")
+	expectTyping(t, alice, eventTypingStop, "")
+
+	// Disconnecting stops whatever is left.
+	*typingTimeout = time.Minute
+	typing(eventTypingStart, TypingPayload{UserID: "alice"})
+	expectTyping(t, alice, eventTypingStart, "")
+	_ = conn.Close()
+	expectTyping(t, alice, eventTypingStop, "")
+}
+
+func TestTypingRejected(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+
+	tests := []struct {
+		payload TypingPayload
+		code    string
+	}{
+		{TypingPayload{}, errCodeInvalidPayload},
+		{TypingPayload{RoomID: "general", UserID: "alice"}, errCodeInvalidPayload},
+		{TypingPayload{UserID: "bob"}, errCodeInvalidPayload},
+		{TypingPayload{RoomID: "general"}, errCodeForbidden},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventTypingStart, "payload": tt.payload}); err != nil {
+			t.Fatal(err)
+		}
+		env, _ := readUntil(t, conn, eventError)
+		var evErr EventError
+		if err := json.Unmarshal(env.Payload, &evErr); err != nil {
+			t.Fatal(err)
+		}
+		if evErr.Code != tt.code {
+			t.Errorf("%+v: expected %s, got %s", tt.payload, tt.code, evErr.Code)
+		}
+	}
+}
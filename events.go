@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/room"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// storeTimeout bounds the database work done while handling a single event.
+const storeTimeout = 5 * time.Second
+
+// maxRoomNameLength matches the rooms.name column.
+const maxRoomNameLength = 100
+
+// Page sizes for history requests.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+// newEventDispatcher returns a Dispatcher with all client -> server events of
+// the protocol registered.
+func newEventDispatcher() *Dispatcher {
+	d := newDispatcher()
+	d.Handle(eventAuth, handleAuth)
+	d.Handle(eventSendMessage, writes(handleSendMessage))
+	d.Handle(eventJoin, handleJoin)
+	d.Handle(eventCreateRoom, writes(handleCreateRoom))
+	d.Handle(eventJoinRoom, writes(handleJoinRoom))
+	d.Handle(eventLeaveRoom, writes(handleLeaveRoom))
+	d.Handle(eventListRooms, handleListRooms)
+	d.Handle(eventHistory, handleHistory)
+	d.Handle(eventSendDirect, writes(handleSendDirect))
+	d.Handle(eventDirectHistory, handleDirectHistory)
+	d.Handle(eventAck, writes(handleAck))
+	d.Handle(eventMarkRead, writes(handleMarkRead))
+	d.Handle(eventTypingStart, writes(handleTypingStart))
+	d.Handle(eventTypingStop, writes(handleTypingStop))
+	return d
+}
+
+// writes wraps the handler of an event that changes state, which connections
+// opened with an API key may only send if the key has the write scope.
+func writes(h EventHandler) EventHandler {
+	return func(c *Client, payload json.RawMessage) error {
+		if !c.allows(scopeWrite) {
+			return &EventError{Code: errCodeForbidden, Message: "api key lacks the write scope"}
+		}
+		return h(c, payload)
+	}
+}
+
+// handleAuth rejects auth events on connections that are already
+// authenticated; see authenticateConn for the first event of a connection.
+func handleAuth(c *Client, payload json.RawMessage) error {
+	return &EventError{Code: errCodeBadRequest, Message: "already authenticated"}
+}
+
+func handleSendMessage(c *Client, payload json.RawMessage) error {
+	var p SendMessagePayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.RoomID == "" {
+		return invalidPayload("room_id is required")
+	}
+	if strings.TrimSpace(p.Content) == "" {
+		return invalidPayload("content is required")
+	}
+	if !c.inRoom(p.RoomID) {
+		return &EventError{Code: errCodeForbidden, Message: "not a member of this room"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	// Persist before fan-out so that everything a client sees live can also
+	// be fetched from history.
+	stored := &message.Message{
+		RoomID:    p.RoomID,
+		UserID:    c.user.ID,
+		Username:  c.user.Username,
+		Content:   p.Content,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := messageStore.Create(ctx, stored); err != nil {
+		if errors.Is(err, message.ErrRoomNotFound) {
+			return &EventError{Code: errCodeNotFound, Message: "room not found"}
+		}
+		return err
+	}
+	markOwnMessageRead(ctx, c.user.ID, p.RoomID, stored.Seq)
+
+	msg, err := encodeEvent(eventBroadcastMessage, messagePayload(stored))
+	if err != nil {
+		return err
+	}
+	c.hub.roomBroadcast <- roomMessage{roomID: p.RoomID, message: msg}
+	return nil
+}
+
+func handleHistory(c *Client, payload json.RawMessage) error {
+	var p HistoryPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.RoomID == "" {
+		return invalidPayload("room_id is required")
+	}
+	if p.Limit < 0 || p.Limit > maxHistoryLimit {
+		return invalidPayload("limit is out of range")
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultHistoryLimit
+	}
+	if !c.inRoom(p.RoomID) {
+		return &EventError{Code: errCodeForbidden, Message: "not a member of this room"}
+	}
+
+	return sendHistory(c, p.RoomID, p.Before, p.Limit)
+}
+
+// sendHistory delivers a page of a room's history to c.
+func sendHistory(c *Client, roomID string, before int64, limit int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	// Fetch one extra message to find out whether there is an older page.
+	msgs, err := messageStore.ListByRoom(ctx, roomID, before, limit+1)
+	if err != nil {
+		return err
+	}
+	hasMore := len(msgs) > limit
+	if hasMore {
+		msgs = msgs[1:]
+	}
+
+	page := MessageHistoryPayload{
+		RoomID:   roomID,
+		Messages: make([]BroadcastMessagePayload, 0, len(msgs)),
+		HasMore:  hasMore,
+	}
+	for _, msg := range msgs {
+		page.Messages = append(page.Messages, messagePayload(msg))
+	}
+	return c.sendEvent(eventMessageHistory, page)
+}
+
+func handleSendDirect(c *Client, payload json.RawMessage) error {
+	var p SendDirectPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if strings.TrimSpace(p.Content) == "" {
+		return invalidPayload("content is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	var recipient *user.User
+	var err error
+	switch {
+	case p.UserID != "":
+		recipient, err = userStore.GetByID(ctx, p.UserID)
+	case p.Username != "":
+		recipient, err = userStore.GetByUsername(ctx, p.Username)
+	default:
+		return invalidPayload("user_id or username is required")
+	}
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			return &EventError{Code: errCodeNotFound, Message: "user not found"}
+		}
+		return err
+	}
+
+	stored := &message.DirectMessage{
+		SenderID:       c.user.ID,
+		RecipientID:    recipient.ID,
+		SenderUsername: c.user.Username,
+		Content:        p.Content,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := messageStore.CreateDirect(ctx, stored); err != nil {
+		return err
+	}
+
+	msg, err := encodeEvent(eventDirectMessage, directMessagePayload(stored))
+	if err != nil {
+		return err
+	}
+	// The sender's own connections get a copy too, so their other devices
+	// stay in sync and the sending one learns the message ID.
+	c.hub.userBroadcast <- userMessage{userIDs: []string{recipient.ID, c.user.ID}, message: msg}
+	return nil
+}
+
+func handleDirectHistory(c *Client, payload json.RawMessage) error {
+	var p DirectHistoryPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.UserID == "" {
+		return invalidPayload("user_id is required")
+	}
+	if p.Limit < 0 || p.Limit > maxHistoryLimit {
+		return invalidPayload("limit is out of range")
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultHistoryLimit
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	msgs, err := messageStore.ListDirect(ctx, c.user.ID, p.UserID, p.Before, p.Limit+1)
+	if err != nil {
+		return err
+	}
+	hasMore := len(msgs) > p.Limit
+	if hasMore {
+		msgs = msgs[1:]
+	}
+
+	page := DirectHistoryResultPayload{
+		UserID:   p.UserID,
+		Messages: make([]DirectMessagePayload, 0, len(msgs)),
+		HasMore:  hasMore,
+	}
+	for _, msg := range msgs {
+		page.Messages = append(page.Messages, directMessagePayload(msg))
+	}
+	return c.sendEvent(eventDirectHistoryResult, page)
+}
+
+// handleJoin answers the optional handshake with the current user_list. The
+// hub announces users on its own when they connect, so the payload is
+// accepted for compatibility but ignored.
+func handleJoin(c *Client, _ json.RawMessage) error {
+	c.hub.userList <- c
+	return nil
+}
+
+func handleCreateRoom(c *Client, payload json.RawMessage) error {
+	var p CreateRoomPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(p.Name)
+	if name == "" {
+		return invalidPayload("name is required")
+	}
+	if utf8.RuneCountInString(name) > maxRoomNameLength {
+		return invalidPayload("name is too long")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rm := &room.Room{Name: name, CreatedBy: c.user.ID}
+	if err := roomStore.Create(ctx, rm); err != nil {
+		if errors.Is(err, room.ErrDuplicateRoomName) {
+			return &EventError{Code: errCodeConflict, Message: "room name already exists"}
+		}
+		return err
+	}
+	if err := roomStore.AddMember(ctx, rm.ID, c.user.ID); err != nil {
+		return err
+	}
+
+	return enterRoom(c, rm)
+}
+
+func handleJoinRoom(c *Client, payload json.RawMessage) error {
+	var p JoinRoomPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	var rm *room.Room
+	var err error
+	switch {
+	case p.RoomID != "":
+		rm, err = roomStore.GetByID(ctx, p.RoomID)
+	case strings.TrimSpace(p.Name) != "":
+		rm, err = roomStore.GetByName(ctx, strings.TrimSpace(p.Name))
+	default:
+		return invalidPayload("room_id or name is required")
+	}
+	if err != nil {
+		if errors.Is(err, room.ErrRoomNotFound) {
+			return &EventError{Code: errCodeNotFound, Message: "room not found"}
+		}
+		return err
+	}
+
+	if err := roomStore.AddMember(ctx, rm.ID, c.user.ID); err != nil {
+		return err
+	}
+
+	return enterRoom(c, rm)
+}
+
+// enterRoom subscribes all of the user's connections to rm and announces the
+// user to the other members.
+func enterRoom(c *Client, rm *room.Room) error {
+	wasMember := c.inRoom(rm.ID)
+
+	notice, err := encodeEvent(eventRoomJoined, RoomJoinedPayload{Room: rm})
+	if err != nil {
+		return err
+	}
+	c.hub.join <- membership{userID: c.user.ID, roomID: rm.ID, notice: notice}
+
+	if wasMember {
+		return nil
+	}
+	return notifyRoom(c.hub, rm.ID, c.user.Username+" has joined #"+rm.Name)
+}
+
+func handleLeaveRoom(c *Client, payload json.RawMessage) error {
+	var p LeaveRoomPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.RoomID == "" {
+		return invalidPayload("room_id is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rm, err := roomStore.GetByID(ctx, p.RoomID)
+	if err != nil {
+		if errors.Is(err, room.ErrRoomNotFound) {
+			return &EventError{Code: errCodeNotFound, Message: "room not found"}
+		}
+		return err
+	}
+
+	if err := roomStore.RemoveMember(ctx, rm.ID, c.user.ID); err != nil {
+		if errors.Is(err, room.ErrNotMember) {
+			return &EventError{Code: errCodeNotFound, Message: "not a member of this room"}
+		}
+		return err
+	}
+
+	notice, err := encodeEvent(eventRoomLeft, RoomLeftPayload{RoomID: rm.ID})
+	if err != nil {
+		return err
+	}
+	c.hub.leave <- membership{userID: c.user.ID, roomID: rm.ID, notice: notice}
+
+	return notifyRoom(c.hub, rm.ID, c.user.Username+" has left #"+rm.Name)
+}
+
+func handleListRooms(c *Client, _ json.RawMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rooms, err := roomStore.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]RoomListEntry, 0, len(rooms))
+	for _, rm := range rooms {
+		entries = append(entries, RoomListEntry{Room: rm, Joined: c.inRoom(rm.ID)})
+	}
+	return c.sendEvent(eventRoomList, RoomListPayload{Rooms: entries})
+}
+
+// notifyRoom sends a system notification to the members of a room.
+func notifyRoom(h *Hub, roomID, content string) error {
+	msg, err := encodeEvent(eventSystemNotification, SystemNotificationPayload{
+		RoomID:    roomID,
+		Content:   content,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	h.roomBroadcast <- roomMessage{roomID: roomID, message: msg}
+	return nil
+}
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexus-im/nexus/mailer"
+	"github.com/nexus-im/nexus/store/apikey"
+	"github.com/nexus-im/nexus/store/attempt"
+	"github.com/nexus-im/nexus/store/cursor"
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/mfa"
+	"github.com/nexus-im/nexus/store/readmarker"
+	"github.com/nexus-im/nexus/store/room"
+	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// memMessageStore is an in-memory message.Store for handler tests.
+type memMessageStore struct {
+	mu     sync.Mutex
+	msgs   []*message.Message
+	direct []*message.DirectMessage
+}
+
+func (s *memMessageStore) Create(_ context.Context, msg *message.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg.ID = int64(len(s.msgs) + 1)
+	msg.Seq = 1
+	for _, m := range s.msgs {
+		if m.RoomID == msg.RoomID {
+			msg.Seq = m.Seq + 1
+		}
+	}
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *memMessageStore) ListByRoom(_ context.Context, roomID string, before int64, limit int) ([]*message.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page []*message.Message
+	for i := len(s.msgs) - 1; i >= 0 && len(page) < limit; i-- {
+		msg := s.msgs[i]
+		if msg.RoomID == roomID && (before <= 0 || msg.ID < before) {
+			page = append([]*message.Message{msg}, page...)
+		}
+	}
+	return page, nil
+}
+
+func (s *memMessageStore) ListAfter(_ context.Context, roomID string, after int64, limit int) ([]*message.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page []*message.Message
+	for _, msg := range s.msgs {
+		if msg.RoomID == roomID && msg.Seq > after && len(page) < limit {
+			page = append(page, msg)
+		}
+	}
+	return page, nil
+}
+
+func (s *memMessageStore) CreateDirect(_ context.Context, msg *message.DirectMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.direct = append(s.direct, msg)
+	msg.ID = int64(len(s.direct))
+	return nil
+}
+
+func (s *memMessageStore) ListDirect(_ context.Context, userID, peerID string, before int64, limit int) ([]*message.DirectMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page []*message.DirectMessage
+	for i := len(s.direct) - 1; i >= 0 && len(page) < limit; i-- {
+		msg := s.direct[i]
+		between := (msg.SenderID == userID && msg.RecipientID == peerID) ||
+			(msg.SenderID == peerID && msg.RecipientID == userID)
+		if between && (before <= 0 || msg.ID < before) {
+			page = append([]*message.DirectMessage{msg}, page...)
+		}
+	}
+	return page, nil
+}
+
+// memAttemptStore is an in-memory attempt.Store for handler tests.
+type memAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*attempt.Attempt
+}
+
+func newMemAttemptStore() *memAttemptStore {
+	return &memAttemptStore{attempts: make(map[string]*attempt.Attempt)}
+}
+
+func (s *memAttemptStore) Get(_ context.Context, key string) (*attempt.Attempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.attempts[key]; ok {
+		copied := *a
+		return &copied, nil
+	}
+	return &attempt.Attempt{Key: key}, nil
+}
+
+func (s *memAttemptStore) RecordFailure(_ context.Context, key string, at, resetBefore time.Time) (*attempt.Attempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	if !ok {
+		a = &attempt.Attempt{Key: key}
+		s.attempts[key] = a
+	}
+	if a.LastFailureAt.Before(resetBefore) {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailureAt = at
+	copied := *a
+	return &copied, nil
+}
+
+func (s *memAttemptStore) Lock(_ context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.attempts[key]; ok {
+		a.LockedUntil = until
+	}
+	return nil
+}
+
+func (s *memAttemptStore) Reset(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *memAttemptStore) DeleteStale(_ context.Context, before, now time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, a := range s.attempts {
+		if a.LastFailureAt.Before(before) && !a.LockedUntil.After(now) && n < int64(limit) {
+			delete(s.attempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memRoomStore is an in-memory room.Store for handler tests.
+type memRoomStore struct {
+	mu      sync.Mutex
+	rooms   map[string]*room.Room
+	members map[string]map[string]bool // room ID -> user IDs
+}
+
+func newMemRoomStore(rooms ...*room.Room) *memRoomStore {
+	s := &memRoomStore{
+		rooms:   make(map[string]*room.Room),
+		members: make(map[string]map[string]bool),
+	}
+	for _, rm := range rooms {
+		s.rooms[rm.ID] = rm
+	}
+	return s
+}
+
+func (s *memRoomStore) Create(_ context.Context, rm *room.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.rooms {
+		if existing.Name == rm.Name {
+			return room.ErrDuplicateRoomName
+		}
+	}
+	if rm.ID == "" {
+		rm.ID = "room-" + rm.Name
+	}
+	s.rooms[rm.ID] = rm
+	return nil
+}
+
+func (s *memRoomStore) GetByID(_ context.Context, id string) (*room.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rm, ok := s.rooms[id]; ok {
+		return rm, nil
+	}
+	return nil, room.ErrRoomNotFound
+}
+
+func (s *memRoomStore) GetByName(_ context.Context, name string) (*room.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rm := range s.rooms {
+		if rm.Name == name {
+			return rm, nil
+		}
+	}
+	return nil, room.ErrRoomNotFound
+}
+
+func (s *memRoomStore) List(_ context.Context) ([]*room.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*room.Room
+	for _, rm := range s.rooms {
+		list = append(list, rm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memRoomStore) AddMember(_ context.Context, roomID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; !ok {
+		return room.ErrRoomNotFound
+	}
+	if s.members[roomID] == nil {
+		s.members[roomID] = make(map[string]bool)
+	}
+	s.members[roomID][userID] = true
+	return nil
+}
+
+func (s *memRoomStore) RemoveMember(_ context.Context, roomID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.members[roomID][userID] {
+		return room.ErrNotMember
+	}
+	delete(s.members[roomID], userID)
+	return nil
+}
+
+func (s *memRoomStore) ListMembers(_ context.Context, roomID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.members[roomID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memRoomStore) ListByUser(_ context.Context, userID string) ([]*room.Room, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*room.Room
+	for id, members := range s.members {
+		if members[userID] {
+			list = append(list, s.rooms[id])
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (s *memRoomStore) ListCoMembers(_ context.Context, userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, members := range s.members {
+		if !members[userID] {
+			continue
+		}
+		for id := range members {
+			seen[id] = true
+		}
+	}
+	var ids []string
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// memUserStore is an in-memory user.Store for handler tests.
+type memUserStore struct {
+	mu         sync.Mutex
+	users      map[string]*user.User
+	identities map[string]string // provider + "|" + subject -> user ID
+	avatars    map[string]*user.Avatar
+}
+
+func newMemUserStore(users ...*user.User) *memUserStore {
+	s := &memUserStore{
+		users:      make(map[string]*user.User),
+		identities: make(map[string]string),
+		avatars:    make(map[string]*user.Avatar),
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+	}
+	return s
+}
+
+func (s *memUserStore) Create(_ context.Context, u *user.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if strings.EqualFold(existing.Username, u.Username) {
+			return user.ErrDuplicateUsername
+		}
+	}
+	u.ID = "user-" + u.Username
+	s.users[u.ID] = u
+	return nil
+}
+
+func (s *memUserStore) GetByID(_ context.Context, id string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[id]; ok {
+		return u, nil
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (s *memUserStore) GetByUsername(_ context.Context, username string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (s *memUserStore) GetByEmail(_ context.Context, email string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (s *memUserStore) UpdateProfile(_ context.Context, id string, update user.ProfileUpdate) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, user.ErrUserNotFound
+	}
+	if update.DisplayName != nil {
+		u.DisplayName = *update.DisplayName
+	}
+	if update.Bio != nil {
+		u.Bio = *update.Bio
+	}
+	if update.AvatarURL != nil {
+		u.AvatarURL = *update.AvatarURL
+	}
+	if update.SetStatus {
+		u.Status = update.Status
+	}
+	updated := *u
+	return &updated, nil
+}
+
+func (s *memUserStore) SetAvatar(_ context.Context, avatar *user.Avatar) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[avatar.UserID]; !ok {
+		return user.ErrUserNotFound
+	}
+	s.avatars[avatar.UserID] = avatar
+	return nil
+}
+
+func (s *memUserStore) GetAvatar(_ context.Context, userID string) (*user.Avatar, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if avatar, ok := s.avatars[userID]; ok {
+		return avatar, nil
+	}
+	return nil, user.ErrAvatarNotFound
+}
+
+func (s *memUserStore) DeleteAvatar(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.avatars, userID)
+	return nil
+}
+
+func (s *memUserStore) UpdatePassword(_ context.Context, id, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return user.ErrUserNotFound
+	}
+	u.PasswordHash = passwordHash
+	return nil
+}
+
+func (s *memUserStore) UpdateLastSeen(_ context.Context, id string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return user.ErrUserNotFound
+	}
+	u.LastSeen = lastSeen
+	return nil
+}
+
+func (s *memUserStore) GetByIdentity(_ context.Context, provider, subject string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[s.identities[provider+"|"+subject]]; ok {
+		return u, nil
+	}
+	return nil, user.ErrUserNotFound
+}
+
+func (s *memUserStore) CreateWithIdentity(ctx context.Context, u *user.User, provider, subject string) error {
+	if err := s.Create(ctx, u); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identities[provider+"|"+subject] = u.ID
+	return nil
+}
+
+// memSessionStore is an in-memory session.Store for handler tests.
+type memSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session.Session
+	refresh  map[string]*session.RefreshToken  // by token
+	tickets  map[string]*session.Ticket        // by token
+	mfa      map[string]*session.MFAChallenge  // by token
+	resets   map[string]*session.PasswordReset // by token
+	nextID   int
+}
+
+func newMemSessionStore(sessions ...*session.Session) *memSessionStore {
+	s := &memSessionStore{
+		sessions: make(map[string]*session.Session),
+		refresh:  make(map[string]*session.RefreshToken),
+		tickets:  make(map[string]*session.Ticket),
+		mfa:      make(map[string]*session.MFAChallenge),
+		resets:   make(map[string]*session.PasswordReset),
+	}
+	for _, sess := range sessions {
+		s.sessions[sess.ID] = sess
+	}
+	return s
+}
+
+func (s *memSessionStore) Create(_ context.Context, sess *session.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.ID == "" {
+		sess.ID = "session-" + sess.Token
+	}
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memSessionStore) GetByToken(_ context.Context, token string) (*session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.Token == token {
+			if time.Now().After(sess.ExpiresAt) {
+				return nil, session.ErrSessionExpired
+			}
+			return sess, nil
+		}
+	}
+	return nil, session.ErrSessionNotFound
+}
+
+func (s *memSessionStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return session.ErrSessionNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memSessionStore) ListByUser(_ context.Context, userID string) ([]*session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*session.Session
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && time.Now().Before(sess.ExpiresAt) {
+			list = append(list, sess)
+		}
+	}
+	return list, nil
+}
+
+func (s *memSessionStore) DeleteAllForUser(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	for token, rt := range s.refresh {
+		if rt.UserID == userID {
+			delete(s.refresh, token)
+		}
+	}
+	return nil
+}
+
+func (s *memSessionStore) DeleteOthersForUser(_ context.Context, userID string, keep *session.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := func(id, familyID string) bool {
+		return id == keep.ID || (keep.FamilyID != "" && familyID == keep.FamilyID)
+	}
+	for id, sess := range s.sessions {
+		if sess.UserID == userID && !kept(id, sess.FamilyID) {
+			delete(s.sessions, id)
+		}
+	}
+	for token, rt := range s.refresh {
+		if rt.UserID == userID && !kept("", rt.FamilyID) {
+			delete(s.refresh, token)
+		}
+	}
+	return nil
+}
+
+func (s *memSessionStore) DeleteExpired(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for id, sess := range s.sessions {
+		if n == int64(limit) {
+			break
+		}
+		if sess.ExpiresAt.Before(before) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memSessionStore) CreateRefreshToken(_ context.Context, rt *session.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createRefreshToken(rt)
+	return nil
+}
+
+func (s *memSessionStore) createRefreshToken(rt *session.RefreshToken) {
+	s.nextID++
+	rt.ID = fmt.Sprintf("refresh-%d", s.nextID)
+	if rt.FamilyID == "" {
+		rt.FamilyID = "family-" + rt.ID
+	}
+	s.refresh[rt.Token] = rt
+}
+
+func (s *memSessionStore) RotateRefreshToken(_ context.Context, token string, next *session.RefreshToken) (*session.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.refresh[token]
+	if !ok {
+		return nil, session.ErrRefreshTokenNotFound
+	}
+	if current.UsedAt != nil {
+		return current, session.ErrRefreshTokenReused
+	}
+	now := time.Now()
+	if now.After(current.ExpiresAt) {
+		return nil, session.ErrRefreshTokenExpired
+	}
+	current.UsedAt = &now
+	next.FamilyID = current.FamilyID
+	next.UserID = current.UserID
+	s.createRefreshToken(next)
+	return current, nil
+}
+
+func (s *memSessionStore) RevokeFamily(_ context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, rt := range s.refresh {
+		if rt.FamilyID == familyID {
+			delete(s.refresh, token)
+		}
+	}
+	for id, sess := range s.sessions {
+		if sess.FamilyID == familyID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memSessionStore) DeleteExpiredRefreshTokens(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for token, rt := range s.refresh {
+		if n == int64(limit) {
+			break
+		}
+		if rt.ExpiresAt.Before(before) {
+			delete(s.refresh, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memSessionStore) CreateTicket(_ context.Context, ticket *session.Ticket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickets[ticket.Token] = ticket
+	return nil
+}
+
+func (s *memSessionStore) RedeemTicket(_ context.Context, token string) (*session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket, ok := s.tickets[token]
+	if !ok {
+		return nil, session.ErrTicketNotFound
+	}
+	delete(s.tickets, token)
+	sess, ok := s.sessions[ticket.SessionID]
+	if !ok {
+		return nil, session.ErrTicketNotFound
+	}
+	if time.Now().After(ticket.ExpiresAt) {
+		return nil, session.ErrTicketExpired
+	}
+	if time.Now().After(sess.ExpiresAt) {
+		return nil, session.ErrSessionExpired
+	}
+	return sess, nil
+}
+
+func (s *memSessionStore) DeleteExpiredTickets(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for token, ticket := range s.tickets {
+		if n == int64(limit) {
+			break
+		}
+		if ticket.ExpiresAt.Before(before) {
+			delete(s.tickets, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memSessionStore) CreateMFAChallenge(_ context.Context, challenge *session.MFAChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mfa[challenge.Token] = challenge
+	return nil
+}
+
+func (s *memSessionStore) GetMFAChallenge(_ context.Context, token string) (*session.MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.mfa[token]
+	if !ok {
+		return nil, session.ErrChallengeNotFound
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, session.ErrChallengeExpired
+	}
+	return challenge, nil
+}
+
+func (s *memSessionStore) DeleteMFAChallenge(_ context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mfa[token]; !ok {
+		return session.ErrChallengeNotFound
+	}
+	delete(s.mfa, token)
+	return nil
+}
+
+func (s *memSessionStore) DeleteExpiredMFAChallenges(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for token, challenge := range s.mfa {
+		if n == int64(limit) {
+			break
+		}
+		if challenge.ExpiresAt.Before(before) {
+			delete(s.mfa, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memMFAStore is an in-memory mfa.Store for handler tests.
+type memMFAStore struct {
+	mu       sync.Mutex
+	totp     map[string]*mfa.TOTP
+	recovery map[string]map[string]bool // user ID -> recovery codes
+}
+
+func newMemMFAStore() *memMFAStore {
+	return &memMFAStore{
+		totp:     make(map[string]*mfa.TOTP),
+		recovery: make(map[string]map[string]bool),
+	}
+}
+
+func (s *memMFAStore) GetTOTP(_ context.Context, userID string) (*mfa.TOTP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok {
+		return nil, mfa.ErrNotEnrolled
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (s *memMFAStore) BeginEnrollment(_ context.Context, userID, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.totp[userID]; ok && t.Enabled() {
+		return mfa.ErrAlreadyEnabled
+	}
+	s.totp[userID] = &mfa.TOTP{UserID: userID, Secret: secret, CreatedAt: time.Now()}
+	return nil
+}
+
+func (s *memMFAStore) ConfirmEnrollment(_ context.Context, userID string, step int64, recoveryCodes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok || t.Enabled() {
+		return mfa.ErrNotEnrolled
+	}
+	now := time.Now()
+	t.ConfirmedAt = &now
+	t.LastUsedStep = step
+	s.recovery[userID] = make(map[string]bool)
+	for _, code := range recoveryCodes {
+		s.recovery[userID][code] = true
+	}
+	return nil
+}
+
+func (s *memMFAStore) UseStep(_ context.Context, userID string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok || t.LastUsedStep >= step {
+		return mfa.ErrCodeReused
+	}
+	t.LastUsedStep = step
+	return nil
+}
+
+func (s *memMFAStore) UseRecoveryCode(_ context.Context, userID, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.recovery[userID][code] {
+		return mfa.ErrRecoveryCodeNotFound
+	}
+	delete(s.recovery[userID], code)
+	return nil
+}
+
+func (s *memMFAStore) Disable(_ context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.totp[userID]; !ok {
+		return mfa.ErrNotEnrolled
+	}
+	delete(s.totp, userID)
+	delete(s.recovery, userID)
+	return nil
+}
+
+func (s *memSessionStore) CreatePasswordReset(_ context.Context, reset *session.PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resets[reset.Token] = reset
+	return nil
+}
+
+func (s *memSessionStore) RedeemPasswordReset(_ context.Context, token string) (*session.PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reset, ok := s.resets[token]
+	if !ok {
+		return nil, session.ErrResetNotFound
+	}
+	for t, other := range s.resets {
+		if other.UserID == reset.UserID {
+			delete(s.resets, t)
+		}
+	}
+	if time.Now().After(reset.ExpiresAt) {
+		return nil, session.ErrResetExpired
+	}
+	return reset, nil
+}
+
+func (s *memSessionStore) DeleteExpiredPasswordResets(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for token, reset := range s.resets {
+		if n == int64(limit) {
+			break
+		}
+		if reset.ExpiresAt.Before(before) {
+			delete(s.resets, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memMailer records the messages it is asked to send, or fails with err if
+// set.
+type memMailer struct {
+	mu   sync.Mutex
+	sent []*mailer.Message
+	err  error
+}
+
+func (m *memMailer) Send(_ context.Context, msg *mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// memAPIKeyStore is an in-memory apikey.Store for handler tests.
+type memAPIKeyStore struct {
+	mu     sync.Mutex
+	keys   map[string]*apikey.Key // by ID
+	nextID int
+}
+
+func newMemAPIKeyStore() *memAPIKeyStore {
+	return &memAPIKeyStore{keys: make(map[string]*apikey.Key)}
+}
+
+func (s *memAPIKeyStore) Create(_ context.Context, key *apikey.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	key.ID = fmt.Sprintf("key-%d", s.nextID)
+	stored := *key
+	s.keys[key.ID] = &stored
+	return nil
+}
+
+func (s *memAPIKeyStore) GetByToken(_ context.Context, token string) (*apikey.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if key.Token == token {
+			if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+				return nil, apikey.ErrKeyExpired
+			}
+			k := *key
+			return &k, nil
+		}
+	}
+	return nil, apikey.ErrKeyNotFound
+}
+
+func (s *memAPIKeyStore) GetByID(_ context.Context, id string) (*apikey.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, apikey.ErrKeyNotFound
+	}
+	k := *key
+	k.Token = ""
+	return &k, nil
+}
+
+func (s *memAPIKeyStore) ListByUser(_ context.Context, userID string) ([]*apikey.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*apikey.Key
+	for _, key := range s.keys {
+		if key.UserID == userID {
+			k := *key
+			k.Token = ""
+			keys = append(keys, &k)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memAPIKeyStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[id]; !ok {
+		return apikey.ErrKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *memAPIKeyStore) Touch(_ context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[id]; ok {
+		key.LastUsedAt = &at
+	}
+	return nil
+}
+
+// memCursorStore is an in-memory cursor.Store for handler tests.
+type memCursorStore struct {
+	mu      sync.Mutex
+	cursors map[[3]string]*cursor.Cursor
+}
+
+func newMemCursorStore() *memCursorStore {
+	return &memCursorStore{cursors: make(map[[3]string]*cursor.Cursor)}
+}
+
+func (s *memCursorStore) Ack(_ context.Context, c *cursor.Cursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := [3]string{c.UserID, c.StreamID, c.RoomID}
+	if old, ok := s.cursors[key]; ok && old.Seq > c.Seq {
+		return nil
+	}
+	stored := *c
+	s.cursors[key] = &stored
+	return nil
+}
+
+func (s *memCursorStore) List(_ context.Context, userID, streamID string) ([]*cursor.Cursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cursors []*cursor.Cursor
+	for _, c := range s.cursors {
+		if c.UserID == userID && c.StreamID == streamID {
+			copied := *c
+			cursors = append(cursors, &copied)
+		}
+	}
+	sort.Slice(cursors, func(i, j int) bool { return cursors[i].RoomID < cursors[j].RoomID })
+	return cursors, nil
+}
+
+func (s *memCursorStore) DeleteStale(_ context.Context, before time.Time, limit int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, c := range s.cursors {
+		if c.UpdatedAt.Before(before) && n < int64(limit) {
+			delete(s.cursors, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memReadMarkerStore is an in-memory readmarker.Store for handler tests. It
+// reads memberships and the last sequence of each room from the given stores,
+// either of which may be nil.
+type memReadMarkerStore struct {
+	mu       sync.Mutex
+	markers  map[[2]string]int64 // user ID, room ID -> seq
+	rooms    *memRoomStore
+	messages *memMessageStore
+}
+
+func newMemReadMarkerStore(rooms *memRoomStore, messages *memMessageStore) *memReadMarkerStore {
+	return &memReadMarkerStore{markers: make(map[[2]string]int64), rooms: rooms, messages: messages}
+}
+
+func (s *memReadMarkerStore) lastSeq(roomID string) int64 {
+	if s.messages == nil {
+		return 0
+	}
+	s.messages.mu.Lock()
+	defer s.messages.mu.Unlock()
+	var seq int64
+	for _, msg := range s.messages.msgs {
+		if msg.RoomID == roomID {
+			seq = msg.Seq
+		}
+	}
+	return seq
+}
+
+func (s *memReadMarkerStore) Mark(_ context.Context, m *readmarker.Marker) (bool, error) {
+	last := s.lastSeq(m.RoomID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := min(m.Seq, last)
+	key := [2]string{m.UserID, m.RoomID}
+	if last == 0 || s.markers[key] >= seq {
+		return false, nil
+	}
+	s.markers[key] = seq
+	m.Seq = seq
+	return true, nil
+}
+
+func (s *memReadMarkerStore) Unread(ctx context.Context, userID string) ([]*readmarker.Unread, error) {
+	if s.rooms == nil {
+		return nil, nil
+	}
+	rooms, err := s.rooms.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+
+	var unread []*readmarker.Unread
+	for _, rm := range rooms {
+		last := s.lastSeq(rm.ID)
+		s.mu.Lock()
+		read := s.markers[[2]string{userID, rm.ID}]
+		s.mu.Unlock()
+		unread = append(unread, &readmarker.Unread{RoomID: rm.ID, LastReadSeq: read, LastSeq: last, Count: max(last-read, 0)})
+	}
+	return unread, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Framings of outbound events, chosen by the client with the batch query
+// parameter when connecting.
+const (
+	// framingSingle sends every event in a frame of its own.
+	framingSingle = ""
+
+	// framingArray sends frames holding a JSON array of one or more events.
+	framingArray = "array"
+
+	// framingNDJSON sends frames holding one or more events, each followed
+	// by a newline.
+	framingNDJSON = "ndjson"
+)
+
+// framing decides how events queued for a client are packed into websocket
+// frames. Batches hold at most maxEvents events and, unless a single event is
+// larger, maxBytes bytes of events.
+type framing struct {
+	format    string
+	maxEvents int
+	maxBytes  int
+}
+
+// parseFraming checks the batch query parameter of a connection.
+func parseFraming(format string) (framing, error) {
+	switch format {
+	case framingSingle, framingArray, framingNDJSON:
+	default:
+		return framing{}, fmt.Errorf("unknown batch format %q", format)
+	}
+	return framing{format: format, maxEvents: *batchMaxEvents, maxBytes: *batchMaxBytes}, nil
+}
+
+// batches reports whether more than one event may share a frame.
+func (f framing) batches() bool {
+	return f.format != framingSingle && f.maxEvents > 1
+}
+
+// writeFrame writes messages, which must not be empty, as a single frame.
+func (c *Client) writeFrame(messages [][]byte) error {
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+
+	var open, sep, end []byte
+	switch c.framing.format {
+	case framingArray:
+		open, sep, end = []byte("["), []byte(","), []byte("]")
+	case framingNDJSON:
+		sep, end = []byte("\n"), []byte("\n")
+	}
+
+	if _, err := w.Write(open); err != nil {
+		return err
+	}
+	for i, message := range messages {
+		if i > 0 {
+			if _, err := w.Write(sep); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(message); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(end); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// writeBatches writes message and, if the client asked for batches, the
+// messages already queued behind it, in as few frames as the limits allow.
+// It reports whether the hub closed the send channel meanwhile.
+func (c *Client) writeBatches(message []byte) (closed bool, err error) {
+	for message != nil {
+		batch := [][]byte{message}
+		size := len(message)
+		message = nil
+
+	fill:
+		for c.framing.batches() && len(batch) < c.framing.maxEvents {
+			select {
+			case next, ok := <-c.send:
+				if !ok {
+					closed = true
+					break fill
+				}
+				if size+len(next) > c.framing.maxBytes {
+					// Starts the next frame.
+					message = next
+					break fill
+				}
+				batch = append(batch, next)
+				size += len(next)
+			default:
+				break fill
+			}
+		}
+
+		if err := c.setWriteDeadline(); err != nil {
+			return closed, err
+		}
+		if err := c.writeFrame(batch); err != nil {
+			return closed, err
+		}
+	}
+	return closed, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/user"
+
+	"github.com/gorilla/websocket"
+)
+
+// runWritePump queues messages for a client using f, closes its send
+// channel and runs writePump until it returns. It returns the frames the peer
+// received; the last read must fail with the close frame.
+func runWritePump(t *testing.T, f framing, messages ...string) [][]byte {
+	t.Helper()
+	conn, peer := wsPair(t)
+	c := &Client{
+		conn:    conn,
+		send:    make(chan []byte, len(messages)),
+		user:    &user.User{ID: "alice"},
+		framing: f,
+	}
+	for _, m := range messages {
+		c.send <- []byte(m)
+	}
+	close(c.send)
+
+	done := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(done)
+	}()
+
+	var frames [][]byte
+	for {
+		if err := peer.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := peer.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+				t.Errorf("expected close frame, got %v", err)
+			}
+			break
+		}
+		frames = append(frames, data)
+	}
+	<-done
+	return frames
+}
+
+// decodeFrame decodes the events of a frame sent with format.
+func decodeFrame(t *testing.T, format string, data []byte) []Envelope {
+	t.Helper()
+	var events []Envelope
+	switch format {
+	case framingSingle:
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatalf("frame is not a single event: %v: %s", err, data)
+		}
+		events = append(events, env)
+	case framingArray:
+		if err := json.Unmarshal(data, &events); err != nil {
+			t.Fatalf("frame is not an array of events: %v: %s", err, data)
+		}
+	case framingNDJSON:
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			t.Fatalf("frame does not end in a newline: %q", data)
+		}
+		for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+			var env Envelope
+			if err := json.Unmarshal(line, &env); err != nil {
+				t.Fatalf("line is not an event: %v: %q", err, line)
+			}
+			events = append(events, env)
+		}
+	}
+	return events
+}
+
+func testEvents(n int) []string {
+	var msgs []string
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, fmt.Sprintf(`{"type":"e%d"}`, i))
+	}
+	return msgs
+}
+
+func TestWritePumpFraming(t *testing.T) {
+	tests := []struct {
+		name      string
+		framing   framing
+		messages  int
+		wantSizes []int
+	}{
+		{"single", framing{format: framingSingle, maxEvents: 64, maxBytes: 1 << 10}, 3, []int{1, 1, 1}},
+		{"array", framing{format: framingArray, maxEvents: 3, maxBytes: 1 << 10}, 5, []int{3, 2}},
+		{"ndjson", framing{format: framingNDJSON, maxEvents: 3, maxBytes: 1 << 10}, 5, []int{3, 2}},
+		// Each event is 13 bytes, so two fit in 30.
+		{"array bytes", framing{format: framingArray, maxEvents: 64, maxBytes: 30}, 3, []int{2, 1}},
+		{"array oversized", framing{format: framingArray, maxEvents: 64, maxBytes: 5}, 2, []int{1, 1}},
+		{"array of one", framing{format: framingArray, maxEvents: 1, maxBytes: 1 << 10}, 2, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := runWritePump(t, tt.framing, testEvents(tt.messages)...)
+
+			var sizes []int
+			var got []string
+			for _, frame := range frames {
+				evs := decodeFrame(t, tt.framing.format, frame)
+				sizes = append(sizes, len(evs))
+				for _, env := range evs {
+					got = append(got, env.Type)
+				}
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.wantSizes) {
+				t.Errorf("expected frames of %v events, got %v", tt.wantSizes, sizes)
+			}
+			for i, typ := range got {
+				if want := fmt.Sprintf("e%d", i); typ != want {
+					t.Errorf("event %d: expected %s, got %s", i, want, typ)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFraming(t *testing.T) {
+	for _, format := range []string{framingSingle, framingArray, framingNDJSON} {
+		if _, err := parseFraming(format); err != nil {
+			t.Errorf("%q: %v", format, err)
+		}
+	}
+	if _, err := parseFraming("xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestWsBatchNegotiation(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+
+	_, resp, err := dialToken(t, wsURL(srv)+"?batch=xml", "token-bob")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected unknown batch format to be rejected with 400, got %v", err)
+	}
+
+	conn, _, err := dialToken(t, wsURL(srv)+"?batch=array", "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evs := decodeFrame(t, framingArray, data); len(evs) != 1 || evs[0].Type != eventConnected {
+		t.Errorf("expected connected in an array, got %s", data)
+	}
+}
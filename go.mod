@@ -10,4 +10,9 @@ require (
 	golang.org/x/crypto v0.47.0
 )
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/lib/pq v1.10.9
+	golang.org/x/text v0.33.0
+)
+
+require golang.org/x/sys v0.40.0 // indirect
@@ -1,49 +1,490 @@
 package main
 
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nexus-im/nexus/broker"
+	"github.com/nexus-im/nexus/store/user"
+
+	"github.com/gorilla/websocket"
+)
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
+	// Registered clients indexed by user ID. A user may have several
+	// connections open at once.
+	users map[string]map[*Client]bool
+
+	// Registered clients indexed by the ID of each room they are a member of.
+	rooms map[string]map[*Client]bool
+
+	// Messages for every connected client.
 	broadcast chan []byte
 
+	// Messages for the members of a single room.
+	roomBroadcast chan roomMessage
+
+	// Messages for every connection of a set of users.
+	userBroadcast chan userMessage
+
+	// Short-lived signals that are never stored; see ephemeral.go.
+	ephemeral chan ephemeralMessage
+
+	// Messages addressed to a single client, e.g. error replies.
+	deliver chan delivery
+
+	// Room membership changes, applied to all connections of a user.
+	join  chan membership
+	leave chan membership
+
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Requests for the current user_list from a client.
+	userList chan *Client
+
+	// Sessions that were revoked; their connections are closed.
+	revoke chan revocation
+
+	// Users that came online or went offline while handling the current
+	// event, announced once it is done.
+	presence []presenceChange
+
+	// Users connected to other nodes, by user ID and node ID, and when each
+	// node was last heard from; see cluster.go. A user is online while they
+	// have a connection here or on any other node.
+	remote map[string]map[string]*remotePresence
+	peers  map[string]time.Time
+
+	// Users whose last connection here closed while they were still online
+	// elsewhere, so last_seen was not recorded for them.
+	unrecorded map[string]bool
+
+	// How often this node's users are announced to the other nodes.
+	presenceInterval time.Duration
+
+	// Used to record when a user's last connection drops. May be nil.
+	userStore user.Store
+
+	// Replicates fan-out to the hubs of other nodes. May be nil when running
+	// a single node.
+	broker broker.Broker
+	nodeID string
+	outbox chan clusterMessage
+	nextID uint64
+	seen   *recentIDs
+
+	// Handlers for inbound client events.
+	events *Dispatcher
+
+	// Decides what happens to messages for clients that fall behind.
+	slowConsumer slowConsumerPolicy
+}
+
+// delivery is a message addressed to one specific client.
+type delivery struct {
+	client  *Client
+	message []byte
+}
+
+// roomMessage is a message addressed to the members of a room.
+type roomMessage struct {
+	roomID  string
+	message []byte
+}
+
+// userMessage is a message addressed to all connections of the given users.
+// A user listed more than once still receives the message once.
+type userMessage struct {
+	userIDs []string
+	message []byte
+}
+
+// revocation closes connections of a user: those opened with a session of a
+// refresh token family, those opened with a session other than keepSessionID
+// and the rest of its family, those opened with a single session or API key,
+// or, with none of these set, every connection of the user. Sessions are
+// matched by family because an expired one may have been swept while its
+// websockets stayed open.
+type revocation struct {
+	userID        string
+	familyID      string
+	keepSessionID string
+	keepFamilyID  string
+	sessionID     string // Session or API key ID
+}
+
+// matches reports whether rev closes client.
+func (rev revocation) matches(client *Client) bool {
+	switch {
+	case rev.familyID != "":
+		return client.session != nil && client.session.FamilyID == rev.familyID
+	case rev.keepSessionID != "":
+		if client.session == nil || client.session.ID == rev.keepSessionID {
+			return false
+		}
+		return rev.keepFamilyID == "" || client.session.FamilyID != rev.keepFamilyID
+	case rev.sessionID != "":
+		return client.credentialID() == rev.sessionID
+	}
+	return true
+}
+
+// presenceChange records a user's first connection in the cluster opening or
+// last connection closing. recordLastSeen is set for the changes that must
+// update the user's last_seen.
+type presenceChange struct {
+	user           *user.User
+	online         bool
+	recordLastSeen bool
 }
 
-func newHub() *Hub {
+// membership adds or removes all connections of a user to or from a room.
+// If notice is set it is sent to each of those connections afterwards.
+type membership struct {
+	userID string
+	roomID string
+	notice []byte
+}
+
+func newHub(users user.Store, b broker.Broker) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		broadcast:     make(chan []byte),
+		roomBroadcast: make(chan roomMessage),
+		userBroadcast: make(chan userMessage),
+		ephemeral:     make(chan ephemeralMessage),
+		deliver:       make(chan delivery),
+		join:          make(chan membership),
+		leave:         make(chan membership),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		userList:      make(chan *Client),
+		revoke:        make(chan revocation),
+		clients:       make(map[*Client]bool),
+		users:         make(map[string]map[*Client]bool),
+		rooms:         make(map[string]map[*Client]bool),
+		events:        newEventDispatcher(),
+		userStore:     users,
+		broker:        b,
+		nodeID:        newNodeID(),
+		outbox:        make(chan clusterMessage, outboxSize),
+		seen:          newRecentIDs(recentIDsSize),
+		slowConsumer:  disconnectPolicy{},
+
+		remote:           make(map[string]map[string]*remotePresence),
+		peers:            make(map[string]time.Time),
+		unrecorded:       make(map[string]bool),
+		presenceInterval: defaultPresenceInterval,
 	}
 }
 
 func (h *Hub) run() {
+	var remote <-chan []byte
+	var presenceTick <-chan time.Time
+	if h.broker != nil {
+		remote = h.broker.Messages()
+		go h.publishLoop()
+
+		ticker := time.NewTicker(h.presenceInterval)
+		defer ticker.Stop()
+		presenceTick = ticker.C
+		// Let the other nodes know this one exists, so they send theirs.
+		h.publishPresence(nil)
+	}
+
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.add(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
+			}
+		case d := <-h.deliver:
+			if _, ok := h.clients[d.client]; ok {
+				h.send(d.client, d.message)
+			}
+		case m := <-h.join:
+			h.joinRoom(m)
+			h.publish(clusterMessage{Kind: clusterJoin, UserIDs: []string{m.userID}, RoomID: m.roomID, Message: m.notice})
+		case m := <-h.leave:
+			h.leaveRoom(m)
+			h.publish(clusterMessage{Kind: clusterLeave, UserIDs: []string{m.userID}, RoomID: m.roomID, Message: m.notice})
+		case m := <-h.roomBroadcast:
+			h.sendRoom(m)
+			h.publish(clusterMessage{Kind: clusterRoom, RoomID: m.roomID, Message: m.message})
+		case m := <-h.userBroadcast:
+			h.sendUsers(m)
+			h.publish(clusterMessage{Kind: clusterUsers, UserIDs: m.userIDs, Message: m.message})
+		case m := <-h.ephemeral:
+			h.sendEphemeral(m)
+			h.publish(clusterMessage{Kind: clusterEphemeral, RoomID: m.roomID, UserIDs: m.userIDs, From: m.from, Message: m.message})
+		case rev := <-h.revoke:
+			h.disconnect(rev)
+			h.publish(clusterMessage{
+				Kind:          clusterRevoke,
+				UserIDs:       []string{rev.userID},
+				FamilyID:      rev.familyID,
+				KeepSessionID: rev.keepSessionID,
+				KeepFamilyID:  rev.keepFamilyID,
+				SessionID:     rev.sessionID,
+			})
+		case client := <-h.userList:
+			if _, ok := h.clients[client]; ok {
+				h.sendUserList(client)
 			}
 		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+			h.sendAll(message)
+			h.publish(clusterMessage{Kind: clusterAll, Message: message})
+		case data, ok := <-remote:
+			if !ok {
+				log.Printf("cluster: broker closed, continuing as a single node")
+				remote = nil
+				break
+			}
+			h.receive(data)
+		case now := <-presenceTick:
+			h.syncPresence(now)
+		}
+		h.announcePresence()
+	}
+}
+
+func (h *Hub) joinRoom(m membership) {
+	for client := range h.users[m.userID] {
+		client.addRoom(m.roomID)
+		h.subscribe(client, m.roomID)
+		if m.notice != nil {
+			h.send(client, m.notice)
+		}
+	}
+}
+
+func (h *Hub) leaveRoom(m membership) {
+	for client := range h.users[m.userID] {
+		client.removeRoom(m.roomID)
+		h.unsubscribe(client, m.roomID)
+		if m.notice != nil {
+			h.send(client, m.notice)
+		}
+	}
+}
+
+func (h *Hub) sendRoom(m roomMessage) {
+	for client := range h.rooms[m.roomID] {
+		h.send(client, m.message)
+	}
+}
+
+func (h *Hub) sendUsers(m userMessage) {
+	seen := make(map[string]bool, len(m.userIDs))
+	for _, userID := range m.userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		for client := range h.users[userID] {
+			h.send(client, m.message)
+		}
+	}
+}
+
+// disconnect closes the connections matching rev with a policy violation
+// close frame so clients can tell they were logged out.
+func (h *Hub) disconnect(rev revocation) {
+	for client := range h.users[rev.userID] {
+		if !rev.matches(client) {
+			continue
+		}
+		client.closeFrame = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+		h.remove(client)
+	}
+}
+
+// add registers client along with the rooms it was a member of on connect.
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+
+	userID := client.user.ID
+	if h.users[userID] == nil {
+		h.users[userID] = make(map[*Client]bool)
+	}
+	h.users[userID][client] = true
+
+	for _, roomID := range client.roomIDs() {
+		h.subscribe(client, roomID)
+	}
+
+	if len(h.users[userID]) == 1 {
+		h.publishPresence([]*user.User{client.user})
+		if len(h.remote[userID]) == 0 {
+			h.presence = append(h.presence, presenceChange{user: client.user, online: true})
+			return
+		}
+	}
+	// Nothing changed for anyone else, but this connection still needs to
+	// know who is online.
+	h.sendUserList(client)
+}
+
+// remove unregisters client from every index and closes its send channel.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+
+	userID := client.user.ID
+	delete(h.users[userID], client)
+	if len(h.users[userID]) == 0 {
+		delete(h.users, userID)
+		// Whichever node sees the user's last connection in the cluster
+		// close records last_seen, and tells the others it did.
+		elsewhere := len(h.remote[userID]) > 0
+		h.publish(clusterMessage{Kind: clusterOffline, UserIDs: []string{userID}, Recorded: !elsewhere})
+		if elsewhere {
+			h.unrecorded[userID] = true
+		} else {
+			delete(h.unrecorded, userID)
+			h.presence = append(h.presence, presenceChange{user: client.user, online: false, recordLastSeen: true})
+		}
+	}
+
+	for _, roomID := range client.roomIDs() {
+		h.unsubscribe(client, roomID)
+	}
+
+	close(client.send)
+}
+
+func (h *Hub) subscribe(client *Client, roomID string) {
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[*Client]bool)
+	}
+	h.rooms[roomID][client] = true
+}
+
+func (h *Hub) unsubscribe(client *Client, roomID string) {
+	delete(h.rooms[roomID], client)
+	if len(h.rooms[roomID]) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+// announcePresence broadcasts a system notification for every pending
+// presence change followed by the updated user_list. Sending may drop slow
+// clients, which queues further changes, so loop until none are left.
+func (h *Hub) announcePresence() {
+	for len(h.presence) > 0 {
+		changes := h.presence
+		h.presence = nil
+
+		for _, change := range changes {
+			content := change.user.Username + " has joined the chat"
+			if !change.online {
+				content = change.user.Username + " has left the chat"
+				if change.recordLastSeen {
+					go h.updateLastSeen(change.user.ID)
 				}
 			}
+			msg, err := encodeEvent(eventSystemNotification, SystemNotificationPayload{
+				Content:   content,
+				Timestamp: time.Now().UTC(),
+			})
+			if err != nil {
+				log.Printf("error encoding presence notification: %v", err)
+				continue
+			}
+			h.sendAll(msg)
+		}
+
+		msg, err := h.encodeUserList()
+		if err != nil {
+			log.Printf("error encoding user list: %v", err)
+			continue
+		}
+		h.sendAll(msg)
+	}
+}
+
+// encodeUserList lists the users online anywhere in the cluster.
+func (h *Hub) encodeUserList() ([]byte, error) {
+	names := make([]string, 0, len(h.users)+len(h.remote))
+	for _, clients := range h.users {
+		for client := range clients {
+			names = append(names, client.user.Username)
+			break
+		}
+	}
+	for userID, nodes := range h.remote {
+		if len(h.users[userID]) > 0 {
+			continue
+		}
+		for _, p := range nodes {
+			names = append(names, p.username)
+			break
+		}
+	}
+	sort.Strings(names)
+	return encodeEvent(eventUserList, UserListPayload{Users: names})
+}
+
+func (h *Hub) sendUserList(client *Client) {
+	msg, err := h.encodeUserList()
+	if err != nil {
+		log.Printf("error encoding user list: %v", err)
+		return
+	}
+	h.send(client, msg)
+}
+
+// updateLastSeen records that a user's last connection has closed. It runs
+// outside the hub goroutine so the database never stalls fan-out.
+func (h *Hub) updateLastSeen(userID string) {
+	if h.userStore == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.userStore.UpdateLastSeen(ctx, userID, time.Now()); err != nil {
+		log.Printf("error updating last seen for %s: %v", userID, err)
+	}
+}
+
+func (h *Hub) sendAll(message []byte) {
+	for client := range h.clients {
+		h.send(client, message)
+	}
+}
+
+// send queues message for client. While the client replays, the message is
+// held until the replay is done. If its buffer is full, or messages spilled
+// earlier are still waiting, the slow consumer policy decides what happens and
+// may drop the client.
+func (h *Hub) send(client *Client, message []byte) {
+	if held, ok := client.hold.push(message); held {
+		if !ok {
+			slowConsumerStats.Add("replay.disconnects", 1)
+			client.closeFrame = slowConsumerCloseFrame
+			h.remove(client)
 		}
+		return
+	}
+	if client.overflow.len() == 0 {
+		select {
+		case client.send <- message:
+			return
+		default:
+		}
+	}
+	if !h.slowConsumer.overflow(client, message) {
+		h.remove(client)
 	}
 }
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/broker"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+func newTestClient(h *Hub, userID string, rooms ...string) *Client {
+	c := &Client{
+		hub:   h,
+		send:  make(chan []byte, 16),
+		user:  &user.User{ID: userID, Username: userID},
+		rooms: make(map[string]bool),
+	}
+	for _, id := range rooms {
+		c.rooms[id] = true
+	}
+	return c
+}
+
+// register adds clients to the hub and discards the presence announcements
+// triggered by their arrival.
+func register(t *testing.T, h *Hub, clients ...*Client) {
+	t.Helper()
+	for _, c := range clients {
+		h.register <- c
+	}
+	settle(t, h, clients...)
+}
+
+// settle waits until the hub has processed everything sent to it so far and
+// discards whatever the given clients received in the meantime.
+func settle(t *testing.T, h *Hub, clients ...*Client) {
+	t.Helper()
+	for _, c := range clients {
+		// A direct delivery stays on this node, unlike a broadcast.
+		h.deliver <- delivery{client: c, message: []byte("settle")}
+		for {
+			select {
+			case got := <-c.send:
+				if string(got) != "settle" {
+					continue
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s: timed out settling hub", c.user.ID)
+			}
+			break
+		}
+	}
+}
+
+// expectMessage fails the test unless c receives want within a short timeout.
+func expectMessage(t *testing.T, c *Client, want string) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", c.user.ID, want, got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%s: timed out waiting for %q", c.user.ID, want)
+	}
+}
+
+// nextEvent returns the next event of one of the given types queued for c,
+// skipping anything else such as presence announcements.
+func nextEvent(t *testing.T, c *Client, types ...string) Envelope {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-c.send:
+			var env Envelope
+			if err := json.Unmarshal(msg, &env); err != nil {
+				t.Fatalf("%s: invalid event %q: %v", c.user.ID, msg, err)
+			}
+			for _, typ := range types {
+				if env.Type == typ {
+					return env
+				}
+			}
+		case <-timeout:
+			t.Fatalf("%s: timed out waiting for %v", c.user.ID, types)
+		}
+	}
+}
+
+// expectNoMessage fails the test if c has anything queued.
+func expectNoMessage(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case got := <-c.send:
+		t.Errorf("%s: unexpected message %q", c.user.ID, got)
+	default:
+	}
+}
+
+func TestHubRoomBroadcast(t *testing.T) {
+	h := newHub(nil, nil)
+	go h.run()
+
+	alice := newTestClient(h, "alice", "room-1")
+	bob := newTestClient(h, "bob", "room-2")
+	register(t, h, alice, bob)
+
+	h.roomBroadcast <- roomMessage{roomID: "room-1", message: []byte("one")}
+	h.roomBroadcast <- roomMessage{roomID: "room-2", message: []byte("two")}
+
+	expectMessage(t, alice, "one")
+	expectMessage(t, bob, "two")
+	expectNoMessage(t, alice)
+	expectNoMessage(t, bob)
+}
+
+func TestHubMembershipAppliesToAllConnections(t *testing.T) {
+	h := newHub(nil, nil)
+	go h.run()
+
+	phone := newTestClient(h, "alice")
+	laptop := newTestClient(h, "alice")
+	bob := newTestClient(h, "bob")
+	register(t, h, phone, laptop, bob)
+
+	h.join <- membership{userID: "alice", roomID: "room-1", notice: []byte("joined")}
+	expectMessage(t, phone, "joined")
+	expectMessage(t, laptop, "joined")
+	expectNoMessage(t, bob)
+
+	h.roomBroadcast <- roomMessage{roomID: "room-1", message: []byte("hello")}
+	expectMessage(t, phone, "hello")
+	expectMessage(t, laptop, "hello")
+
+	h.leave <- membership{userID: "alice", roomID: "room-1"}
+	h.roomBroadcast <- roomMessage{roomID: "room-1", message: []byte("anyone?")}
+	h.broadcast <- []byte("sync")
+	expectMessage(t, phone, "sync")
+	expectMessage(t, laptop, "sync")
+	if phone.inRoom("room-1") {
+		t.Errorf("expected room to be removed from client")
+	}
+}
+
+func TestHubUserBroadcast(t *testing.T) {
+	h := newHub(nil, nil)
+	go h.run()
+
+	phone := newTestClient(h, "alice")
+	laptop := newTestClient(h, "alice")
+	bob := newTestClient(h, "bob")
+	carol := newTestClient(h, "carol")
+	register(t, h, phone, laptop, bob, carol)
+
+	h.userBroadcast <- userMessage{userIDs: []string{"bob", "alice", "bob"}, message: []byte("dm")}
+
+	expectMessage(t, phone, "dm")
+	expectMessage(t, laptop, "dm")
+	expectMessage(t, bob, "dm")
+
+	h.broadcast <- []byte("sync")
+	expectMessage(t, bob, "sync")
+	expectMessage(t, carol, "sync")
+}
+
+func TestHubPresence(t *testing.T) {
+	users := newMemUserStore(&user.User{ID: "alice", Username: "alice"})
+	h := newHub(users, nil)
+	go h.run()
+
+	bob := newTestClient(h, "bob")
+	register(t, h, bob)
+
+	phone := newTestClient(h, "alice")
+	h.register <- phone
+	expectEvent(t, bob, eventSystemNotification, "alice has joined the chat")
+	expectEvent(t, bob, eventUserList, "alice,bob")
+
+	// A second connection of an online user is not announced to others.
+	laptop := newTestClient(h, "alice")
+	h.register <- laptop
+	expectEvent(t, laptop, eventUserList, "alice,bob")
+	settle(t, h, bob, phone, laptop)
+
+	h.unregister <- phone
+	h.unregister <- laptop
+	expectEvent(t, bob, eventSystemNotification, "alice has left the chat")
+	expectEvent(t, bob, eventUserList, "bob")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		u, _ := users.GetByID(context.Background(), "alice")
+		users.mu.Lock()
+		seen := !u.LastSeen.IsZero()
+		users.mu.Unlock()
+		if seen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected last seen to be updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectEvent fails the test unless the next message c receives has the
+// given type and a summary of its payload equal to want: the content of a
+// system notification or the comma separated users of a user_list.
+func expectEvent(t *testing.T, c *Client, eventType, want string) {
+	t.Helper()
+	var raw []byte
+	select {
+	case raw = <-c.send:
+	case <-time.After(time.Second):
+		t.Fatalf("%s: timed out waiting for %s", c.user.ID, eventType)
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatalf("%s: invalid JSON %q: %v", c.user.ID, raw, err)
+	}
+	if env.Type != eventType {
+		t.Fatalf("%s: expected %s, got %s", c.user.ID, eventType, raw)
+	}
+
+	var got string
+	switch eventType {
+	case eventSystemNotification:
+		var p SystemNotificationPayload
+		_ = json.Unmarshal(env.Payload, &p)
+		got = p.Content
+	case eventUserList:
+		var p UserListPayload
+		_ = json.Unmarshal(env.Payload, &p)
+		got = strings.Join(p.Users, ",")
+	}
+	if got != want {
+		t.Errorf("%s: expected %s %q, got %q", c.user.ID, eventType, want, got)
+	}
+}
+
+func TestHubClusterFanOut(t *testing.T) {
+	bus := broker.NewBus()
+	nodeA := newHub(nil, bus.Join(16))
+	nodeB := newHub(nil, bus.Join(16))
+	go nodeA.run()
+	go nodeB.run()
+
+	alice := newTestClient(nodeA, "alice", "room-1")
+	bob := newTestClient(nodeB, "bob", "room-1")
+	carol := newTestClient(nodeB, "carol")
+	register(t, nodeA, alice)
+	register(t, nodeB, bob, carol)
+	for _, c := range []*Client{alice, bob, carol} {
+		awaitUserList(t, c, "alice,bob,carol")
+	}
+
+	nodeA.roomBroadcast <- roomMessage{roomID: "room-1", message: []byte(`"hello"`)}
+	expectMessage(t, alice, `"hello"`)
+	expectMessage(t, bob, `"hello"`)
+
+	// Membership changes follow the user to every node.
+	nodeA.join <- membership{userID: "carol", roomID: "room-1", notice: []byte(`"joined"`)}
+	expectMessage(t, carol, `"joined"`)
+
+	nodeA.roomBroadcast <- roomMessage{roomID: "room-1", message: []byte(`"again"`)}
+	expectMessage(t, alice, `"again"`)
+	expectMessage(t, bob, `"again"`)
+	expectMessage(t, carol, `"again"`)
+
+	// Neither the publisher's own echo nor a redelivery reaches clients
+	// twice. Remote messages are applied in order, so the marker arriving
+	// proves the duplicates were processed.
+	publish := func(id, message string) {
+		cm, _ := json.Marshal(clusterMessage{ID: id, Origin: "elsewhere", Kind: clusterAll, Message: []byte(message)})
+		if err := nodeA.broker.Publish(context.Background(), cm); err != nil {
+			t.Fatalf("error was not expected while publishing: %s", err)
+		}
+	}
+	publish("dup", `"once"`)
+	publish("dup", `"once"`)
+	publish("marker", `"marker"`)
+	expectMessage(t, alice, `"once"`)
+	expectMessage(t, alice, `"marker"`)
+}
+
+// awaitUserList asks for the user_list of c until it holds the given comma
+// separated users, then discards whatever else c received.
+func awaitUserList(t *testing.T, c *Client, want string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.hub.userList <- c
+		env := nextEvent(t, c, eventUserList)
+		var p UserListPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			t.Fatalf("invalid user list: %v", err)
+		}
+		if strings.Join(p.Users, ",") == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected users %s, got %v", c.user.ID, want, p.Users)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	settle(t, c.hub, c)
+}
+
+func TestHubClusterPresence(t *testing.T) {
+	users := newMemUserStore(&user.User{ID: "alice", Username: "alice"})
+	bus := broker.NewBus()
+	nodeA := newHub(users, bus.Join(16))
+	nodeB := newHub(users, bus.Join(16))
+	go nodeA.run()
+	go nodeB.run()
+
+	bob := newTestClient(nodeB, "bob")
+	register(t, nodeB, bob)
+
+	// Users on other nodes are announced and listed.
+	phone := newTestClient(nodeA, "alice")
+	nodeA.register <- phone
+	expectEvent(t, bob, eventSystemNotification, "alice has joined the chat")
+	expectEvent(t, bob, eventUserList, "alice,bob")
+	awaitUserList(t, phone, "alice,bob")
+
+	// A user connected to two nodes is online until both connections
+	// close, and last_seen is only recorded then.
+	// Broadcasts are applied in order with the presence messages before
+	// them, so their arrival proves those were processed.
+	laptop := newTestClient(nodeB, "alice")
+	register(t, nodeB, laptop)
+	nodeB.broadcast <- []byte(`"marker"`)
+	for _, c := range []*Client{bob, laptop, phone} {
+		expectMessage(t, c, `"marker"`)
+	}
+	nodeA.unregister <- phone
+	nodeA.broadcast <- []byte(`"marker"`)
+	for _, c := range []*Client{bob, laptop} {
+		expectMessage(t, c, `"marker"`)
+	}
+	u, _ := users.GetByID(context.Background(), "alice")
+	users.mu.Lock()
+	seen := !u.LastSeen.IsZero()
+	users.mu.Unlock()
+	if seen {
+		t.Errorf("expected last seen not to be recorded while connected elsewhere")
+	}
+
+	nodeB.unregister <- laptop
+	expectEvent(t, bob, eventSystemNotification, "alice has left the chat")
+	expectEvent(t, bob, eventUserList, "bob")
+	deadline := time.Now().Add(time.Second)
+	for {
+		u, _ := users.GetByID(context.Background(), "alice")
+		users.mu.Lock()
+		seen := !u.LastSeen.IsZero()
+		users.mu.Unlock()
+		if seen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected last seen to be updated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubPresenceExpires(t *testing.T) {
+	// Not running, so the test can drive the hub directly.
+	h := newHub(nil, nil)
+	cm, _ := json.Marshal(clusterMessage{ID: "1", Origin: "elsewhere", Kind: clusterPresence, UserIDs: []string{"alice"}, Usernames: []string{"alice"}})
+	h.receive(cm)
+	if !h.online("alice") || len(h.presence) != 1 || !h.presence[0].online {
+		t.Fatalf("expected alice to come online, got %+v", h.presence)
+	}
+	h.presence = nil
+
+	// A node that stops refreshing its users is presumed gone.
+	h.syncPresence(time.Now().Add(presenceTTLFactor * h.presenceInterval / 2))
+	if !h.online("alice") {
+		t.Fatalf("expected alice to stay online within the TTL")
+	}
+	h.syncPresence(time.Now().Add(presenceTTLFactor*h.presenceInterval + time.Second))
+	if h.online("alice") || len(h.presence) != 1 || h.presence[0].online || !h.presence[0].recordLastSeen {
+		t.Errorf("expected alice to go offline with last seen recorded, got %+v", h.presence)
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	r := newRecentIDs(2)
+	if !r.add("a") || !r.add("b") {
+		t.Fatalf("expected new ids to be added")
+	}
+	if r.add("a") {
+		t.Errorf("expected duplicate to be rejected")
+	}
+	r.add("c") // evicts "a"
+	if !r.add("a") {
+		t.Errorf("expected evicted id to be accepted again")
+	}
+}
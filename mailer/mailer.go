@@ -0,0 +1,59 @@
+// Package mailer delivers the email nexus sends, such as password reset
+// links. Only local implementations live here: one that logs messages and
+// one that writes them to files. Production deployments plug in their own.
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// LogMailer writes messages to a logger instead of sending them.
+type LogMailer struct {
+	Logger *log.Logger // Nil means the standard logger
+}
+
+func (m *LogMailer) Send(_ context.Context, msg *Message) error {
+	logger := m.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer writes each message to its own .eml file in Dir, where it can
+// be opened with a mail client.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(_ context.Context, msg *Message) error {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		msg.To, msg.Subject, now.Format(time.RFC1123Z), msg.Body)
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0o600)
+}
@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := &LogMailer{Logger: log.New(&buf, "", 0)}
+	if err := m.Send(context.Background(), &Message{To: "a@example.com", Subject: "Hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "a@example.com") || !strings.Contains(buf.String(), "hello") {
+		t.Errorf("expected recipient and body to be logged, got %q", buf.String())
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir}
+	for i := 0; i < 2; i++ {
+		if err := m.Send(context.Background(), &Message{To: "a@example.com", Subject: "Reset", Body: "token"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected one file per message, got %d", len(files))
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "To: a@example.com\r\nSubject: Reset\r\n") || !strings.HasSuffix(string(data), "\r\n\r\ntoken") {
+		t.Errorf("unexpected message file:\n%s", data)
+	}
+}
@@ -1,16 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
+	"github.com/nexus-im/nexus/broker"
+	"github.com/nexus-im/nexus/mailer"
+	"github.com/nexus-im/nexus/passhash"
+	"github.com/nexus-im/nexus/policy"
+	"github.com/nexus-im/nexus/store/apikey"
+	"github.com/nexus-im/nexus/store/attempt"
+	"github.com/nexus-im/nexus/store/cursor"
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/mfa"
+	"github.com/nexus-im/nexus/store/readmarker"
+	"github.com/nexus-im/nexus/store/room"
 	"github.com/nexus-im/nexus/store/session"
 	"github.com/nexus-im/nexus/store/user"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -18,19 +35,71 @@ import (
 	_ "github.com/lib/pq"
 )
 
-var addr = flag.String("addr", ":8080", "http service address")
+var (
+	addr             = flag.String("addr", ":8080", "http service address")
+	historyBackfill  = flag.Int("history-backfill", 50, "number of recent messages per room sent to a client on connect")
+	resumeLimit      = flag.Int("resume-limit", 1000, "maximum number of missed messages per room replayed to a resuming client")
+	resumeTTL        = flag.Duration("resume-ttl", 30*24*time.Hour, "how long delivery cursors are kept after their last ack; older resume IDs start over")
+	brokerKind       = flag.String("broker", "none", "cross-node fan-out: none (single node) or postgres (LISTEN/NOTIFY)")
+	brokerChannel    = flag.String("broker-channel", "nexus_events", "Postgres channel used by the postgres broker")
+	sweepInterval    = flag.Duration("session-sweep-interval", 10*time.Minute, "how often expired sessions are deleted (0 disables)")
+	sweepBatchSize   = flag.Int("session-sweep-batch", 1000, "maximum number of expired sessions deleted per statement")
+	accessTokenTTL   = flag.Duration("access-token-ttl", 15*time.Minute, "lifetime of access tokens issued by login and refresh")
+	refreshTokenTTL  = flag.Duration("refresh-token-ttl", 30*24*time.Hour, "lifetime of refresh tokens; each refresh issues a new one")
+	batchMaxEvents   = flag.Int("ws-batch-max-events", 64, "most events sent in one websocket frame to clients connecting with ?batch=array or ?batch=ndjson")
+	batchMaxBytes    = flag.Int("ws-batch-max-bytes", 64<<10, "most bytes of events sent in one websocket frame to batching clients; a larger event gets a frame of its own")
+	wsAuthTimeout    = flag.Duration("ws-auth-timeout", 10*time.Second, "how long a websocket opened without credentials has to send its auth event")
+	typingTimeout    = flag.Duration("typing-timeout", 10*time.Second, "how long a typing indicator lasts unless the client sends typing_start again")
+	passwordHash     = flag.String("password-hash", passhash.Argon2id, "algorithm for new password hashes: argon2id or bcrypt; older hashes are upgraded at login")
+	bcryptCost       = flag.Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost when -password-hash is bcrypt")
+	mailerKind       = flag.String("mailer", "log", "how email is delivered: log (to the server log) or file (to -mail-dir)")
+	mailDir          = flag.String("mail-dir", "mail", "directory the file mailer writes messages to")
+	passwordResetURL = flag.String("password-reset-url", "http://localhost:5173/reset-password", "page password reset emails link to; the token is appended as ?token=")
+	oidcConfig       = flag.String("oidc-config", "", "path to a JSON file listing OpenID Connect providers users can sign in with")
+
+	usernameCharset   = flag.String("username-charset", policy.CharsetASCII, "characters usernames may contain: ascii or unicode (letters and digits of a single script)")
+	usernameMinLength = flag.Int("username-min-length", 3, "minimum username length in characters")
+	usernameMaxLength = flag.Int("username-max-length", 32, "maximum username length in characters, at most 50")
+	reservedUsernames = flag.String("reserved-usernames", "", "file of usernames that cannot be registered, one per line, in addition to the built-in ones")
+	passwordMinLength = flag.Int("password-min-length", 8, "minimum password length in characters")
+	passwordBlocklist = flag.String("password-blocklist", "", "file of breached or common passwords to refuse, one per line, in addition to the built-in list")
+
+	slowConsumer           = flag.String("slow-consumer", slowConsumerDisconnect, "what happens when a client falls 256 messages behind: disconnect, drop-oldest, drop-newest or spill")
+	slowConsumerSpillBytes = flag.Int("slow-consumer-spill-bytes", 1<<20, "bytes each client may spill before being disconnected when -slow-consumer is spill")
+)
 
 // Global instances (in a real app, use dependency injection)
 var (
-	userStore    user.Store
-	sessionStore session.Store
+	userStore       user.Store
+	sessionStore    session.Store
+	roomStore       room.Store
+	messageStore    message.Store
+	attemptStore    attempt.Store
+	mfaStore        mfa.Store
+	apiKeyStore     apikey.Store
+	cursorStore     cursor.Store
+	readMarkerStore readmarker.Store
+)
+
+var (
+	passwordHasher *passhash.Hasher
+	mailSender     mailer.Mailer
 )
 
-const sessionTTL = 24 * time.Hour
+// adminToken authenticates admin endpoints. Read from NEXUS_ADMIN_TOKEN; when
+// empty the admin endpoints are disabled.
+var adminToken string
+
+// shutdownTimeout bounds how long in-flight HTTP requests may take to finish
+// once the server is asked to stop.
+const shutdownTimeout = 10 * time.Second
 
 func main() {
 	flag.Parse()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Database Connection
 	// TODO: Load from env
 	connStr := os.Getenv("DATABASE_URL")
@@ -57,32 +126,184 @@ func main() {
 
 	userStore = user.NewSQLStore(db)
 	sessionStore = session.NewSQLStore(db)
+	roomStore = room.NewSQLStore(db)
+	messageStore = message.NewSQLStore(db)
+	attemptStore = attempt.NewSQLStore(db)
+	mfaStore = mfa.NewSQLStore(db)
+	apiKeyStore = apikey.NewSQLStore(db)
+	cursorStore = cursor.NewSQLStore(db)
+	readMarkerStore = readmarker.NewSQLStore(db)
+
+	adminToken = os.Getenv("NEXUS_ADMIN_TOKEN")
+
+	switch *passwordHash {
+	case passhash.Argon2id, passhash.Bcrypt:
+		passwordHasher = &passhash.Hasher{Algorithm: *passwordHash, BcryptCost: *bcryptCost, Argon2: passhash.DefaultArgon2Params}
+	default:
+		log.Fatalf("Unknown password hash %q", *passwordHash)
+	}
+	if err := initDummyPasswordHash(); err != nil {
+		log.Fatal("Failed to hash dummy password:", err)
+	}
+	if err := loadAccountPolicy(); err != nil {
+		log.Fatal("Failed to load account policy:", err)
+	}
 
-	hub := newHub()
+	switch *mailerKind {
+	case "log":
+		mailSender = &mailer.LogMailer{}
+	case "file":
+		if err := os.MkdirAll(*mailDir, 0o700); err != nil {
+			log.Fatal("Failed to create mail directory:", err)
+		}
+		mailSender = &mailer.FileMailer{Dir: *mailDir}
+	default:
+		log.Fatalf("Unknown mailer %q", *mailerKind)
+	}
+
+	if *oidcConfig != "" {
+		if err := loadOIDCProviders(ctx, *oidcConfig); err != nil {
+			log.Fatal("Failed to load OpenID Connect providers:", err)
+		}
+	}
+
+	var b broker.Broker
+	switch *brokerKind {
+	case "none":
+	case "postgres":
+		pg, err := broker.NewPostgres(db, connStr, *brokerChannel)
+		if err != nil {
+			log.Fatal("Failed to start broker:", err)
+		}
+		defer func() {
+			if err := pg.Close(); err != nil {
+				log.Printf("Error closing broker: %v", err)
+			}
+		}()
+		b = pg
+		log.Printf("Using postgres broker on channel %s", *brokerChannel)
+	default:
+		log.Fatalf("Unknown broker %q", *brokerKind)
+	}
+
+	hub := newHub(userStore, b)
+	hub.slowConsumer, err = newSlowConsumerPolicy(*slowConsumer, *slowConsumerSpillBytes)
+	if err != nil {
+		log.Fatal("Invalid slow consumer policy:", err)
+	}
 	go hub.run()
 
+	// Background jobs stop when ctx is cancelled; wait for them before the
+	// deferred database close runs.
+	var jobs sync.WaitGroup
+	defer jobs.Wait()
+
+	if *sweepInterval > 0 {
+		sweeper := &sessionSweeper{
+			store:     sessionStore,
+			interval:  *sweepInterval,
+			batchSize: *sweepBatchSize,
+			cursors:   cursorStore,
+			cursorTTL: *resumeTTL,
+			attempts:  attemptStore,
+		}
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			sweeper.run(ctx)
+		}()
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, hub)
+
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down server: %v", err)
+		}
+	}()
+
+	log.Printf("Server starting on %s", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
+
+// registerRoutes installs all HTTP and websocket endpoints on mux.
+func registerRoutes(mux *http.ServeMux, hub *Hub) {
 	// API Endpoints
-	http.HandleFunc("/api/register", handleRegister)
-	http.HandleFunc("/api/login", handleLogin)
+	mux.HandleFunc("/api/register", handleRegister)
+	mux.HandleFunc("/api/login", handleLogin)
+	mux.HandleFunc("/api/login/mfa", handleLoginMFA)
+	mux.HandleFunc("/api/mfa/totp/enroll", handleTOTPEnroll)
+	mux.HandleFunc("/api/mfa/totp/confirm", handleTOTPConfirm)
+	mux.HandleFunc("/api/mfa/totp/disable", handleTOTPDisable)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/start", handleOIDCStart)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/callback", handleOIDCCallback)
+	mux.HandleFunc("/api/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		handleRefresh(hub, w, r)
+	})
+	mux.HandleFunc("/api/ws-ticket", handleWsTicket)
+	mux.HandleFunc("/api/logout", func(w http.ResponseWriter, r *http.Request) {
+		handleLogout(hub, w, r)
+	})
+	mux.HandleFunc("/api/sessions", handleListSessions)
+	mux.HandleFunc("/api/admin/unlock", handleUnlock)
+	mux.HandleFunc("POST /api/password/change", func(w http.ResponseWriter, r *http.Request) {
+		handlePasswordChange(hub, w, r)
+	})
+	mux.HandleFunc("POST /api/password/reset", handlePasswordResetRequest)
+	mux.HandleFunc("POST /api/password/reset/confirm", func(w http.ResponseWriter, r *http.Request) {
+		handlePasswordResetConfirm(hub, w, r)
+	})
+	mux.HandleFunc("GET /api/rooms/unread", handleListUnread)
+	mux.HandleFunc("GET /api/users/me", handleGetMe)
+	mux.HandleFunc("PATCH /api/users/me", func(w http.ResponseWriter, r *http.Request) {
+		handleUpdateMe(hub, w, r)
+	})
+	mux.HandleFunc("PUT /api/users/me/avatar", func(w http.ResponseWriter, r *http.Request) {
+		handleUploadAvatar(hub, w, r)
+	})
+	mux.HandleFunc("DELETE /api/users/me/avatar", func(w http.ResponseWriter, r *http.Request) {
+		handleDeleteAvatar(hub, w, r)
+	})
+	mux.HandleFunc("GET /api/users/{id}", handleGetUser)
+	mux.HandleFunc("GET /api/users/{id}/avatar", handleGetAvatar)
+	mux.HandleFunc("POST /api/bots", handleCreateBot)
+	mux.HandleFunc("GET /api/keys", handleListAPIKeys)
+	mux.HandleFunc("POST /api/keys", handleCreateAPIKey)
+	mux.HandleFunc("DELETE /api/keys/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleRevokeAPIKey(hub, w, r)
+	})
+	mux.HandleFunc("DELETE /api/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleRevokeSession(hub, w, r)
+	})
 
 	// WebSocket Endpoint
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
 
+	// Metrics, which include the command line and memory statistics, so
+	// only for operators.
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if requireAdmin(w, r) {
+			expvar.Handler().ServeHTTP(w, r)
+		}
+	})
+
 	// Health Check
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write([]byte("OK")); err != nil {
 			log.Printf("health check write error: %v", err)
 		}
 	})
-
-	log.Printf("Server starting on %s", *addr)
-	err = http.ListenAndServe(*addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +315,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Email    string `json:"email"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -101,13 +323,20 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Username == "" || req.Password == "" {
-		http.Error(w, "Username and password are required", http.StatusBadRequest)
+	req.Username = policy.NormalizeUsername(req.Username)
+	violations := accountPolicy.CheckUsername(req.Username)
+	violations = append(violations, accountPolicy.CheckPassword(req.Password, req.Username)...)
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+	if req.Email != "" && !validEmail(req.Email) {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
 		return
 	}
 
 	// Hash Password
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hash, err := passwordHasher.Hash(req.Password)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
@@ -129,16 +358,21 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	// I'll assume we need to provide an ID.
 	newUser := &user.User{
 		Username:     req.Username,
-		PasswordHash: string(hashedBytes),
+		PasswordHash: hash,
+		Email:        req.Email,
 		CreatedAt:    time.Now(),
 		LastSeen:     time.Now(),
 	}
 
 	if err := userStore.Create(r.Context(), newUser); err != nil {
-		if err == user.ErrDuplicateUsername {
+		if errors.Is(err, user.ErrDuplicateUsername) {
 			http.Error(w, "Username already exists", http.StatusConflict)
 			return
 		}
+		if errors.Is(err, user.ErrDuplicateEmail) {
+			http.Error(w, "Email already in use", http.StatusConflict)
+			return
+		}
 		log.Printf("Error creating user: %v", err)
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
@@ -163,54 +397,82 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.Username = policy.NormalizeUsername(req.Username)
 	if req.Username == "" || req.Password == "" {
 		http.Error(w, "Username and password are required", http.StatusBadRequest)
 		return
 	}
 
-	u, err := userStore.GetByUsername(r.Context(), req.Username)
+	// Refuse locked out usernames and addresses before doing any password
+	// work.
+	ip := clientIP(r)
+	wait, err := loginLockout(r.Context(), userAttemptKey(req.Username), ipAttemptKey(ip))
 	if err != nil {
-		if err == user.ErrUserNotFound {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
+		log.Printf("Error checking login attempts: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	u, err := userStore.GetByUsername(r.Context(), req.Username)
+	if err != nil && err != user.ErrUserNotFound {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	token, err := generateSessionToken()
+	// Unknown usernames count as failures too and take as long to check, so
+	// neither lockouts nor response times reveal which accounts exist.
+	ok, err := verifyPassword(r.Context(), u, req.Password)
 	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		log.Printf("Error verifying password of %s: %v", u.ID, err)
+	}
+	if !ok {
+		if err := recordLoginFailure(r.Context(), req.Username, ip); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	now := time.Now()
-	sess := &session.Session{
-		UserID:    u.ID,
-		Token:     token,
-		CreatedAt: now,
-		ExpiresAt: now.Add(sessionTTL),
-	}
+	completeOrChallenge(w, r, u)
+}
 
-	if err := sessionStore.Create(r.Context(), sess); err != nil {
-		log.Printf("Error creating session: %v", err)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+// completeOrChallenge answers a login in which u proved their identity by
+// a password or an identity provider: with a challenge for their second
+// factor if they have one, and with their tokens otherwise.
+func completeOrChallenge(w http.ResponseWriter, r *http.Request, u *user.User) {
+	// Failures are only forgiven once the login is complete, otherwise a
+	// known password would allow unlimited guesses at the second factor.
+	totp, err := mfaStore.GetTOTP(r.Context(), u.ID)
+	if err != nil && !errors.Is(err, mfa.ErrNotEnrolled) {
+		log.Printf("Error loading second factor of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && totp.Enabled() {
+		startMFAChallenge(w, r, u)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	resp := map[string]interface{}{
-		"token":      token,
-		"expires_in": int(sessionTTL.Seconds()),
+	completeLogin(w, r, u)
+}
+
+// completeLogin forgives the user's failed logins and issues their tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, u *user.User) {
+	if err := attemptStore.Reset(r.Context(), userAttemptKey(u.Username)); err != nil {
+		log.Printf("Error resetting login attempts of %s: %v", u.Username, err)
 	}
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("login response write error: %v", err)
+
+	resp, err := issueTokens(r.Context(), u.ID)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
 	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func generateSessionToken() (string, error) {
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nexus-im/nexus/store/mfa"
+	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
+	"github.com/nexus-im/nexus/totp"
+)
+
+const (
+	// totpIssuer names the service in authenticator apps.
+	totpIssuer = "Nexus"
+
+	// totpSkew is the number of time steps of clock drift tolerated either
+	// way.
+	totpSkew = 1
+
+	// mfaChallengeTTL is how long a user has to enter their code after
+	// entering their password.
+	mfaChallengeTTL = 5 * time.Minute
+
+	// recoveryCodeCount is the number of recovery codes handed out on
+	// enrollment. Each can replace a code from the app once.
+	recoveryCodeCount = 10
+)
+
+// startMFAChallenge answers a login with a correct password, or through an
+// identity provider, for a user with a second factor. No session is created
+// until the challenge is completed with POST /api/login/mfa.
+func startMFAChallenge(w http.ResponseWriter, r *http.Request, u *user.User) {
+	token, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	challenge := &session.MFAChallenge{
+		Token:     token,
+		UserID:    u.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(mfaChallengeTTL),
+	}
+	if err := sessionStore.CreateMFAChallenge(r.Context(), challenge); err != nil {
+		log.Printf("Error creating MFA challenge: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(mfaChallengeTTL.Seconds()),
+	})
+}
+
+// handleLoginMFA completes a login started by handleLogin with a code from the
+// user's authenticator app or one of their recovery codes. Wrong codes count
+// as failed logins, so the usual lockout applies.
+func handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		http.Error(w, "mfa_token and either code or recovery_code are required", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := sessionStore.GetMFAChallenge(r.Context(), req.MFAToken)
+	if err != nil {
+		if errors.Is(err, session.ErrChallengeNotFound) || errors.Is(err, session.ErrChallengeExpired) {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Error loading MFA challenge: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := userStore.GetByID(r.Context(), challenge.UserID)
+	if err != nil {
+		if errors.Is(err, user.ErrUserNotFound) {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginLockout(r.Context(), userAttemptKey(u.Username), ipAttemptKey(ip))
+	if err != nil {
+		log.Printf("Error checking login attempts: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err := verifySecondFactor(r.Context(), u.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Printf("Error verifying second factor of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := recordLoginFailure(r.Context(), u.Username, ip); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	// Deleting the challenge makes it single use; if another request got
+	// there first, this one loses.
+	if err := sessionStore.DeleteMFAChallenge(r.Context(), req.MFAToken); err != nil {
+		if errors.Is(err, session.ErrChallengeNotFound) {
+			http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Error deleting MFA challenge: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	completeLogin(w, r, u)
+}
+
+// verifySecondFactor checks a TOTP code or consumes a recovery code of the
+// user's confirmed enrollment. Accepted TOTP codes are recorded so that they
+// cannot be replayed.
+func verifySecondFactor(ctx context.Context, userID, code, recoveryCode string) (bool, error) {
+	t, err := mfaStore.GetTOTP(ctx, userID)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !t.Enabled() {
+		return false, nil
+	}
+
+	if recoveryCode != "" {
+		err := mfaStore.UseRecoveryCode(ctx, userID, normalizeRecoveryCode(recoveryCode))
+		if errors.Is(err, mfa.ErrRecoveryCodeNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	step, ok := totp.Validate(t.Secret, strings.TrimSpace(code), time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+	err = mfaStore.UseStep(ctx, userID, step)
+	if errors.Is(err, mfa.ErrCodeReused) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// handleTOTPEnroll generates a new secret for the authenticated user. It has
+// no effect on login until confirmed with a code from the app.
+func handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := mfaStore.BeginEnrollment(r.Context(), u.ID, secret); err != nil {
+		if errors.Is(err, mfa.ErrAlreadyEnabled) {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		log.Printf("Error enrolling %s in TOTP: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, u.Username, secret),
+	})
+}
+
+// handleTOTPConfirm enables a pending enrollment once the user proves their
+// app produces valid codes, and returns a fresh set of recovery codes. The
+// codes are only shown this once.
+func handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := mfaStore.GetTOTP(r.Context(), u.ID)
+	if errors.Is(err, mfa.ErrNotEnrolled) {
+		http.Error(w, "No pending enrollment", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading TOTP of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if t.Enabled() {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	step, ok := totp.Validate(t.Secret, strings.TrimSpace(req.Code), time.Now(), totpSkew)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = normalizeRecoveryCode(code)
+	}
+
+	if err := mfaStore.ConfirmEnrollment(r.Context(), u.ID, step, normalized); err != nil {
+		if errors.Is(err, mfa.ErrNotEnrolled) {
+			http.Error(w, "No pending enrollment", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error confirming TOTP of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
+
+// handleTOTPDisable turns two-factor authentication off. It takes a current
+// code or a recovery code, so a stolen access token alone cannot do it. Wrong
+// codes count as failed logins, so they cannot be guessed at without limit.
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+		http.Error(w, "Either code or recovery_code is required", http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginLockout(r.Context(), userAttemptKey(u.Username), ipAttemptKey(ip))
+	if err != nil {
+		log.Printf("Error checking login attempts: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err = verifySecondFactor(r.Context(), u.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		log.Printf("Error verifying second factor of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := recordLoginFailure(r.Context(), u.Username, ip); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+
+	if err := mfaStore.Disable(r.Context(), u.ID); err != nil && !errors.Is(err, mfa.ErrNotEnrolled) {
+		log.Printf("Error disabling TOTP of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// generateRecoveryCodes returns n random codes formatted for reading aloud,
+// e.g. "3f9a-12cd-8e07-b4c1".
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[0:4] + "-" + h[4:8] + "-" + h[8:12] + "-" + h[12:16]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips the formatting users may or may not type.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/user"
+	"github.com/nexus-im/nexus/totp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// enrollTOTP enrolls the owner of token and returns the secret and recovery
+// codes.
+func enrollTOTP(t *testing.T, srv *httptest.Server, token string) (string, []string) {
+	t.Helper()
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/enroll", token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&enrollment); err != nil || enrollment.Secret == "" {
+		t.Fatalf("invalid enrollment response: %v", err)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/confirm", token, `{"code":"000000x"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected wrong code to be rejected, got %d", resp.StatusCode)
+	}
+
+	code, err := totp.CodeAt(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/confirm", token, `{"code":"`+code+`"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&confirmed); err != nil || len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes: %v", recoveryCodeCount, err)
+	}
+	return enrollment.Secret, confirmed.RecoveryCodes
+}
+
+// startLogin logs carol in with her password and returns the MFA token.
+func startLogin(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"secret"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["mfa_required"] != true {
+		t.Fatalf("expected mfa_required, got %v", body)
+	}
+	if _, ok := body["token"]; ok {
+		t.Fatalf("no session may be issued before the second factor")
+	}
+	return body["mfa_token"].(string)
+}
+
+func TestTOTPLogin(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.Create(t.Context(), &user.User{Username: "carol", PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+	login := decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"secret"}`))
+
+	secret, recovery := enrollTOTP(t, srv, login.Token)
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/enroll", login.Token, ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected re-enrolling to conflict, got %d", resp.StatusCode)
+	}
+
+	mfaToken := startLogin(t, srv)
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"123456"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected wrong code to be rejected, got %d", resp.StatusCode)
+	}
+
+	// The code used to confirm has been spent; the next one is accepted.
+	used, _ := totp.CodeAt(secret, totp.Step(time.Now()))
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+used+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected replayed code to be rejected, got %d", resp.StatusCode)
+	}
+	next, _ := totp.CodeAt(secret, totp.Step(time.Now())+1)
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","code":"`+next+`"}`))
+
+	// Challenges are single use.
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+recovery[0]+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected completed challenge to be rejected, got %d", resp.StatusCode)
+	}
+
+	// Recovery codes work once each, with or without formatting.
+	mfaToken = startLogin(t, srv)
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+normalizeRecoveryCode(recovery[0])+`"}`))
+	mfaToken = startLogin(t, srv)
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+mfaToken+`","recovery_code":"`+recovery[0]+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected used recovery code to be rejected, got %d", resp.StatusCode)
+	}
+
+	// Disabling takes a second factor too.
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/disable", login.Token, `{"code":"000000"}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/disable", login.Token, `{"recovery_code":"`+recovery[1]+`"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"secret"}`))
+}
+
+func TestTOTPDisableLockout(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	createCarol(t, "")
+	token := decodeTokens(t, login(t, srv.URL, "secret")).Token
+	_, recovery := enrollTOTP(t, srv, token)
+
+	// Wrong codes count as failed logins, so the access token alone cannot
+	// be used to guess the code.
+	for i := 0; i <= loginFreeFailuresUser; i++ {
+		if resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/disable", token, `{"code":"000000"}`); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("attempt %d: expected 403, got %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/mfa/totp/disable", token, `{"recovery_code":"`+recovery[0]+`"}`); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", resp.StatusCode)
+	}
+}
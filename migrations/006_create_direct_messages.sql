@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS direct_messages (
+    id BIGSERIAL PRIMARY KEY,
+    sender_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    recipient_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    sender_username VARCHAR(50) NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_direct_messages_sender_recipient ON direct_messages(sender_id, recipient_id, id);
+CREATE INDEX IF NOT EXISTS idx_direct_messages_recipient_sender ON direct_messages(recipient_id, sender_id, id);
@@ -0,0 +1,2 @@
+-- Supports the background sweep of expired sessions.
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
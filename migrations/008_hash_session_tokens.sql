@@ -0,0 +1,16 @@
+-- Sessions store the SHA-256 of their token instead of the token itself, so a
+-- database dump no longer contains usable credentials. Existing plaintext
+-- tokens are hashed in place, keeping current logins valid.
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'sessions' AND column_name = 'token'
+    ) THEN
+        ALTER TABLE sessions RENAME COLUMN token TO token_hash;
+        UPDATE sessions SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+    END IF;
+END
+$$;
+
+ALTER INDEX IF EXISTS idx_sessions_token RENAME TO idx_sessions_token_hash;
@@ -0,0 +1,11 @@
+-- Websocket tickets are short-lived, single-use credentials minted from a
+-- session so the session token itself never appears in a websocket URL.
+-- Deleting the session invalidates its outstanding tickets.
+CREATE TABLE IF NOT EXISTS ws_tickets (
+    token_hash TEXT PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ws_tickets_expires_at ON ws_tickets(expires_at);
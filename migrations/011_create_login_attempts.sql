@@ -0,0 +1,9 @@
+-- Failed login attempts, keyed by "user:<username>" or "ip:<address>", used
+-- to back off and temporarily lock out password guessing. Rows are reset on a
+-- successful login and start over once the last failure is old enough.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,6 @@
+-- Bot users are driven by integrations through API keys rather than by a
+-- person logging in. They have no password and are managed by their owner.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS owner_id UUID REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_users_owner_id ON users(owner_id);
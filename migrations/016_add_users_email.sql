@@ -0,0 +1,5 @@
+-- Optional email address, used to send password reset links. Addresses are
+-- unique regardless of case.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users(lower(email));
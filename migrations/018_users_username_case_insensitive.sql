@@ -0,0 +1,8 @@
+-- Usernames are unique regardless of case, so "Alice" and "alice" cannot both
+-- register. The index also serves the case-insensitive lookups at login. This
+-- fails if such duplicates already exist; rename them first, e.g. with
+--   SELECT lower(username) FROM users GROUP BY 1 HAVING count(*) > 1;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_lower ON users(lower(username));
+
+-- Superseded by the index above.
+DROP INDEX IF EXISTS idx_users_username;
@@ -0,0 +1,16 @@
+-- Profile fields users show each other. The status ends at
+-- status_expires_at, or never when it is null.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio VARCHAR(500);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_text VARCHAR(100);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_emoji VARCHAR(32);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_expires_at TIMESTAMP WITH TIME ZONE;
+
+-- Uploaded avatars, served by the API so every node can reach them.
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    content_type TEXT NOT NULL,
+    data BYTEA NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
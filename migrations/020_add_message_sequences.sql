@@ -0,0 +1,32 @@
+-- Number the messages of each room from 1 without gaps. rooms.last_seq holds
+-- the last number handed out; bumping it locks the room row, which orders
+-- concurrent inserts.
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS last_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT;
+
+UPDATE messages m
+SET seq = numbered.seq
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY room_id ORDER BY id) AS seq
+    FROM messages
+) numbered
+WHERE m.id = numbered.id AND m.seq IS NULL;
+
+UPDATE rooms r
+SET last_seq = COALESCE((SELECT MAX(seq) FROM messages WHERE room_id = r.id), 0);
+
+ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_room_id_seq ON messages(room_id, seq);
+
+-- The last message each delivery stream acknowledged per room. A stream is
+-- named by the resume ID a client passes back when reconnecting.
+CREATE TABLE IF NOT EXISTS delivery_cursors (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    stream_id VARCHAR(64) NOT NULL,
+    room_id UUID NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, stream_id, room_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_cursors_updated_at ON delivery_cursors(updated_at);
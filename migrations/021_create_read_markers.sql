@@ -0,0 +1,9 @@
+-- The last message of each room a user has read, shared by all of the user's
+-- connections. Unread counts are rooms.last_seq minus seq.
+CREATE TABLE IF NOT EXISTS read_markers (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    room_id UUID NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, room_id)
+);
@@ -0,0 +1,3 @@
+-- Lets the session sweeper find login attempts whose failures no longer
+-- count.
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failure_at ON login_attempts(last_failure_at);
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nexus-im/nexus/oidc"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// oidcProviders are the configured OpenID Connect providers by name. Written
+// once at startup.
+var oidcProviders = map[string]*oidc.Provider{}
+
+const (
+	// oidcFlowTTL is how long a user has to sign in at the provider.
+	oidcFlowTTL = 10 * time.Minute
+
+	// oidcCookie holds the state and PKCE verifier of a sign-in in progress.
+	// It is scoped to the provider's endpoints.
+	oidcCookie = "nexus_oidc"
+)
+
+// loadOIDCProviders reads the provider configuration at path and discovers
+// the endpoints of each provider.
+func loadOIDCProviders(ctx context.Context, path string) error {
+	providers, err := oidc.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range providers {
+		ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+		err := p.Discover(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		oidcProviders[p.Name] = p
+		log.Printf("OpenID Connect provider %s enabled", p.Name)
+	}
+	return nil
+}
+
+// handleOIDCStart sends the browser to the provider to sign in. The state and
+// PKCE verifier are kept in a short-lived cookie that only the callback reads.
+func handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	p, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := oidc.NewVerifier()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + verifier,
+		Path:     "/api/auth/oidc/" + p.Name,
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.AuthCodeURL(state, challenge), http.StatusFound)
+}
+
+// handleOIDCCallback completes a sign-in: it checks the state, redeems the
+// code with the PKCE verifier, identifies the user at the provider and
+// responds with the same tokens as handleLogin. Users signing in for the
+// first time get a new account linked to their identity at the provider.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Sign-in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		http.Error(w, "Sign-in expired, please start over", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: cookie.Path, MaxAge: -1})
+
+	state, verifier, ok := strings.Cut(cookie.Value, ".")
+	if !ok || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+
+	accessToken, err := p.Exchange(r.Context(), q.Get("code"), verifier)
+	if err != nil {
+		log.Printf("Error completing %s sign-in: %v", p.Name, err)
+		http.Error(w, "Sign-in failed", http.StatusBadGateway)
+		return
+	}
+	info, err := p.UserInfo(r.Context(), accessToken)
+	if err != nil {
+		log.Printf("Error completing %s sign-in: %v", p.Name, err)
+		http.Error(w, "Sign-in failed", http.StatusBadGateway)
+		return
+	}
+
+	u, err := oidcUser(r.Context(), p.Name, info)
+	if err != nil {
+		log.Printf("Error provisioning %s user %s: %v", p.Name, info.Subject, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The provider stands in for the password only; a second factor enrolled
+	// with nexus is still required.
+	completeOrChallenge(w, r, u)
+}
+
+// oidcUser returns the user linked to the identity, creating one on first
+// sign-in. New users are never linked to an existing account by name, which
+// would let anyone who controls that name at the provider take it over. They
+// get the name the provider suggests, with a random suffix if it is taken,
+// and no password.
+func oidcUser(ctx context.Context, provider string, info *oidc.UserInfo) (*user.User, error) {
+	u, err := userStore.GetByIdentity(ctx, provider, info.Subject)
+	if !errors.Is(err, user.ErrUserNotFound) {
+		return u, err
+	}
+
+	base := oidcUsername(info)
+	for attempt := 0; attempt < 5; attempt++ {
+		name := base
+		if attempt > 0 {
+			suffix := make([]byte, 3)
+			if _, err := rand.Read(suffix); err != nil {
+				return nil, err
+			}
+			name = truncate(base, max(accountPolicy.MaxUsernameLength-7, 0)) + "-" + hex.EncodeToString(suffix)
+		}
+		if len(accountPolicy.CheckUsername(name)) > 0 {
+			continue
+		}
+
+		if _, err := userStore.GetByUsername(ctx, name); err == nil {
+			continue
+		} else if !errors.Is(err, user.ErrUserNotFound) {
+			return nil, err
+		}
+
+		now := time.Now()
+		u := &user.User{Username: name, CreatedAt: now, LastSeen: now}
+		if err := userStore.CreateWithIdentity(ctx, u, provider, info.Subject); err != nil {
+			if errors.Is(err, user.ErrDuplicateUsername) {
+				continue
+			}
+			if errors.Is(err, user.ErrDuplicateIdentity) {
+				// A concurrent callback for the same account won the race.
+				return userStore.GetByIdentity(ctx, provider, info.Subject)
+			}
+			return nil, err
+		}
+		log.Printf("Created user %s for %s identity %s", u.Username, provider, info.Subject)
+		return u, nil
+	}
+	return nil, errors.New("no free username")
+}
+
+// oidcUsername picks a username from the provider's claims that satisfies the
+// username policy.
+func oidcUsername(info *oidc.UserInfo) string {
+	name := info.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(info.Email, "@")
+	}
+	name = accountPolicy.SanitizeUsername(name)
+	if len(accountPolicy.CheckUsername(name)) > 0 {
+		name = "user"
+	}
+	return name
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
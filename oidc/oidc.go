@@ -0,0 +1,224 @@
+// Package oidc implements the client side of the OpenID Connect
+// authorization code flow with PKCE (RFC 7636). The user is identified
+// through the provider's userinfo endpoint, which is called over TLS with the
+// access token just obtained from the token endpoint, so no ID token
+// signature verification is needed.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Provider is an OpenID Connect identity provider nexus users can sign in
+// with.
+type Provider struct {
+	// Name identifies the provider in URLs and in linked identities.
+	Name string `json:"name"`
+
+	// Issuer is used to discover the endpoints below if they are not set.
+	Issuer string `json:"issuer,omitempty"`
+
+	AuthURL     string `json:"authorization_endpoint,omitempty"`
+	TokenURL    string `json:"token_endpoint,omitempty"`
+	UserInfoURL string `json:"userinfo_endpoint,omitempty"`
+
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes,omitempty"` // Defaults to openid, profile and email
+
+	// HTTPClient is used for all requests to the provider. Nil means a
+	// client with a 10 second timeout.
+	HTTPClient *http.Client `json:"-"`
+}
+
+// UserInfo holds the claims of the userinfo response nexus uses.
+type UserInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+}
+
+// ErrNoSubject is returned when the userinfo response does not identify the
+// user.
+var ErrNoSubject = errors.New("oidc: userinfo response has no subject")
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadConfig reads a JSON array of providers from path.
+func LoadConfig(path string) ([]*Provider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var providers []*Provider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, fmt.Errorf("oidc: parsing %s: %w", path, err)
+	}
+	for _, p := range providers {
+		if p.Name == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("oidc: provider %q needs name, client_id and redirect_url", p.Name)
+		}
+	}
+	return providers, nil
+}
+
+// Discover fills in the endpoints that are not configured from the issuer's
+// discovery document.
+func (p *Provider) Discover(ctx context.Context) error {
+	if p.AuthURL != "" && p.TokenURL != "" && p.UserInfoURL != "" {
+		return nil
+	}
+	if p.Issuer == "" {
+		return fmt.Errorf("oidc: provider %q needs an issuer or all endpoints", p.Name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		AuthURL     string `json:"authorization_endpoint"`
+		TokenURL    string `json:"token_endpoint"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+	}
+	if err := p.doJSON(req, &doc); err != nil {
+		return fmt.Errorf("oidc: discovering %s: %w", p.Issuer, err)
+	}
+
+	if p.AuthURL == "" {
+		p.AuthURL = doc.AuthURL
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = doc.TokenURL
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = doc.UserInfoURL
+	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+		return fmt.Errorf("oidc: discovery document of %s is missing endpoints", p.Issuer)
+	}
+	return nil
+}
+
+// AuthCodeURL returns the URL to send the user to for signing in. state is
+// echoed back to the redirect URL; challenge is the PKCE code challenge of
+// the verifier later passed to Exchange.
+func (p *Provider) AuthCodeURL(state, challenge string) string {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange trades an authorization code for an access token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := p.doJSON(req, &tok); err != nil {
+		return "", fmt.Errorf("oidc: exchanging code: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("oidc: token response has no access_token")
+	}
+	return tok.AccessToken, nil
+}
+
+// UserInfo fetches the claims of the user the access token was issued to.
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var info UserInfo
+	if err := p.doJSON(req, &info); err != nil {
+		return nil, fmt.Errorf("oidc: fetching userinfo: %w", err)
+	}
+	if info.Subject == "" {
+		return nil, ErrNoSubject
+	}
+	return &info, nil
+}
+
+func (p *Provider) doJSON(req *http.Request, v interface{}) error {
+	client := p.HTTPClient
+	if client == nil {
+		client = defaultClient
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// NewVerifier returns a random PKCE code verifier and its S256 challenge.
+func NewVerifier() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	return verifier, Challenge(verifier), nil
+}
+
+// Challenge returns the S256 code challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
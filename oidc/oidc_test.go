@@ -0,0 +1,80 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nexus-im/nexus/oidc"
+	"github.com/nexus-im/nexus/oidc/oidctest"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp := oidctest.NewServer("nexus", "s3cret", oidc.UserInfo{Subject: "1234", PreferredUsername: "alice"})
+	defer idp.Close()
+
+	p := idp.Provider("corp", "http://nexus.example/callback")
+	ctx := context.Background()
+	if err := p.Discover(ctx); err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+
+	verifier, challenge, err := oidc.NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL := p.AuthCodeURL("state-1", challenge)
+	if !strings.Contains(authURL, "code_challenge_method=S256") {
+		t.Errorf("expected PKCE parameters in %s", authURL)
+	}
+
+	// Follow the provider's redirect by hand to pick up the code.
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Query().Get("state") != "state-1" {
+		t.Errorf("expected state to be echoed, got %s", redirect)
+	}
+	code := redirect.Query().Get("code")
+
+	if _, err := p.Exchange(ctx, code, "wrong-verifier"); err == nil {
+		t.Errorf("expected exchange with the wrong verifier to fail")
+	}
+
+	// Codes are single use, so start over.
+	resp, err = client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	redirect, _ = url.Parse(resp.Header.Get("Location"))
+
+	accessToken, err := p.Exchange(ctx, redirect.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	info, err := p.UserInfo(ctx, accessToken)
+	if err != nil {
+		t.Fatalf("userinfo failed: %v", err)
+	}
+	if info.Subject != "1234" || info.PreferredUsername != "alice" {
+		t.Errorf("unexpected userinfo %+v", info)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	// Example from RFC 7636, Appendix B.
+	if got := oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("unexpected challenge %s", got)
+	}
+}
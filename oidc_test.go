@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/oidc"
+	"github.com/nexus-im/nexus/oidc/oidctest"
+	"github.com/nexus-im/nexus/totp"
+)
+
+// newOIDCTestServer starts a test server with an identity provider named corp
+// that signs in user.
+func newOIDCTestServer(t *testing.T, user oidc.UserInfo) (*httptest.Server, *oidctest.Server) {
+	t.Helper()
+	srv, _, _ := newSessionTestServer(t)
+
+	idp := oidctest.NewServer("nexus", "s3cret", user)
+	t.Cleanup(idp.Close)
+
+	p := idp.Provider("corp", srv.URL+"/api/auth/oidc/corp/callback")
+	if err := p.Discover(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	oidcProviders = map[string]*oidc.Provider{"corp": p}
+	t.Cleanup(func() { oidcProviders = map[string]*oidc.Provider{} })
+	return srv, idp
+}
+
+// oidcLogin runs the sign-in flow in a fresh browser and returns the response
+// of the callback.
+func oidcLogin(t *testing.T, srv *httptest.Server) *http.Response {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(srv.URL + "/api/auth/oidc/corp/start")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	srv, idp := newOIDCTestServer(t, oidc.UserInfo{Subject: "1001", PreferredUsername: "dave"})
+
+	first := decodeTokens(t, oidcLogin(t, srv))
+	sess, err := sessionStore.GetByToken(t.Context(), first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := userStore.GetByID(t.Context(), sess.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "dave" {
+		t.Errorf("expected username dave, got %s", u.Username)
+	}
+	if u.PasswordHash != "" {
+		t.Errorf("expected provisioned user to have no password")
+	}
+
+	// Signing in again finds the linked user, even if the name changed.
+	idp.SetUser(oidc.UserInfo{Subject: "1001", PreferredUsername: "david"})
+	second := decodeTokens(t, oidcLogin(t, srv))
+	sess, err = sessionStore.GetByToken(t.Context(), second.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.UserID != u.ID {
+		t.Errorf("expected second sign-in as %s, got %s", u.ID, sess.UserID)
+	}
+
+	// Another identity claiming a taken name gets a user of its own.
+	idp.SetUser(oidc.UserInfo{Subject: "1002", PreferredUsername: "alice"})
+	third := decodeTokens(t, oidcLogin(t, srv))
+	sess, err = sessionStore.GetByToken(t.Context(), third.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.UserID == "user-alice" {
+		t.Errorf("expected identity not to be linked to the existing alice")
+	}
+}
+
+func TestOIDCLoginTOTP(t *testing.T) {
+	srv, _ := newOIDCTestServer(t, oidc.UserInfo{Subject: "1001", PreferredUsername: "dave"})
+
+	first := decodeTokens(t, oidcLogin(t, srv))
+	secret, _ := enrollTOTP(t, srv, first.Token)
+
+	// The provider replaces the password, not the second factor.
+	resp := oidcLogin(t, srv)
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["mfa_required"] != true {
+		t.Fatalf("expected mfa_required, got %v", body)
+	}
+	if _, ok := body["token"]; ok {
+		t.Fatalf("no session may be issued before the second factor")
+	}
+
+	code, _ := totp.CodeAt(secret, totp.Step(time.Now())+1)
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login/mfa", "", `{"mfa_token":"`+body["mfa_token"].(string)+`","code":"`+code+`"}`))
+}
+
+func TestOIDCCallbackRejected(t *testing.T) {
+	srv, _ := newOIDCTestServer(t, oidc.UserInfo{Subject: "1001", Email: "dave@example.com"})
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/auth/oidc/other/start", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown provider, got %d", resp.StatusCode)
+	}
+
+	// Without the cookie set by start, a callback cannot be completed.
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/auth/oidc/corp/callback?code=x&state=y", "", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without state cookie, got %d", resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/auth/oidc/corp/callback?code=x&state=y", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: oidcCookie, Value: "z.verifier"})
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 on state mismatch, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/auth/oidc/corp/callback?error=access_denied", "", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 when the provider reports an error, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+// Package passhash hashes passwords for storage and verifies them. It reads
+// bcrypt hashes and argon2id hashes in the PHC string format
+// ("$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>"), writes whichever the Hasher
+// is configured for, and tells callers when a stored hash should be replaced
+// because its algorithm or cost is outdated.
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms a Hasher can write.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// Argon2Params are the cost parameters of argon2id.
+type Argon2Params struct {
+	Time    uint32 // Number of passes
+	Memory  uint32 // KiB
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106 with
+// less memory: 64 MiB and three passes.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4, SaltLen: 16, KeyLen: 32}
+
+// ErrUnknownFormat is returned for stored hashes this package cannot read.
+var ErrUnknownFormat = errors.New("passhash: unknown hash format")
+
+// Hasher hashes new passwords with one algorithm and verifies hashes written
+// with any.
+type Hasher struct {
+	Algorithm  string // Argon2id or Bcrypt
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// Hash returns the encoded hash of password.
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	case Argon2id:
+		salt := make([]byte, h.Argon2.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+	return "", fmt.Errorf("passhash: unknown algorithm %q", h.Algorithm)
+}
+
+// Verify reports whether password matches the encoded hash. An empty hash,
+// as stored for users without a password, matches nothing.
+func (h *Hasher) Verify(encoded, password string) (bool, error) {
+	switch {
+	case encoded == "":
+		return false, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		p, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, ErrUnknownFormat
+}
+
+// NeedsRehash reports whether encoded was written with another algorithm or
+// weaker parameters than h uses, so it should be replaced the next time the
+// password is known.
+func (h *Hasher) NeedsRehash(encoded string) bool {
+	switch h.Algorithm {
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < h.BcryptCost
+	case Argon2id:
+		p, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return true
+		}
+		want := h.Argon2
+		return p.Time < want.Time || p.Memory < want.Memory || p.Threads < want.Threads ||
+			uint32(len(salt)) < want.SaltLen || uint32(len(key)) < want.KeyLen
+	}
+	return false
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func decodeArgon2(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownFormat
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,75 @@
+package passhash
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2 keeps the tests fast.
+var cheapArgon2 = Argon2Params{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestHashAndVerify(t *testing.T) {
+	hashers := []*Hasher{
+		{Algorithm: Argon2id, Argon2: cheapArgon2},
+		{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost},
+	}
+	for _, h := range hashers {
+		hash, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatalf("%s: %v", h.Algorithm, err)
+		}
+		if ok, err := h.Verify(hash, "correct horse"); !ok || err != nil {
+			t.Errorf("%s: expected password to match, got %v, %v", h.Algorithm, ok, err)
+		}
+		if ok, err := h.Verify(hash, "battery staple"); ok || err != nil {
+			t.Errorf("%s: expected wrong password not to match, got %v, %v", h.Algorithm, ok, err)
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s: fresh hash should not need rehashing", h.Algorithm)
+		}
+	}
+}
+
+func TestVerifyWithoutPassword(t *testing.T) {
+	h := &Hasher{Algorithm: Argon2id, Argon2: cheapArgon2}
+	if ok, err := h.Verify("", ""); ok || err != nil {
+		t.Errorf("expected empty hash to match nothing, got %v, %v", ok, err)
+	}
+	if _, err := h.Verify("plaintext", "plaintext"); err != ErrUnknownFormat {
+		t.Errorf("expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weakBcrypt := &Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	oldHash, err := weakBcrypt.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stronger bcrypt cost.
+	if !(&Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}).NeedsRehash(oldHash) {
+		t.Errorf("expected bcrypt hash with lower cost to need rehashing")
+	}
+
+	// Switching algorithms, and verifying across them.
+	argon := &Hasher{Algorithm: Argon2id, Argon2: cheapArgon2}
+	if !argon.NeedsRehash(oldHash) {
+		t.Errorf("expected bcrypt hash to need rehashing to argon2id")
+	}
+	if ok, err := argon.Verify(oldHash, "secret"); !ok || err != nil {
+		t.Errorf("expected argon2id hasher to verify bcrypt hashes, got %v, %v", ok, err)
+	}
+
+	// Stronger argon2id parameters.
+	newHash, err := argon.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := cheapArgon2
+	stronger.Memory *= 2
+	if !(&Hasher{Algorithm: Argon2id, Argon2: stronger}).NeedsRehash(newHash) {
+		t.Errorf("expected argon2id hash with less memory to need rehashing")
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/nexus-im/nexus/mailer"
+	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// passwordResetTTL is how long a password reset link works.
+const passwordResetTTL = time.Hour
+
+// dummyPasswordHash is checked in place of a real hash for logins naming an
+// unknown user or one without a password, so they take as long to fail as a
+// wrong password. Set by initDummyPasswordHash once passwordHasher is
+// configured.
+var dummyPasswordHash string
+
+// initDummyPasswordHash hashes a random password with the current hasher
+// settings.
+func initDummyPasswordHash() error {
+	password, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+	dummyPasswordHash, err = passwordHasher.Hash(password)
+	return err
+}
+
+// verifyPassword checks password against the user's stored hash and, when it
+// matches, replaces a hash written with an outdated algorithm or cost. A nil
+// user, or one without a password, never matches, but is checked against
+// dummyPasswordHash so that response times do not tell them apart.
+func verifyPassword(ctx context.Context, u *user.User, password string) (bool, error) {
+	if u == nil || u.PasswordHash == "" {
+		_, _ = passwordHasher.Verify(dummyPasswordHash, password)
+		return false, nil
+	}
+
+	ok, err := passwordHasher.Verify(u.PasswordHash, password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if passwordHasher.NeedsRehash(u.PasswordHash) {
+		hash, err := passwordHasher.Hash(password)
+		if err == nil {
+			err = userStore.UpdatePassword(ctx, u.ID, hash)
+		}
+		if err != nil {
+			// The password was right; a stale hash can be upgraded next time.
+			log.Printf("Error rehashing password of %s: %v", u.ID, err)
+		} else {
+			u.PasswordHash = hash
+		}
+	}
+	return true, nil
+}
+
+// validEmail reports whether s is a bare email address.
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// handlePasswordChange sets a new password for the authenticated user, who
+// must confirm the current one. Every other session is ended and its
+// websockets closed; the session making the request stays valid. Wrong
+// current passwords count as failed logins.
+func handlePasswordChange(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	sess, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.CurrentPassword == "" {
+		http.Error(w, "Current password is required", http.StatusBadRequest)
+		return
+	}
+	if violations := accountPolicy.CheckPassword(req.NewPassword, u.Username); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	ip := clientIP(r)
+	wait, err := loginLockout(r.Context(), userAttemptKey(u.Username), ipAttemptKey(ip))
+	if err != nil {
+		log.Printf("Error checking login attempts: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err = verifyPassword(r.Context(), u, req.CurrentPassword)
+	if err != nil {
+		log.Printf("Error verifying password of %s: %v", u.ID, err)
+	}
+	if !ok {
+		if err := recordLoginFailure(r.Context(), u.Username, ip); err != nil {
+			log.Printf("Error recording failed login: %v", err)
+		}
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	if err := setPassword(r.Context(), u, req.NewPassword); err != nil {
+		log.Printf("Error changing password of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sessionStore.DeleteOthersForUser(r.Context(), u.ID, sess); err != nil {
+		log.Printf("Error ending other sessions of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hub.revoke <- revocation{userID: u.ID, keepSessionID: sess.ID, keepFamilyID: sess.FamilyID}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePasswordResetRequest emails a single-use reset link to the user with
+// the given address. The response is the same whether or not such a user
+// exists, so it cannot be used to find out.
+func handlePasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validEmail(req.Email) {
+		http.Error(w, "A valid email address is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := userStore.GetByEmail(r.Context(), req.Email)
+	switch {
+	case errors.Is(err, user.ErrUserNotFound):
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case err != nil:
+		log.Printf("Error looking up user by email: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	case u.IsBot:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	reset := &session.PasswordReset{
+		Token:     token,
+		UserID:    u.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	}
+	if err := sessionStore.CreatePasswordReset(r.Context(), reset); err != nil {
+		log.Printf("Error creating password reset for %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	msg := &mailer.Message{
+		To:      u.Email,
+		Subject: "Reset your nexus password",
+		Body: "Someone asked to reset the password of your nexus account " + u.Username + ".\n\n" +
+			"To choose a new password, open this link within an hour:\n\n" +
+			*passwordResetURL + "?token=" + token + "\n\n" +
+			"If this was not you, ignore this email; your password stays the same.\n",
+	}
+	// A failure is not reported to the client, which would tell it that the
+	// address belongs to an account.
+	if err := mailSender.Send(r.Context(), msg); err != nil {
+		log.Printf("Error sending password reset to %s: %v", u.ID, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlePasswordResetConfirm sets a new password with the token from a reset
+// email. Every session of the user is ended and their lockout lifted. The
+// second factor, if enabled, still applies at the next login.
+func handlePasswordResetConfirm(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+	// Check the password before the token is used up. The user is not known
+	// yet, so a password containing the username is not caught here.
+	if violations := accountPolicy.CheckPassword(req.NewPassword, ""); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	reset, err := sessionStore.RedeemPasswordReset(r.Context(), req.Token)
+	if errors.Is(err, session.ErrResetNotFound) || errors.Is(err, session.ErrResetExpired) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error redeeming password reset: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := userStore.GetByID(r.Context(), reset.UserID)
+	if err != nil {
+		log.Printf("Error loading user %s for password reset: %v", reset.UserID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := setPassword(r.Context(), u, req.NewPassword); err != nil {
+		log.Printf("Error resetting password of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sessionStore.DeleteAllForUser(r.Context(), u.ID); err != nil {
+		log.Printf("Error deleting sessions of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	hub.revoke <- revocation{userID: u.ID}
+
+	if err := attemptStore.Reset(r.Context(), userAttemptKey(u.Username)); err != nil {
+		log.Printf("Error resetting login attempts of %s: %v", u.Username, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword hashes password and stores it for u.
+func setPassword(ctx context.Context, u *user.User, password string) error {
+	hash, err := passwordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := userStore.UpdatePassword(ctx, u.ID, hash); err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nexus-im/nexus/passhash"
+	"github.com/nexus-im/nexus/store/user"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// createCarol adds a user carol with password "secret".
+func createCarol(t *testing.T, email string) *user.User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{Username: "carol", PasswordHash: string(hash), Email: email}
+	if err := userStore.Create(t.Context(), u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func login(t *testing.T, url, password string) *http.Response {
+	t.Helper()
+	return doRequest(t, http.MethodPost, url+"/api/login", "", `{"username":"carol","password":"`+password+`"}`)
+}
+
+func TestPasswordChange(t *testing.T) {
+	srv, hub, _ := newSessionTestServer(t)
+	createCarol(t, "")
+
+	current := decodeTokens(t, login(t, srv.URL, "secret"))
+	other := decodeTokens(t, login(t, srv.URL, "secret"))
+
+	sess, err := sessionStore.GetByToken(t.Context(), other.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(hub, sess.UserID)
+	c.session = sess
+	register(t, hub, c)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/change", current.Token, `{"current_password":"wrong","new_password":"n3w-passw0rd"}`)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong current password, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/password/change", current.Token, `{"current_password":"secret","new_password":"n3w-passw0rd"}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	expectClosed(t, c)
+
+	// The other device is logged out, this one is not.
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", other.Token, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected other session to be revoked, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+other.RefreshToken+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected other refresh token to be revoked, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", current.Token, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected current session to stay valid, got %d", resp.StatusCode)
+	}
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+current.RefreshToken+`"}`))
+
+	if resp := login(t, srv.URL, "secret"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected old password to be rejected, got %d", resp.StatusCode)
+	}
+	decodeTokens(t, login(t, srv.URL, "n3w-passw0rd"))
+}
+
+func TestPasswordReset(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	createCarol(t, "carol@example.com")
+	before := decodeTokens(t, login(t, srv.URL, "secret"))
+	outbox := mailSender.(*memMailer)
+
+	// Unknown addresses look the same but send nothing.
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset", "", `{"email":"nobody@example.com"}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202 for unknown address, got %d", resp.StatusCode)
+	}
+	if len(outbox.sent) != 0 {
+		t.Fatalf("expected no mail for unknown address, got %d", len(outbox.sent))
+	}
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset", "", `{"email":"Carol@Example.com"}`); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	if len(outbox.sent) != 1 || outbox.sent[0].To != "carol@example.com" {
+		t.Fatalf("expected one mail to carol@example.com, got %+v", outbox.sent)
+	}
+	_, link, _ := strings.Cut(outbox.sent[0].Body, "?token=")
+	token, _, _ := strings.Cut(link, "\n")
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset/confirm", "", `{"token":"bogus","new_password":"n3w-passw0rd"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown token, got %d", resp.StatusCode)
+	}
+	body := `{"token":"` + token + `","new_password":"n3w-passw0rd"}`
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset/confirm", "", body); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset/confirm", "", body); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected reset token to be single use, got %d", resp.StatusCode)
+	}
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", before.Token, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected sessions to be revoked by the reset, got %d", resp.StatusCode)
+	}
+	decodeTokens(t, login(t, srv.URL, "n3w-passw0rd"))
+}
+
+func TestPasswordResetMailFailure(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	createCarol(t, "carol@example.com")
+	mailSender = &memMailer{err: errors.New("connection refused")}
+
+	// A mail that cannot be sent looks the same as an unknown address.
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/password/reset", "", `{"email":"carol@example.com"}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202, got %d", resp.StatusCode)
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	carol := createCarol(t, "")
+
+	passwordHasher = &passhash.Hasher{
+		Algorithm: passhash.Argon2id,
+		Argon2:    passhash.Argon2Params{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32},
+	}
+
+	decodeTokens(t, login(t, srv.URL, "secret"))
+	stored, err := userStore.GetByID(t.Context(), carol.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.PasswordHash, "$argon2id$") {
+		t.Fatalf("expected bcrypt hash to be upgraded to argon2id, got %q", stored.PasswordHash)
+	}
+	decodeTokens(t, login(t, srv.URL, "secret"))
+}
+
+func TestLoginUnknownUser(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	// Unknown users are checked against a hash with the current settings,
+	// so they take as long to refuse as a wrong password.
+	if passwordHasher.NeedsRehash(dummyPasswordHash) {
+		t.Errorf("expected dummy hash to use the current settings, got %q", dummyPasswordHash)
+	}
+	if ok, err := verifyPassword(t.Context(), nil, "secret"); ok || err != nil {
+		t.Errorf("expected unknown user not to match, got %v (%v)", ok, err)
+	}
+	if resp := login(t, srv.URL, "secret"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for unknown user, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nexus-im/nexus/passhash"
+	"github.com/nexus-im/nexus/policy"
+)
+
+// accountPolicy decides which usernames and passwords are accepted.
+var accountPolicy = policy.Default()
+
+// bcryptMaxPassword is the longest password bcrypt can hash.
+const bcryptMaxPassword = 72
+
+// loadAccountPolicy builds accountPolicy from the command line flags.
+func loadAccountPolicy() error {
+	p := policy.Default()
+
+	switch *usernameCharset {
+	case policy.CharsetASCII, policy.CharsetUnicode:
+		p.UsernameCharset = *usernameCharset
+	default:
+		return fmt.Errorf("unknown username charset %q", *usernameCharset)
+	}
+	if *usernameMinLength < 1 || *usernameMaxLength < *usernameMinLength || *usernameMaxLength > policy.MaxUsernameLength {
+		return fmt.Errorf("username lengths must satisfy 1 <= min <= max <= %d", policy.MaxUsernameLength)
+	}
+	p.MinUsernameLength = *usernameMinLength
+	p.MaxUsernameLength = *usernameMaxLength
+	p.MinPasswordLength = *passwordMinLength
+	if passwordHasher != nil && passwordHasher.Algorithm == passhash.Bcrypt {
+		p.MaxPasswordLength = bcryptMaxPassword
+	}
+
+	if *reservedUsernames != "" {
+		names, err := policy.LoadList(*reservedUsernames)
+		if err != nil {
+			return err
+		}
+		policy.Merge(p.ReservedUsernames, names)
+	}
+	if *passwordBlocklist != "" {
+		passwords, err := policy.LoadList(*passwordBlocklist)
+		if err != nil {
+			return err
+		}
+		policy.Merge(p.BlockedPasswords, passwords)
+	}
+
+	accountPolicy = p
+	return nil
+}
+
+// writeViolations rejects a request whose username or password breaks the
+// policy, listing every rule broken so clients can show them all at once.
+func writeViolations(w http.ResponseWriter, violations []policy.Violation) {
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":      "policy_violation",
+		"violations": violations,
+	})
+}
@@ -0,0 +1,293 @@
+// Package policy decides which usernames and passwords accounts may have.
+// Usernames are compared after Unicode NFKC normalization and without regard
+// to case, so "Alice", "alice" and "ａｌｉｃｅ" are the same name; passwords
+// are checked for length, for containing the username and against a list of
+// known breached or common passwords.
+package policy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxUsernameLength matches the users.username column.
+const MaxUsernameLength = 50
+
+// Character sets usernames may be drawn from.
+const (
+	// CharsetASCII allows ASCII letters, digits, '_', '.' and '-'.
+	CharsetASCII = "ascii"
+
+	// CharsetUnicode allows letters and digits of any script, but not of
+	// several scripts in one name, plus '_', '.' and '-'.
+	CharsetUnicode = "unicode"
+)
+
+// Codes of the rules a Violation can break.
+const (
+	CodeRequired         = "required"
+	CodeTooShort         = "too_short"
+	CodeTooLong          = "too_long"
+	CodeInvalidChars     = "invalid_characters"
+	CodeMixedScripts     = "mixed_scripts"
+	CodeReserved         = "reserved"
+	CodeContainsUsername = "contains_username"
+	CodeBreached         = "breached"
+)
+
+// Violation describes why a field was rejected.
+type Violation struct {
+	Field   string `json:"field"` // "username" or "password"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// DefaultReservedUsernames cannot be registered because they could be
+// mistaken for the service or its staff, or clash with routes.
+var DefaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "nexus", "support", "help",
+	"moderator", "mod", "staff", "security", "official", "bot", "api",
+	"me", "null", "undefined", "anonymous", "everyone", "here", "server",
+}
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// Policy holds the rules. The zero value accepts everything but empty
+// fields; use Default for sensible limits.
+type Policy struct {
+	UsernameCharset   string          // CharsetASCII or CharsetUnicode
+	MinUsernameLength int             // In characters
+	MaxUsernameLength int             // In characters, at most MaxUsernameLength
+	ReservedUsernames map[string]bool // Lower case
+
+	MinPasswordLength int             // In characters
+	MaxPasswordLength int             // In bytes; bcrypt ignores all past 72
+	BlockedPasswords  map[string]bool // Lower case
+}
+
+// Default returns the policy used unless configured otherwise: ASCII names of
+// 3 to 32 characters and passwords of at least 8 characters that are not on
+// the built-in list of common passwords.
+func Default() *Policy {
+	return &Policy{
+		UsernameCharset:   CharsetASCII,
+		MinUsernameLength: 3,
+		MaxUsernameLength: 32,
+		ReservedUsernames: toSet(DefaultReservedUsernames),
+		MinPasswordLength: 8,
+		MaxPasswordLength: 256,
+		BlockedPasswords:  defaultBlockedPasswords(),
+	}
+}
+
+func defaultBlockedPasswords() map[string]bool {
+	set, err := parseList(strings.NewReader(commonPasswords))
+	if err != nil {
+		panic(err) // Cannot fail on an in-memory list
+	}
+	return set
+}
+
+// NormalizeUsername returns the form of name that is checked and stored.
+func NormalizeUsername(name string) string {
+	return norm.NFKC.String(strings.TrimSpace(name))
+}
+
+// CheckUsername returns the rules the normalized name breaks.
+func (p *Policy) CheckUsername(name string) []Violation {
+	if name == "" {
+		return []Violation{usernameViolation(CodeRequired, "Username is required")}
+	}
+
+	var vs []Violation
+	n := utf8.RuneCountInString(name)
+	if n < p.MinUsernameLength {
+		vs = append(vs, usernameViolation(CodeTooShort, fmt.Sprintf("Username must be at least %d characters", p.MinUsernameLength)))
+	}
+	if max := p.maxUsernameLength(); n > max {
+		vs = append(vs, usernameViolation(CodeTooLong, fmt.Sprintf("Username must be at most %d characters", max)))
+	}
+
+	first, _ := utf8.DecodeRuneInString(name)
+	if !p.allowed(name) {
+		vs = append(vs, usernameViolation(CodeInvalidChars, p.charsetMessage()))
+	} else if !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		vs = append(vs, usernameViolation(CodeInvalidChars, "Username must start with a letter or digit"))
+	} else if p.UsernameCharset == CharsetUnicode && mixedScripts(name) {
+		vs = append(vs, usernameViolation(CodeMixedScripts, "Username must not mix letters of different scripts"))
+	}
+
+	if p.ReservedUsernames[strings.ToLower(name)] {
+		vs = append(vs, usernameViolation(CodeReserved, "Username is reserved"))
+	}
+	return vs
+}
+
+// CheckPassword returns the rules password breaks. username may be empty
+// when it is not known yet.
+func (p *Policy) CheckPassword(password, username string) []Violation {
+	if password == "" {
+		return []Violation{passwordViolation(CodeRequired, "Password is required")}
+	}
+
+	var vs []Violation
+	if utf8.RuneCountInString(password) < p.MinPasswordLength {
+		vs = append(vs, passwordViolation(CodeTooShort, fmt.Sprintf("Password must be at least %d characters", p.MinPasswordLength)))
+	}
+	if p.MaxPasswordLength > 0 && len(password) > p.MaxPasswordLength {
+		vs = append(vs, passwordViolation(CodeTooLong, fmt.Sprintf("Password must be at most %d bytes", p.MaxPasswordLength)))
+	}
+
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		vs = append(vs, passwordViolation(CodeContainsUsername, "Password must not contain the username"))
+	}
+	if p.BlockedPasswords[lower] {
+		vs = append(vs, passwordViolation(CodeBreached, "Password is too common or has appeared in a data breach"))
+	}
+	return vs
+}
+
+// SanitizeUsername turns an arbitrary name, such as one suggested by an
+// identity provider, into one that satisfies the character rules by dropping
+// the characters that do not. The result may still be too short or reserved.
+func (p *Policy) SanitizeUsername(name string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range NormalizeUsername(name) {
+		if r == ' ' {
+			r = '_'
+		}
+		if !p.allowedRune(r) || (n == 0 && !unicode.IsLetter(r) && !unicode.IsDigit(r)) {
+			continue
+		}
+		if n == p.maxUsernameLength() {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+func (p *Policy) maxUsernameLength() int {
+	if p.MaxUsernameLength <= 0 || p.MaxUsernameLength > MaxUsernameLength {
+		return MaxUsernameLength
+	}
+	return p.MaxUsernameLength
+}
+
+func (p *Policy) allowed(name string) bool {
+	for _, r := range name {
+		if !p.allowedRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Policy) allowedRune(r rune) bool {
+	if r == '_' || r == '.' || r == '-' {
+		return true
+	}
+	if p.UsernameCharset == CharsetUnicode {
+		return unicode.IsLetter(r) || unicode.Is(unicode.Nd, r) || unicode.IsMark(r)
+	}
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func (p *Policy) charsetMessage() string {
+	if p.UsernameCharset == CharsetUnicode {
+		return "Username may only contain letters, digits, '_', '.' and '-'"
+	}
+	return "Username may only contain ASCII letters, digits, '_', '.' and '-'"
+}
+
+// mixedScripts reports whether name has letters of more than one script, as
+// in "аlice" with a Cyrillic "а".
+func mixedScripts(name string) bool {
+	var seen *unicode.RangeTable
+	for _, r := range name {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		script := scriptOf(r)
+		if script == nil {
+			continue
+		}
+		if seen != nil && seen != script {
+			return true
+		}
+		seen = script
+	}
+	return false
+}
+
+func scriptOf(r rune) *unicode.RangeTable {
+	if unicode.Is(unicode.Latin, r) {
+		return unicode.Latin
+	}
+	for name, table := range unicode.Scripts {
+		if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+			return table
+		}
+	}
+	return nil
+}
+
+// LoadList reads a list of reserved usernames or blocked passwords from
+// path: one entry per line, blank lines and lines starting with '#' ignored.
+// Entries are lower-cased.
+func LoadList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return parseList(f)
+}
+
+// Merge adds the entries of other to set.
+func Merge(set, other map[string]bool) {
+	for k := range other {
+		set[k] = true
+	}
+}
+
+func parseList(r io.Reader) (map[string]bool, error) {
+	set := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return set, sc.Err()
+}
+
+func toSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[strings.ToLower(s)] = true
+	}
+	return set
+}
+
+func usernameViolation(code, msg string) Violation {
+	return Violation{Field: "username", Code: code, Message: msg}
+}
+
+func passwordViolation(code, msg string) Violation {
+	return Violation{Field: "password", Code: code, Message: msg}
+}
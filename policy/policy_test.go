@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+// codes lists the codes of vs.
+func codes(vs []Violation) []string {
+	var out []string
+	for _, v := range vs {
+		out = append(out, v.Code)
+	}
+	return out
+}
+
+func TestCheckUsername(t *testing.T) {
+	p := Default()
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"alice", nil},
+		{"Alice_99", nil},
+		{"a.b-c", nil},
+		{"", []string{CodeRequired}},
+		{"al", []string{CodeTooShort}},
+		{strings.Repeat("a", 33), []string{CodeTooLong}},
+		{"аlice", []string{CodeInvalidChars}}, // Cyrillic а
+		{"al ice", []string{CodeInvalidChars}},
+		{"_alice", []string{CodeInvalidChars}},
+		{"Admin", []string{CodeReserved}},
+	}
+	for _, tt := range tests {
+		got := codes(p.CheckUsername(tt.name))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("CheckUsername(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckUsernameUnicode(t *testing.T) {
+	p := Default()
+	p.UsernameCharset = CharsetUnicode
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"алиса", nil},
+		{"josé", nil},
+		{"ユーザー1", nil},
+		{"аlice", []string{CodeMixedScripts}},
+		{"ali😀ce", []string{CodeInvalidChars}},
+	}
+	for _, tt := range tests {
+		got := codes(p.CheckUsername(tt.name))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("CheckUsername(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	if got := NormalizeUsername(" ａｌｉｃｅ "); got != "alice" {
+		t.Errorf("expected fullwidth letters to normalize to alice, got %q", got)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	p := Default()
+	p.MaxPasswordLength = 72
+	tests := []struct {
+		password, username string
+		want               []string
+	}{
+		{"correct horse battery", "alice", nil},
+		{"", "alice", []string{CodeRequired}},
+		{"short", "alice", []string{CodeTooShort}},
+		{strings.Repeat("x", 73), "alice", []string{CodeTooLong}},
+		{"my-Alice-password", "alice", []string{CodeContainsUsername}},
+		{"Password123", "alice", []string{CodeBreached}},
+		{"my-alice-password", "", nil},
+	}
+	for _, tt := range tests {
+		got := codes(p.CheckPassword(tt.password, tt.username))
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("CheckPassword(%q, %q) = %v, want %v", tt.password, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeUsername(t *testing.T) {
+	p := Default()
+	tests := []struct{ in, want string }{
+		{"Dave Smith", "Dave_Smith"},
+		{"_.josé", "jos"},
+		{strings.Repeat("b", 40), strings.Repeat("b", 32)},
+	}
+	for _, tt := range tests {
+		if got := p.SanitizeUsername(tt.in); got != tt.want {
+			t.Errorf("SanitizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nexus-im/nexus/policy"
+)
+
+func TestRegisterPolicy(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	rejected := []struct {
+		body string
+		code string
+	}{
+		{`{"username":"` + strings.Repeat("c", 51) + `","password":"correct horse"}`, policy.CodeTooLong},
+		{`{"username":"аlice","password":"correct horse"}`, policy.CodeInvalidChars},
+		{`{"username":"root","password":"correct horse"}`, policy.CodeReserved},
+		{`{"username":"carol","password":"password123"}`, policy.CodeBreached},
+		{`{"username":"carol","password":"carol2024!"}`, policy.CodeContainsUsername},
+	}
+	for _, tt := range rejected {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/api/register", "", tt.body)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.body, resp.StatusCode)
+			continue
+		}
+		var body struct {
+			Error      string             `json:"error"`
+			Violations []policy.Violation `json:"violations"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error != "policy_violation" || len(body.Violations) != 1 || body.Violations[0].Code != tt.code {
+			t.Errorf("%s: expected a %s violation, got %+v", tt.body, tt.code, body)
+		}
+	}
+
+	// Usernames differing only in case or width are the same name.
+	for _, name := range []string{"Alice", "ａｌｉｃｅ"} {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/api/register", "", `{"username":"`+name+`","password":"correct horse"}`)
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("%s: expected 409, got %d", name, resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/register", "", `{"username":"Carol","password":"correct horse"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"correct horse"}`))
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// Profile limits, matching the users columns.
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxAvatarURLLength   = 2048
+	maxStatusTextLength  = 100
+	maxStatusEmojiLength = 32
+)
+
+// maxAvatarSize bounds uploaded avatars.
+const maxAvatarSize = 1 << 20
+
+// avatarTypes are the image types accepted for upload, as sniffed by
+// http.DetectContentType. SVG is not among them since it can carry scripts.
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// visibleUser returns what the viewer may see of u: other users do not see
+// the email address, and nobody sees a status that has expired.
+func visibleUser(u *user.User, viewerID string) *user.User {
+	v := *u
+	if viewerID != u.ID {
+		v.Email = ""
+	}
+	if v.Status != nil && v.Status.Expired(time.Now()) {
+		v.Status = nil
+	}
+	return &v
+}
+
+// handleGetMe returns the authenticated user. API keys need the read scope.
+func handleGetMe(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireScope(w, r, scopeRead)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleUser(u, u.ID))
+}
+
+// handleGetUser returns another user's profile. API keys need the read scope.
+func handleGetUser(w http.ResponseWriter, r *http.Request) {
+	viewer, ok := requireScope(w, r, scopeRead)
+	if !ok {
+		return
+	}
+
+	u, err := userStore.GetByID(r.Context(), r.PathValue("id"))
+	if errors.Is(err, user.ErrUserNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading user %s: %v", r.PathValue("id"), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, visibleUser(u, viewer.ID))
+}
+
+// handleUpdateMe changes the profile fields present in the body and leaves
+// the others alone. A null status clears it. API keys need the write scope,
+// so bots can keep their own profile.
+func handleUpdateMe(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	u, ok := requireScope(w, r, scopeWrite)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		DisplayName *string         `json:"display_name"`
+		Bio         *string         `json:"bio"`
+		AvatarURL   *string         `json:"avatar_url"`
+		Status      json.RawMessage `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var update user.ProfileUpdate
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if err := checkProfileText("display_name", displayName, maxDisplayNameLength, false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.DisplayName = &displayName
+	}
+	if req.Bio != nil {
+		bio := strings.TrimSpace(*req.Bio)
+		if err := checkProfileText("bio", bio, maxBioLength, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.Bio = &bio
+	}
+	if req.AvatarURL != nil {
+		avatarURL := strings.TrimSpace(*req.AvatarURL)
+		if err := checkAvatarURL(avatarURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.AvatarURL = &avatarURL
+	}
+	if len(req.Status) > 0 {
+		status, err := decodeStatus(req.Status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.Status, update.SetStatus = status, true
+	}
+
+	updated, err := userStore.UpdateProfile(r.Context(), u.ID, update)
+	if err != nil {
+		log.Printf("Error updating profile of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// An external avatar replaces an uploaded one.
+	if req.AvatarURL != nil {
+		if err := userStore.DeleteAvatar(r.Context(), u.ID); err != nil {
+			log.Printf("Error deleting avatar of %s: %v", u.ID, err)
+		}
+	}
+
+	u = updated
+	announceProfile(r.Context(), hub, u)
+	writeJSON(w, http.StatusOK, visibleUser(u, u.ID))
+}
+
+// handleUploadAvatar stores the image in the request body as the user's
+// avatar and points avatar_url at it.
+func handleUploadAvatar(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	u, ok := requireScope(w, r, scopeWrite)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAvatarSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Avatar must be at most %d bytes", maxAvatarSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		http.Error(w, "Avatar must be a PNG, JPEG, GIF or WebP image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	avatar := &user.Avatar{UserID: u.ID, ContentType: contentType, Data: data, UpdatedAt: time.Now()}
+	if err := userStore.SetAvatar(r.Context(), avatar); err != nil {
+		log.Printf("Error storing avatar of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The version parameter changes with every upload, so the image can be
+	// cached for long.
+	avatarURL := fmt.Sprintf("/api/users/%s/avatar?v=%d", url.PathEscape(u.ID), avatar.UpdatedAt.Unix())
+	updated, err := userStore.UpdateProfile(r.Context(), u.ID, user.ProfileUpdate{AvatarURL: &avatarURL})
+	if err != nil {
+		log.Printf("Error updating profile of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	u = updated
+
+	announceProfile(r.Context(), hub, u)
+	writeJSON(w, http.StatusOK, visibleUser(u, u.ID))
+}
+
+// handleDeleteAvatar removes the user's avatar, uploaded or external.
+func handleDeleteAvatar(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	u, ok := requireScope(w, r, scopeWrite)
+	if !ok {
+		return
+	}
+
+	if err := userStore.DeleteAvatar(r.Context(), u.ID); err != nil {
+		log.Printf("Error deleting avatar of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var noAvatar string
+	updated, err := userStore.UpdateProfile(r.Context(), u.ID, user.ProfileUpdate{AvatarURL: &noAvatar})
+	if err != nil {
+		log.Printf("Error updating profile of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	u = updated
+
+	announceProfile(r.Context(), hub, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetAvatar serves an uploaded avatar. It needs no credentials since
+// browsers load it from an <img> tag.
+func handleGetAvatar(w http.ResponseWriter, r *http.Request) {
+	avatar, err := userStore.GetAvatar(r.Context(), r.PathValue("id"))
+	if errors.Is(err, user.ErrAvatarNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error loading avatar of %s: %v", r.PathValue("id"), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", avatar.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", avatar.UpdatedAt, bytes.NewReader(avatar.Data))
+}
+
+// announceProfile sends u's profile to every connection of the users sharing
+// a room with u and to u's own other connections. Failing to find them is
+// logged, not fatal: the change itself has been saved.
+func announceProfile(ctx context.Context, hub *Hub, u *user.User) {
+	userIDs, err := roomStore.ListCoMembers(ctx, u.ID)
+	if err != nil {
+		log.Printf("Error listing users sharing a room with %s: %v", u.ID, err)
+	}
+	userIDs = append(userIDs, u.ID)
+
+	msg, err := encodeEvent(eventUserUpdated, UserUpdatedPayload{User: visibleUser(u, "")})
+	if err != nil {
+		log.Printf("Error encoding profile of %s: %v", u.ID, err)
+		return
+	}
+	hub.userBroadcast <- userMessage{userIDs: userIDs, message: msg}
+}
+
+// decodeStatus parses the status of a profile update; null clears it.
+func decodeStatus(raw json.RawMessage) (*user.Status, error) {
+	var status *user.Status
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return nil, errors.New("status must be an object or null")
+	}
+	if status == nil {
+		return nil, nil
+	}
+
+	status.Text = strings.TrimSpace(status.Text)
+	status.Emoji = strings.TrimSpace(status.Emoji)
+	if status.Text == "" && status.Emoji == "" {
+		return nil, nil
+	}
+	if err := checkProfileText("status.text", status.Text, maxStatusTextLength, false); err != nil {
+		return nil, err
+	}
+	if err := checkProfileText("status.emoji", status.Emoji, maxStatusEmojiLength, false); err != nil {
+		return nil, err
+	}
+	if status.ExpiresAt != nil && !status.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("status.expires_at must be in the future")
+	}
+	return status, nil
+}
+
+// checkProfileText rejects text that is too long or has control characters;
+// multiline text may contain line breaks.
+func checkProfileText(field, s string, maxLength int, multiline bool) error {
+	if utf8.RuneCountInString(s) > maxLength {
+		return fmt.Errorf("%s must be at most %d characters", field, maxLength)
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			return fmt.Errorf("%s must not contain control characters", field)
+		}
+	}
+	return nil
+}
+
+// checkAvatarURL accepts empty strings, which remove the avatar, and absolute
+// http(s) URLs.
+func checkAvatarURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	if len(s) > maxAvatarURLLength {
+		return fmt.Errorf("avatar_url must be at most %d characters", maxAvatarURLLength)
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("avatar_url must be an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/room"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// expectUserUpdated fails the test unless c's next message announces the
+// profile of userID, and returns it.
+func expectUserUpdated(t *testing.T, c *Client, userID string) *user.User {
+	t.Helper()
+	select {
+	case msg := <-c.send:
+		var env Envelope
+		var p UserUpdatedPayload
+		if err := json.Unmarshal(msg, &env); err != nil || env.Type != eventUserUpdated {
+			t.Fatalf("%s: expected user_updated, got %s", c.user.ID, msg)
+		}
+		if err := json.Unmarshal(env.Payload, &p); err != nil || p.User == nil || p.User.ID != userID {
+			t.Fatalf("%s: expected profile of %s, got %s", c.user.ID, userID, msg)
+		}
+		return p.User
+	case <-time.After(time.Second):
+		t.Fatalf("%s: timed out waiting for user_updated", c.user.ID)
+		return nil
+	}
+}
+
+func decodeUser(t *testing.T, resp *http.Response) *user.User {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var u user.User
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+func TestProfile(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+	alice, _ := userStore.GetByID(t.Context(), "alice")
+	alice.Email = "alice@example.com"
+
+	// alice and bob share a room, carol does not.
+	roomStore = newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+	for _, id := range []string{"alice", "bob"} {
+		if err := roomStore.AddMember(t.Context(), "general", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := userStore.Create(t.Context(), &user.User{Username: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	carol := newTestClient(hub, "user-carol")
+	register(t, hub, carol)
+	settle(t, hub, clients["alice-phone"], clients["alice-laptop"], clients["bob-phone"])
+
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := `{"display_name":" Alice A. ","bio":"Hi","status":{"text":"In a meeting","emoji":"📅","expires_at":"` + expires + `"}}`
+	me := decodeUser(t, doRequest(t, http.MethodPatch, srv.URL+"/api/users/me", "token-phone", body))
+	if me.DisplayName != "Alice A." || me.Bio != "Hi" || me.Status == nil || me.Status.Text != "In a meeting" || me.Email == "" {
+		t.Errorf("unexpected profile %+v", me)
+	}
+
+	for _, c := range []*Client{clients["bob-phone"], clients["alice-laptop"]} {
+		got := expectUserUpdated(t, c, "alice")
+		if got.DisplayName != "Alice A." || got.Email != "" {
+			t.Errorf("%s: expected display name without email, got %+v", c.user.ID, got)
+		}
+	}
+	settle(t, hub, carol)
+	expectNoMessage(t, carol)
+
+	// Others do not see the email address.
+	seen := decodeUser(t, doRequest(t, http.MethodGet, srv.URL+"/api/users/alice", "token-bob", ""))
+	if seen.DisplayName != "Alice A." || seen.Email != "" {
+		t.Errorf("unexpected profile seen by bob %+v", seen)
+	}
+	if self := decodeUser(t, doRequest(t, http.MethodGet, srv.URL+"/api/users/me", "token-phone", "")); self.Email != "alice@example.com" {
+		t.Errorf("expected own email, got %+v", self)
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/users/nobody", "token-bob", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown user, got %d", resp.StatusCode)
+	}
+
+	// Fields not in the body stay; a null status is cleared.
+	me = decodeUser(t, doRequest(t, http.MethodPatch, srv.URL+"/api/users/me", "token-phone", `{"status":null}`))
+	if me.DisplayName != "Alice A." || me.Status != nil {
+		t.Errorf("expected only the status to be cleared, got %+v", me)
+	}
+
+	invalid := []string{
+		`{"display_name":"` + strings.Repeat("a", maxDisplayNameLength+1) + `"}`,
+		`{"display_name":"a\u0007b"}`,
+		`{"avatar_url":"javascript:alert(1)"}`,
+		`{"status":{"text":"Away","expires_at":"2001-01-01T00:00:00Z"}}`,
+		`{"status":"away"}`,
+	}
+	for _, body := range invalid {
+		if resp := doRequest(t, http.MethodPatch, srv.URL+"/api/users/me", "token-phone", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// Expired statuses are hidden.
+	past := time.Now().Add(-time.Minute)
+	if _, err := userStore.UpdateProfile(t.Context(), "alice", user.ProfileUpdate{Status: &user.Status{Text: "Lunch", ExpiresAt: &past}, SetStatus: true}); err != nil {
+		t.Fatal(err)
+	}
+	if seen := decodeUser(t, doRequest(t, http.MethodGet, srv.URL+"/api/users/alice", "token-bob", "")); seen.Status != nil {
+		t.Errorf("expected expired status to be hidden, got %+v", seen.Status)
+	}
+}
+
+func TestProfileConcurrentUpdates(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	// doRequest may not be called off the test goroutine.
+	var wg sync.WaitGroup
+	patch := func(token, body string) {
+		defer wg.Done()
+		req, _ := http.NewRequest(http.MethodPatch, srv.URL+"/api/users/me", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// Two devices change different fields at once; neither undoes the other.
+	for i := 0; i < 20; i++ {
+		name, bio := fmt.Sprintf("Alice %d", i), fmt.Sprintf("Bio %d", i)
+		wg.Add(2)
+		go patch("token-phone", `{"display_name":"`+name+`"}`)
+		go patch("token-laptop", `{"bio":"`+bio+`"}`)
+		wg.Wait()
+
+		u, err := userStore.GetByID(t.Context(), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.DisplayName != name || u.Bio != bio {
+			t.Fatalf("expected %q and %q, got %q and %q", name, bio, u.DisplayName, u.Bio)
+		}
+	}
+}
+
+func TestAvatarUpload(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+	settle(t, hub, clients["alice-phone"], clients["alice-laptop"], clients["bob-phone"])
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+	me := decodeUser(t, doRequest(t, http.MethodPut, srv.URL+"/api/users/me/avatar", "token-phone", string(png)))
+	if !strings.HasPrefix(me.AvatarURL, "/api/users/alice/avatar?v=") {
+		t.Fatalf("expected avatar_url to point at the upload, got %q", me.AvatarURL)
+	}
+	expectUserUpdated(t, clients["alice-laptop"], "alice")
+
+	// Served without credentials.
+	resp := doRequest(t, http.MethodGet, srv.URL+me.AvatarURL, "", "")
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(data, png) {
+		t.Errorf("unexpected avatar response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/api/users/me/avatar", "token-phone", svg); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for svg, got %d", resp.StatusCode)
+	}
+	huge := string(png) + strings.Repeat("x", maxAvatarSize)
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/api/users/me/avatar", "token-phone", huge); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for oversized avatar, got %d", resp.StatusCode)
+	}
+
+	if resp := doRequest(t, http.MethodDelete, srv.URL+"/api/users/me/avatar", "token-phone", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/users/alice/avatar", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected deleted avatar to be gone, got %d", resp.StatusCode)
+	}
+	settle(t, hub, clients["alice-laptop"])
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/readmarker"
+	"github.com/nexus-im/nexus/store/room"
+	"github.com/nexus-im/nexus/store/user"
+)
+
+// Event types exchanged over the websocket. See doc/api_spec.md.
+const (
+	// Client -> Server
+	eventAuth          = "auth"
+	eventSendMessage   = "send_message"
+	eventJoin          = "join"
+	eventCreateRoom    = "create_room"
+	eventJoinRoom      = "join_room"
+	eventLeaveRoom     = "leave_room"
+	eventListRooms     = "list_rooms"
+	eventHistory       = "history"
+	eventSendDirect    = "send_direct"
+	eventDirectHistory = "direct_history"
+	eventAck           = "ack"
+	eventMarkRead      = "mark_read"
+
+	// Both directions: clients send these to start and stop a typing
+	// indicator, and receive them for other users. They are ephemeral,
+	// see ephemeral.go.
+	eventTypingStart = "typing_start"
+	eventTypingStop  = "typing_stop"
+
+	// Server -> Client
+	eventConnected           = "connected"
+	eventBroadcastMessage    = "broadcast_message"
+	eventSystemNotification  = "system_notification"
+	eventUserList            = "user_list"
+	eventRoomJoined          = "room_joined"
+	eventRoomLeft            = "room_left"
+	eventRoomList            = "room_list"
+	eventMessageHistory      = "message_history"
+	eventDirectMessage       = "direct_message"
+	eventDirectHistoryResult = "direct_message_history"
+	eventUserUpdated         = "user_updated"
+	eventMessagesDropped     = "messages_dropped"
+	eventReadReceipt         = "read_receipt"
+	eventUnreadSummary       = "unread_summary"
+	eventError               = "error"
+)
+
+// Error codes carried in the payload of an "error" event.
+const (
+	errCodeBadRequest     = "bad_request"
+	errCodeUnknownType    = "unknown_type"
+	errCodeInvalidPayload = "invalid_payload"
+	errCodeNotFound       = "not_found"
+	errCodeConflict       = "conflict"
+	errCodeForbidden      = "forbidden"
+	errCodeInternal       = "internal_error"
+)
+
+// Envelope is the base structure of every message exchanged over the
+// websocket.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// AuthPayload is the first event of a websocket opened without credentials in
+// the handshake. Exactly one of Token and Ticket must be set.
+type AuthPayload struct {
+	Token  string `json:"token,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// SendMessagePayload is sent by a client to post a message to the chat. The
+// sender is always taken from the authenticated connection; any identity
+// fields supplied by the client are ignored.
+type SendMessagePayload struct {
+	RoomID  string `json:"room_id"`
+	Content string `json:"content"`
+}
+
+// CreateRoomPayload is sent by a client to create a new room. The creator
+// joins the room automatically.
+type CreateRoomPayload struct {
+	Name string `json:"name"`
+}
+
+// JoinRoomPayload is sent by a client to join an existing room, identified
+// either by ID or by name.
+type JoinRoomPayload struct {
+	RoomID string `json:"room_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// LeaveRoomPayload is sent by a client to leave a room.
+type LeaveRoomPayload struct {
+	RoomID string `json:"room_id"`
+}
+
+// HistoryPayload requests a page of a room's message history. Before is the ID
+// of the oldest message the client already has; zero requests the most recent
+// page.
+type HistoryPayload struct {
+	RoomID string `json:"room_id"`
+	Before int64  `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// SendDirectPayload is sent by a client to message a single user, addressed
+// either by user ID or by username.
+type SendDirectPayload struct {
+	UserID   string `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Content  string `json:"content"`
+}
+
+// DirectHistoryPayload requests a page of the direct messages exchanged with
+// another user. Before and Limit work as in HistoryPayload.
+type DirectHistoryPayload struct {
+	UserID string `json:"user_id"`
+	Before int64  `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// AckPayload is sent by a client to acknowledge every message of a room up
+// to and including Seq. Resuming the connection's stream later replays only
+// what comes after it.
+type AckPayload struct {
+	RoomID string `json:"room_id"`
+	Seq    int64  `json:"seq"`
+}
+
+// MarkReadPayload is sent by a client once the user has read every message
+// of a room up to and including Seq. Unlike an ack it applies to all of the
+// user's connections.
+type MarkReadPayload struct {
+	RoomID string `json:"room_id"`
+	Seq    int64  `json:"seq"`
+}
+
+// TypingPayload is sent by a client that starts or stops typing in a room or
+// to a single user. Exactly one of RoomID and UserID must be set.
+type TypingPayload struct {
+	RoomID string `json:"room_id,omitempty"`
+	UserID string `json:"user_id,omitempty"`
+}
+
+// TypingIndicatorPayload tells a client that UserID started or stopped typing,
+// in RoomID or, if it is empty, to the client's user.
+type TypingIndicatorPayload struct {
+	RoomID   string `json:"room_id,omitempty"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// BroadcastMessagePayload is a chat message fanned out to clients. All sender
+// fields are filled in by the server. Seq numbers the messages of each room
+// without gaps.
+type BroadcastMessagePayload struct {
+	ID        int64     `json:"id"`
+	RoomID    string    `json:"room_id"`
+	Seq       int64     `json:"seq"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ConnectedPayload is the first event of every connection. ResumeID names
+// the connection's delivery stream; passing it as resume_from when
+// reconnecting replays the messages not acknowledged on it. Resumed reports
+// whether resume_from was accepted, and Rooms what was replayed.
+type ConnectedPayload struct {
+	ResumeID string        `json:"resume_id"`
+	Resumed  bool          `json:"resumed"`
+	Rooms    []ResumedRoom `json:"rooms,omitempty"`
+}
+
+// ResumedRoom describes the replay of one room. Seq is the last sequence
+// replayed, or the acknowledged one if nothing was missed. HasMore is set
+// when the gap was too large to replay in full; the client should fetch
+// history instead.
+type ResumedRoom struct {
+	RoomID  string `json:"room_id"`
+	Seq     int64  `json:"seq"`
+	HasMore bool   `json:"has_more"`
+}
+
+// SystemNotificationPayload is a server generated notice, e.g. a user joining.
+type SystemNotificationPayload struct {
+	RoomID    string    `json:"room_id,omitempty"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UserListPayload lists the currently active usernames.
+type UserListPayload struct {
+	Users []string `json:"users"`
+}
+
+// RoomJoinedPayload is sent to every connection of a user that joined or
+// created a room.
+type RoomJoinedPayload struct {
+	Room *room.Room `json:"room"`
+}
+
+// RoomLeftPayload is sent to every connection of a user that left a room.
+type RoomLeftPayload struct {
+	RoomID string `json:"room_id"`
+}
+
+// RoomListEntry describes a room in a room_list event.
+type RoomListEntry struct {
+	*room.Room
+	Joined bool `json:"joined"`
+}
+
+// RoomListPayload answers a list_rooms request.
+type RoomListPayload struct {
+	Rooms []RoomListEntry `json:"rooms"`
+}
+
+// MessageHistoryPayload carries a page of room history, oldest first. HasMore
+// reports whether older messages exist before the first one in the page.
+type MessageHistoryPayload struct {
+	RoomID   string                    `json:"room_id"`
+	Messages []BroadcastMessagePayload `json:"messages"`
+	HasMore  bool                      `json:"has_more"`
+}
+
+// DirectMessagePayload is a direct message delivered to both the recipient and
+// the sender's connections. All sender fields are filled in by the server.
+type DirectMessagePayload struct {
+	ID             int64     `json:"id"`
+	SenderID       string    `json:"sender_id"`
+	SenderUsername string    `json:"sender_username"`
+	RecipientID    string    `json:"recipient_id"`
+	Content        string    `json:"content"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// DirectHistoryResultPayload carries a page of direct messages exchanged with
+// UserID, oldest first.
+type DirectHistoryResultPayload struct {
+	UserID   string                 `json:"user_id"`
+	Messages []DirectMessagePayload `json:"messages"`
+	HasMore  bool                   `json:"has_more"`
+}
+
+// UserUpdatedPayload carries the changed profile of a user to everyone
+// sharing a room with them. The email address is never included.
+type UserUpdatedPayload struct {
+	User *user.User `json:"user"`
+}
+
+// MessagesDroppedPayload tells a client that fell behind how many events the
+// server discarded instead of delivering. Clients should refetch room
+// history to fill the gap.
+type MessagesDroppedPayload struct {
+	Count     int64     `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ReadReceiptPayload tells the members of a room that a user has read its
+// messages up to and including Seq.
+type ReadReceiptPayload struct {
+	RoomID    string    `json:"room_id"`
+	UserID    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Seq       int64     `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UnreadSummaryPayload lists how far the user has read in each of their
+// rooms. It is sent on connect, after connected, and returned by
+// GET /api/rooms/unread.
+type UnreadSummaryPayload struct {
+	Rooms []*readmarker.Unread `json:"rooms"`
+}
+
+// EventError describes why an inbound event was rejected. Event handlers
+// return it to have it reported back to the sending client as an "error"
+// event.
+type EventError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *EventError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func invalidPayload(message string) *EventError {
+	return &EventError{Code: errCodeInvalidPayload, Message: message}
+}
+
+func messagePayload(msg *message.Message) BroadcastMessagePayload {
+	return BroadcastMessagePayload{
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		Seq:       msg.Seq,
+		UserID:    msg.UserID,
+		Username:  msg.Username,
+		Content:   msg.Content,
+		Timestamp: msg.CreatedAt.UTC(),
+	}
+}
+
+func directMessagePayload(msg *message.DirectMessage) DirectMessagePayload {
+	return DirectMessagePayload{
+		ID:             msg.ID,
+		SenderID:       msg.SenderID,
+		SenderUsername: msg.SenderUsername,
+		RecipientID:    msg.RecipientID,
+		Content:        msg.Content,
+		Timestamp:      msg.CreatedAt.UTC(),
+	}
+}
+
+// encodeEvent wraps payload in an Envelope of the given type and returns the
+// JSON encoding ready to be written to a client.
+func encodeEvent(eventType string, payload interface{}) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Type: eventType, Payload: raw})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nexus-im/nexus/store/readmarker"
+)
+
+// handleMarkRead moves the user's read marker in a room forward and tells the
+// room's members. Marking read is not answered otherwise; a marker that did
+// not move is not announced.
+func handleMarkRead(c *Client, payload json.RawMessage) error {
+	var p MarkReadPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.RoomID == "" {
+		return invalidPayload("room_id is required")
+	}
+	if p.Seq <= 0 {
+		return invalidPayload("seq must be positive")
+	}
+	if !c.inRoom(p.RoomID) {
+		return &EventError{Code: errCodeForbidden, Message: "not a member of this room"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	m := &readmarker.Marker{UserID: c.user.ID, RoomID: p.RoomID, Seq: p.Seq, UpdatedAt: time.Now()}
+	moved, err := readMarkerStore.Mark(ctx, m)
+	if err != nil || !moved {
+		return err
+	}
+
+	msg, err := encodeEvent(eventReadReceipt, ReadReceiptPayload{
+		RoomID:    m.RoomID,
+		UserID:    c.user.ID,
+		Username:  c.user.Username,
+		Seq:       m.Seq,
+		Timestamp: m.UpdatedAt.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	// The user's other connections get it too, to keep their unread counts
+	// in sync.
+	c.hub.roomBroadcast <- roomMessage{roomID: p.RoomID, message: msg}
+	return nil
+}
+
+// markOwnMessageRead moves the sender's marker past a message they posted, so
+// their own messages never count as unread. It is not announced: the message
+// itself tells the room.
+func markOwnMessageRead(ctx context.Context, userID, roomID string, seq int64) {
+	m := &readmarker.Marker{UserID: userID, RoomID: roomID, Seq: seq, UpdatedAt: time.Now()}
+	if _, err := readMarkerStore.Mark(ctx, m); err != nil {
+		log.Printf("error marking room %s read for %s: %v", roomID, userID, err)
+	}
+}
+
+// loadUnread returns the read state of a user's rooms, never nil.
+func loadUnread(ctx context.Context, userID string) ([]*readmarker.Unread, error) {
+	unread, err := readMarkerStore.Unread(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if unread == nil {
+		unread = []*readmarker.Unread{}
+	}
+	return unread, nil
+}
+
+// writeUnread writes the unread_summary event directly to the connection; like
+// replay, it must run before writePump starts.
+func (c *Client) writeUnread() error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	unread, err := loadUnread(ctx, c.user.ID)
+	if err != nil {
+		return err
+	}
+	msg, err := encodeEvent(eventUnreadSummary, UnreadSummaryPayload{Rooms: unread})
+	if err != nil {
+		return err
+	}
+	return c.write(msg)
+}
+
+// handleListUnread returns the read state of each of the authenticated user's
+// rooms. API keys need the read scope.
+func handleListUnread(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireScope(w, r, scopeRead)
+	if !ok {
+		return
+	}
+
+	unread, err := loadUnread(r.Context(), u.ID)
+	if err != nil {
+		log.Printf("Error loading unread counts of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, UnreadSummaryPayload{Rooms: unread})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/nexus-im/nexus/store/readmarker"
+	"github.com/nexus-im/nexus/store/room"
+)
+
+func expectReceipt(t *testing.T, c *Client, wantSeq int64) {
+	t.Helper()
+	env := nextEvent(t, c, eventReadReceipt)
+	var p ReadReceiptPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid read receipt payload: %v", err)
+	}
+	if p.RoomID != "general" || p.UserID != "bob" || p.Username != "bob" || p.Seq != wantSeq {
+		t.Errorf("expected bob to have read general up to %d, got %+v", wantSeq, p)
+	}
+}
+
+func getUnread(t *testing.T, url, token string) []*readmarker.Unread {
+	t.Helper()
+	resp := doRequest(t, http.MethodGet, url+"/api/rooms/unread", token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body UnreadSummaryPayload
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("invalid unread response: %v", err)
+	}
+	return body.Rooms
+}
+
+func TestReadReceipts(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+	rooms := newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+	msgs := &memMessageStore{}
+	roomStore = rooms
+	messageStore = msgs
+	readMarkerStore = newMemReadMarkerStore(rooms, msgs)
+	for _, id := range []string{"alice", "bob"} {
+		if err := rooms.AddMember(context.Background(), "general", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hub.join <- membership{userID: "alice", roomID: "general"}
+	alice := clients["alice-phone"]
+	postMessages(t, "general", "one", "two", "three")
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+	env := readEvent(t, conn)
+	var summary UnreadSummaryPayload
+	if err := json.Unmarshal(env.Payload, &summary); env.Type != eventUnreadSummary || err != nil {
+		t.Fatalf("expected unread_summary after connected, got %s (%v)", env.Type, err)
+	}
+	if len(summary.Rooms) != 1 || *summary.Rooms[0] != (readmarker.Unread{RoomID: "general", LastSeq: 3, Count: 3}) {
+		t.Errorf("expected 3 unread in general, got %+v", summary.Rooms)
+	}
+
+	markRead := func(seq int64) {
+		t.Helper()
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventMarkRead, "payload": MarkReadPayload{RoomID: "general", Seq: seq}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Markers only move forward, and not past the last message; receipts
+	// are only sent when they move.
+	markRead(2)
+	expectReceipt(t, alice, 2)
+	markRead(1)
+	markRead(99)
+	expectReceipt(t, alice, 3)
+	readUntil(t, conn, eventReadReceipt)
+
+	if unread := getUnread(t, srv.URL, "token-bob"); len(unread) != 1 || *unread[0] != (readmarker.Unread{RoomID: "general", LastReadSeq: 3, LastSeq: 3}) {
+		t.Errorf("expected general read, got %+v", unread)
+	}
+
+	// Posting marks the room read for the sender only.
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventSendMessage, "payload": SendMessagePayload{RoomID: "general", Content: "four"}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, eventBroadcastMessage)
+	if unread := getUnread(t, srv.URL, "token-bob"); len(unread) != 1 || unread[0].Count != 0 || unread[0].LastReadSeq != 4 {
+		t.Errorf("expected own message to be read, got %+v", unread)
+	}
+	if unread := getUnread(t, srv.URL, "token-phone"); len(unread) != 1 || unread[0].Count != 4 {
+		t.Errorf("expected 4 unread for alice, got %+v", unread)
+	}
+}
+
+func TestMarkReadRejected(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+
+	tests := []struct {
+		payload MarkReadPayload
+		code    string
+	}{
+		{MarkReadPayload{Seq: 1}, errCodeInvalidPayload},
+		{MarkReadPayload{RoomID: "general"}, errCodeInvalidPayload},
+		{MarkReadPayload{RoomID: "general", Seq: 1}, errCodeForbidden},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventMarkRead, "payload": tt.payload}); err != nil {
+			t.Fatal(err)
+		}
+		env, _ := readUntil(t, conn, eventError)
+		var evErr EventError
+		if err := json.Unmarshal(env.Payload, &evErr); err != nil {
+			t.Fatal(err)
+		}
+		if evErr.Code != tt.code {
+			t.Errorf("%+v: expected %s, got %s", tt.payload, tt.code, evErr.Code)
+		}
+	}
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/api/rooms/unread", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without credentials, got %d", resp.StatusCode)
+	}
+}
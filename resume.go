@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nexus-im/nexus/store/cursor"
+)
+
+// resumeIDLength is the length of a resume ID: 16 random bytes, hex encoded.
+const resumeIDLength = 32
+
+// maxHeldBytes bounds the live messages held for a connection while it
+// replays. A connection that misses more than that during its replay is
+// dropped as a slow consumer.
+const maxHeldBytes = 1 << 20
+
+// newResumeID returns a random ID for a new delivery stream.
+func newResumeID() (string, error) {
+	b := make([]byte, resumeIDLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validResumeID reports whether id could have been issued by newResumeID.
+func validResumeID(id string) bool {
+	if len(id) != resumeIDLength {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// resumeStream picks the delivery stream of a new connection: the one named
+// by resumeFrom if it is a valid resume ID, or a new one. It returns the
+// stream's cursors, which are nil for a new stream. If the cursors cannot be
+// loaded a new stream is started, so the client gets a regular backfill.
+func resumeStream(userID, resumeFrom string) (id string, resumed bool, cursors []*cursor.Cursor, err error) {
+	if validResumeID(resumeFrom) {
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		defer cancel()
+		cursors, err = cursorStore.List(ctx, userID, resumeFrom)
+		if err == nil {
+			return resumeFrom, true, cursors, nil
+		}
+		log.Printf("error loading cursors of stream %s for %s: %v", resumeFrom, userID, err)
+	}
+
+	id, err = newResumeID()
+	return id, false, nil, err
+}
+
+// replayHold keeps the live messages for a connection that is still
+// replaying, so they neither overtake the replay nor fill the send buffer
+// before writePump runs. The hub pushes to it until startClient has written
+// out what it holds and released it; from then on messages go to the send
+// buffer. A nil hold is released.
+type replayHold struct {
+	mu       sync.Mutex
+	messages [][]byte
+	bytes    int
+	released bool
+}
+
+// push holds message unless the hold has been released, and reports whether
+// it did. ok is false if holding message would exceed maxHeldBytes, in which
+// case it is not held and the client must be dropped.
+func (h *replayHold) push(message []byte) (held, ok bool) {
+	if h == nil {
+		return false, true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return false, true
+	}
+	if h.bytes+len(message) > maxHeldBytes {
+		return true, false
+	}
+	h.messages = append(h.messages, message)
+	h.bytes += len(message)
+	return true, true
+}
+
+// take removes and returns the held messages. Once there are none left it
+// releases the hold, so no message can slip in between.
+func (h *replayHold) take() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	messages := h.messages
+	h.messages, h.bytes = nil, 0
+	if len(messages) == 0 {
+		h.released = true
+	}
+	return messages
+}
+
+// release discards the held messages and releases the hold.
+func (h *replayHold) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages, h.bytes = nil, 0
+	h.released = true
+}
+
+// writeHeld writes the live messages held during the replay, directly to the
+// connection, until none are left and the hold is released.
+func (c *Client) writeHeld() error {
+	for {
+		messages := c.hold.take()
+		if len(messages) == 0 {
+			return nil
+		}
+		for _, message := range messages {
+			if err := c.write(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replay writes, directly to the connection, the messages of every room with
+// a cursor that were posted after it, then the connected event. It must run
+// after the client is registered and before writePump starts: live messages
+// are then held until the replay is done, and nothing posted in between is
+// lost. A message may arrive both replayed and live; clients drop sequences
+// they already have. It returns the rooms that were replayed.
+func (c *Client) replay(resumed bool, cursors []*cursor.Cursor, limit int) (map[string]bool, error) {
+	replayed := make(map[string]bool, len(cursors))
+	connected := ConnectedPayload{ResumeID: c.resumeID, Resumed: resumed}
+	for _, cur := range cursors {
+		if !c.inRoom(cur.RoomID) {
+			continue
+		}
+		room, err := c.replayRoom(cur.RoomID, cur.Seq, limit)
+		if err != nil {
+			return replayed, err
+		}
+		replayed[cur.RoomID] = true
+		connected.Rooms = append(connected.Rooms, room)
+	}
+
+	msg, err := encodeEvent(eventConnected, connected)
+	if err != nil {
+		return replayed, err
+	}
+	return replayed, c.write(msg)
+}
+
+// replayRoom writes up to limit messages of a room posted after seq. Only
+// errors writing to the connection are returned; if the store fails the room
+// is reported as having more, so the client falls back to history.
+func (c *Client) replayRoom(roomID string, seq int64, limit int) (ResumedRoom, error) {
+	room := ResumedRoom{RoomID: roomID, Seq: seq}
+	for sent := 0; ; {
+		// Ask for one more than is left to find out whether the gap is
+		// larger than limit.
+		n := min(maxHistoryLimit, limit-sent+1)
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		msgs, err := messageStore.ListAfter(ctx, roomID, room.Seq, n)
+		cancel()
+		if err != nil {
+			log.Printf("error replaying room %s to %s: %v", roomID, c.user.ID, err)
+			room.HasMore = true
+			return room, nil
+		}
+
+		for _, msg := range msgs {
+			if sent == limit {
+				room.HasMore = true
+				return room, nil
+			}
+			data, err := encodeEvent(eventBroadcastMessage, messagePayload(msg))
+			if err != nil {
+				return room, err
+			}
+			if err := c.write(data); err != nil {
+				return room, err
+			}
+			room.Seq = msg.Seq
+			sent++
+		}
+		if len(msgs) < n {
+			return room, nil
+		}
+	}
+}
+
+// handleAck moves the connection's cursor in a room forward. Acks are not
+// answered.
+func handleAck(c *Client, payload json.RawMessage) error {
+	var p AckPayload
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	if p.RoomID == "" {
+		return invalidPayload("room_id is required")
+	}
+	if p.Seq <= 0 {
+		return invalidPayload("seq must be positive")
+	}
+	if !c.inRoom(p.RoomID) {
+		return &EventError{Code: errCodeForbidden, Message: "not a member of this room"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	return cursorStore.Ack(ctx, &cursor.Cursor{
+		UserID:    c.user.ID,
+		StreamID:  c.resumeID,
+		RoomID:    p.RoomID,
+		Seq:       p.Seq,
+		UpdatedAt: time.Now(),
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/nexus-im/nexus/store/message"
+	"github.com/nexus-im/nexus/store/room"
+
+	"github.com/gorilla/websocket"
+)
+
+// readUntil reads events from conn until one of type want arrives and
+// returns it along with the events skipped on the way.
+func readUntil(t *testing.T, conn *websocket.Conn, want string) (Envelope, []Envelope) {
+	t.Helper()
+	var skipped []Envelope
+	for {
+		env := readEvent(t, conn)
+		if env.Type == want {
+			return env, skipped
+		}
+		skipped = append(skipped, env)
+	}
+}
+
+func decodeConnected(t *testing.T, env Envelope) ConnectedPayload {
+	t.Helper()
+	var p ConnectedPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatalf("invalid connected payload: %v", err)
+	}
+	return p
+}
+
+func postMessages(t *testing.T, roomID string, contents ...string) {
+	t.Helper()
+	for _, content := range contents {
+		if err := messageStore.Create(context.Background(), &message.Message{RoomID: roomID, UserID: "alice", Username: "alice", Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	rooms := newMemRoomStore(&room.Room{ID: "general", Name: "general"}, &room.Room{ID: "random", Name: "random"})
+	roomStore = rooms
+	messageStore = &memMessageStore{}
+	for _, id := range []string{"general", "random"} {
+		if err := rooms.AddMember(context.Background(), id, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	postMessages(t, "general", "one", "two", "three")
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := decodeConnected(t, readEvent(t, conn))
+	if first.Resumed || !validResumeID(first.ResumeID) {
+		t.Fatalf("expected a new stream, got %+v", first)
+	}
+
+	// Acks are not answered; a request that is lets us know it was handled.
+	for _, ack := range []AckPayload{{RoomID: "general", Seq: 1}, {RoomID: "random", Seq: 1}} {
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventAck, "payload": ack}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventListRooms}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, eventRoomList)
+	_ = conn.Close()
+
+	postMessages(t, "general", "four")
+	postMessages(t, "random", "five")
+
+	// Everything after the acked sequence is replayed before connected.
+	conn, _, err = dialToken(t, wsURL(srv)+"?resume_from="+first.ResumeID, "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, replayed := readUntil(t, conn, eventConnected)
+	var got []string
+	for _, e := range replayed {
+		var m BroadcastMessagePayload
+		if e.Type != eventBroadcastMessage || json.Unmarshal(e.Payload, &m) != nil {
+			t.Fatalf("expected only replayed messages before connected, got %s", e.Type)
+		}
+		got = append(got, m.Content)
+	}
+	if len(got) != 3 || got[0] != "two" || got[1] != "three" || got[2] != "four" {
+		t.Errorf("expected two, three and four replayed, got %v", got)
+	}
+	resumed := decodeConnected(t, env)
+	if !resumed.Resumed || resumed.ResumeID != first.ResumeID {
+		t.Errorf("expected stream %s to be resumed, got %+v", first.ResumeID, resumed)
+	}
+	if len(resumed.Rooms) != 2 || resumed.Rooms[0] != (ResumedRoom{RoomID: "general", Seq: 4}) {
+		t.Errorf("unexpected rooms %+v", resumed.Rooms)
+	}
+	// "five" is the first message of random, so acking seq 1 covered it.
+	if len(resumed.Rooms) == 2 && resumed.Rooms[1] != (ResumedRoom{RoomID: "random", Seq: 1}) {
+		t.Errorf("unexpected random room %+v", resumed.Rooms[1])
+	}
+	_ = conn.Close()
+
+	// A gap larger than the limit is cut short.
+	defer func(limit int) { *resumeLimit = limit }(*resumeLimit)
+	*resumeLimit = 2
+	conn, _, err = dialToken(t, wsURL(srv)+"?resume_from="+first.ResumeID, "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, replayed = readUntil(t, conn, eventConnected)
+	if len(replayed) != 2 {
+		t.Errorf("expected 2 messages replayed, got %d", len(replayed))
+	}
+	if rooms := decodeConnected(t, env).Rooms; len(rooms) == 0 || rooms[0] != (ResumedRoom{RoomID: "general", Seq: 3, HasMore: true}) {
+		t.Errorf("expected general to have more, got %+v", rooms)
+	}
+	_ = conn.Close()
+
+	// Another user cannot resume bob's stream.
+	conn, _, err = dialToken(t, wsURL(srv)+"?resume_from="+first.ResumeID, "token-phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := decodeConnected(t, readEvent(t, conn)); len(p.Rooms) != 0 {
+		t.Errorf("expected nothing replayed to alice, got %+v", p.Rooms)
+	}
+
+	// Anything that is not a resume ID starts a new stream.
+	conn, _, err = dialToken(t, wsURL(srv)+"?resume_from=bogus", "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := decodeConnected(t, readEvent(t, conn)); p.Resumed || p.ResumeID == first.ResumeID {
+		t.Errorf("expected a new stream, got %+v", p)
+	}
+}
+
+func TestAckRejected(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+
+	for _, ack := range []AckPayload{{Seq: 1}, {RoomID: "general"}, {RoomID: "general", Seq: 1}} {
+		if err := conn.WriteJSON(map[string]interface{}{"type": eventAck, "payload": ack}); err != nil {
+			t.Fatal(err)
+		}
+		env, _ := readUntil(t, conn, eventError)
+		var evErr EventError
+		if err := json.Unmarshal(env.Payload, &evErr); err != nil {
+			t.Fatal(err)
+		}
+		if ack.RoomID != "" && ack.Seq != 0 && evErr.Code != errCodeForbidden {
+			t.Errorf("expected forbidden for a room bob is not in, got %s", evErr.Code)
+		}
+	}
+}
+
+// blockingMessageStore holds up the first ListAfter until proceed is closed,
+// so a test can deliver live messages while a replay is in flight.
+type blockingMessageStore struct {
+	*memMessageStore
+	once    sync.Once
+	started chan struct{}
+	proceed chan struct{}
+}
+
+func (s *blockingMessageStore) ListAfter(ctx context.Context, roomID string, after int64, limit int) ([]*message.Message, error) {
+	s.once.Do(func() {
+		close(s.started)
+		<-s.proceed
+	})
+	return s.memMessageStore.ListAfter(ctx, roomID, after, limit)
+}
+
+func TestResumeDuringLiveTraffic(t *testing.T) {
+	srv, hub, _ := newSessionTestServer(t)
+	rooms := newMemRoomStore(&room.Room{ID: "general", Name: "general"})
+	roomStore = rooms
+	messageStore = &memMessageStore{}
+	if err := rooms.AddMember(context.Background(), "general", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	postMessages(t, "general", "first")
+
+	conn, _, err := dialToken(t, wsURL(srv), "token-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := decodeConnected(t, readEvent(t, conn)).ResumeID
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventAck, "payload": AckPayload{RoomID: "general", Seq: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(map[string]interface{}{"type": eventListRooms}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, eventRoomList)
+	_ = conn.Close()
+
+	// Both the replay and the live traffic during it are longer than the
+	// send buffer.
+	const n = 300
+	missed := make([]string, n)
+	for i := range missed {
+		missed[i] = "missed"
+	}
+	postMessages(t, "general", missed...)
+	store := &blockingMessageStore{
+		memMessageStore: messageStore.(*memMessageStore),
+		started:         make(chan struct{}),
+		proceed:         make(chan struct{}),
+	}
+	messageStore = store
+
+	done := make(chan *websocket.Conn)
+	go func() {
+		conn, _, err := dialToken(t, wsURL(srv)+"?resume_from="+stream, "token-bob")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- conn
+	}()
+	<-store.started
+	for i := 0; i < n; i++ {
+		hub.roomBroadcast <- roomMessage{roomID: "general", message: []byte(`{"type":"live"}`)}
+	}
+	close(store.proceed)
+	conn = <-done
+	if conn == nil {
+		t.FailNow()
+	}
+
+	// The replay comes first, then the live messages, and the client is
+	// not dropped.
+	_, replayed := readUntil(t, conn, eventConnected)
+	if len(replayed) != n {
+		t.Errorf("expected %d messages replayed, got %d", n, len(replayed))
+	}
+	live := 0
+	for live < n {
+		if env := readEvent(t, conn); env.Type == "live" {
+			live++
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nexus-im/nexus/store/session"
+)
+
+// sessionInfo is the public view of a session. It never includes the token.
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Current   bool      `json:"current"`
+}
+
+// handleLogout ends the session used to authenticate the request, or every
+// session of the user when the body is {"all": true}. Sessions issued by a
+// refresh token end together with the rest of their family, so the client
+// cannot refresh its way back in. Websockets opened with the revoked sessions
+// are closed.
+func handleLogout(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		All bool `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.All {
+		if err := sessionStore.DeleteAllForUser(r.Context(), u.ID); err != nil {
+			log.Printf("Error deleting sessions of %s: %v", u.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		hub.revoke <- revocation{userID: u.ID}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := endSession(r.Context(), hub, sess); err != nil && !errors.Is(err, session.ErrSessionNotFound) {
+		log.Printf("Error deleting session %s: %v", sess.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListSessions lists the active sessions of the authenticated user.
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := sessionStore.ListByUser(r.Context(), u.ID)
+	if err != nil {
+		log.Printf("Error listing sessions of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, sessionInfo{
+			ID:        s.ID,
+			CreatedAt: s.CreatedAt,
+			ExpiresAt: s.ExpiresAt,
+			Current:   s.ID == sess.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": infos})
+}
+
+// handleRevokeSession deletes one of the authenticated user's sessions by ID
+// and closes any websocket opened with it.
+func handleRevokeSession(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	_, u, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+
+	// Only allow revoking the caller's own sessions. Unknown IDs and other
+	// users' sessions are indistinguishable to the caller.
+	sessions, err := sessionStore.ListByUser(r.Context(), u.ID)
+	if err != nil {
+		log.Printf("Error listing sessions of %s: %v", u.ID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var target *session.Session
+	for _, s := range sessions {
+		if s.ID == id {
+			target = s
+			break
+		}
+	}
+	if target == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := endSession(r.Context(), hub, target); err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting session %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endSession deletes sess, or its whole refresh token family if it has one,
+// and closes the websockets opened with the deleted sessions.
+func endSession(ctx context.Context, hub *Hub, sess *session.Session) error {
+	if sess.FamilyID != "" {
+		return revokeFamily(ctx, hub, sess.UserID, sess.FamilyID)
+	}
+	if err := sessionStore.Delete(ctx, sess.ID); err != nil {
+		return err
+	}
+	hub.revoke <- revocation{userID: sess.UserID, sessionID: sess.ID}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/passhash"
+	"github.com/nexus-im/nexus/policy"
+	"github.com/nexus-im/nexus/store/session"
+	"github.com/nexus-im/nexus/store/user"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newSessionTestServer wires the API to in-memory stores holding two sessions
+// for alice and one for bob, with a live websocket client for each session.
+func newSessionTestServer(t *testing.T) (*httptest.Server, *Hub, map[string]*Client) {
+	t.Helper()
+
+	expires := time.Now().Add(time.Hour)
+	sessions := []*session.Session{
+		{ID: "alice-phone", UserID: "alice", Token: "token-phone", CreatedAt: time.Now(), ExpiresAt: expires},
+		{ID: "alice-laptop", UserID: "alice", Token: "token-laptop", CreatedAt: time.Now(), ExpiresAt: expires},
+		{ID: "bob-phone", UserID: "bob", Token: "token-bob", CreatedAt: time.Now(), ExpiresAt: expires},
+	}
+	userStore = newMemUserStore(
+		&user.User{ID: "alice", Username: "alice"},
+		&user.User{ID: "bob", Username: "bob"},
+	)
+	sessionStore = newMemSessionStore(sessions...)
+	attemptStore = newMemAttemptStore()
+	mfaStore = newMemMFAStore()
+	apiKeyStore = newMemAPIKeyStore()
+	cursorStore = newMemCursorStore()
+	readMarkerStore = newMemReadMarkerStore(nil, nil)
+	passwordHasher = &passhash.Hasher{Algorithm: passhash.Bcrypt, BcryptCost: bcrypt.MinCost}
+	if err := initDummyPasswordHash(); err != nil {
+		t.Fatal(err)
+	}
+	accountPolicy = policy.Default()
+	mailSender = &memMailer{}
+
+	hub := newHub(nil, nil)
+	go hub.run()
+
+	clients := make(map[string]*Client)
+	for _, sess := range sessions {
+		c := newTestClient(hub, sess.UserID)
+		c.session = sess
+		clients[sess.ID] = c
+		register(t, hub, c)
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, hub)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, hub, clients
+}
+
+func doRequest(t *testing.T, method, url, token, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error building request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// expectClosed fails the test unless the hub closed c's send channel with a
+// close frame, draining anything queued before it.
+func expectClosed(t *testing.T, c *Client) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-c.send:
+			if ok {
+				continue
+			}
+			if c.closeFrame == nil {
+				t.Errorf("%s: expected a close frame", c.session.ID)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("%s: expected connection to be closed", c.session.ID)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/logout", "", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/logout", "token-phone", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	expectClosed(t, clients["alice-phone"])
+	settle(t, hub, clients["alice-laptop"])
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/api/sessions", "token-phone", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected logged out token to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/logout", "token-laptop", `{"all":true}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	expectClosed(t, clients["alice-laptop"])
+	settle(t, hub, clients["bob-phone"])
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	srv, hub, clients := newSessionTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", "token-laptop", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Sessions []map[string]interface{} `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(body.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(body.Sessions))
+	}
+	for _, s := range body.Sessions {
+		if _, ok := s["token"]; ok {
+			t.Errorf("session listing must not expose tokens")
+		}
+		if s["current"] != (s["id"] == "alice-laptop") {
+			t.Errorf("unexpected current flag on %v", s)
+		}
+	}
+
+	// Other users' sessions cannot be revoked.
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/sessions/bob-phone", "token-laptop", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+
+	resp = doRequest(t, http.MethodDelete, srv.URL+"/api/sessions/alice-phone", "token-laptop", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	expectClosed(t, clients["alice-phone"])
+	settle(t, hub, clients["alice-laptop"], clients["bob-phone"])
+}
@@ -0,0 +1,70 @@
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Prefix starts every API key, which tells keys apart from session tokens.
+const Prefix = "nxk_"
+
+// Key is a long-lived credential that acts for a user, usually a bot, within
+// its scopes. Only a hash of Token is persisted, so Token is only set on keys
+// passed to Create and returned by GetByToken.
+type Key struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // Nil for keys that do not expire
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasScope reports whether the key grants scope.
+func (k *Key) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrKeyNotFound = errors.New("api key not found")
+	ErrKeyExpired  = errors.New("api key expired")
+)
+
+// Store defines the interface for API key persistence.
+type Store interface {
+	// Create stores a new key and sets its ID.
+	Create(ctx context.Context, key *Key) error
+
+	// GetByToken retrieves the key for a presented token. Expired keys yield
+	// ErrKeyExpired.
+	GetByToken(ctx context.Context, token string) (*Key, error)
+
+	// GetByID retrieves a key by its ID.
+	GetByID(ctx context.Context, id string) (*Key, error)
+
+	// ListByUser returns the keys of a user, newest first.
+	ListByUser(ctx context.Context, userID string) ([]*Key, error)
+
+	// Delete revokes a key.
+	Delete(ctx context.Context, id string) error
+
+	// Touch records that the key was used at the given time.
+	Touch(ctx context.Context, id string, at time.Time) error
+}
+
+// HashToken returns the representation of an API key stored at rest. Keys
+// are random, so a plain SHA-256 suffices.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,159 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Create(ctx context.Context, key *Key) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, key_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+
+	return s.db.QueryRowContext(ctx, query,
+		key.UserID,
+		key.Name,
+		HashToken(key.Token),
+		strings.Join(key.Scopes, " "),
+		key.CreatedAt,
+		key.ExpiresAt,
+	).Scan(&key.ID)
+}
+
+func (s *SQLStore) GetByToken(ctx context.Context, token string) (*Key, error) {
+	query := `
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_keys
+		WHERE key_hash = $1
+	`
+
+	key, err := scanKey(s.db.QueryRowContext(ctx, query, HashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	key.Token = token
+
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, ErrKeyExpired
+	}
+
+	return key, nil
+}
+
+func (s *SQLStore) GetByID(ctx context.Context, id string) (*Key, error) {
+	query := `
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_keys
+		WHERE id = $1
+	`
+
+	key, err := scanKey(s.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (s *SQLStore) ListByUser(ctx context.Context, userID string) ([]*Key, error) {
+	query := `
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var keys []*Key
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) Delete(ctx context.Context, id string) error {
+	query := `DELETE FROM api_keys WHERE id = $1`
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) Touch(ctx context.Context, id string, at time.Time) error {
+	query := `UPDATE api_keys SET last_used_at = $1 WHERE id = $2`
+
+	_, err := s.db.ExecContext(ctx, query, at, id)
+	return err
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (*Key, error) {
+	var key Key
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&scopes,
+		&key.CreatedAt,
+		&expiresAt,
+		&lastUsedAt,
+	); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return &key, nil
+}
@@ -0,0 +1,136 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := &Key{
+		UserID:    "bot-123",
+		Name:      "deploy notifications",
+		Token:     Prefix + "secret",
+		Scopes:    []string{"read", "write"},
+		CreatedAt: fixedTime,
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO api_keys (user_id, name, key_hash, scopes, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`)).
+		WithArgs("bot-123", "deploy notifications", HashToken(Prefix+"secret"), "read write", fixedTime, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("key-1"))
+
+	if err := store.Create(ctx, key); err != nil {
+		t.Errorf("error was not expected while creating key: %s", err)
+	}
+	if key.ID != "key-1" {
+		t.Errorf("expected ID to be set, got %s", key.ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetByToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at FROM api_keys WHERE key_hash = $1`
+	columns := []string{"id", "user_id", "name", "scopes", "created_at", "expires_at", "last_used_at"}
+	now := time.Now()
+
+	// Success Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("good")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("key-1", "bot-123", "ci", "read", now, nil, nil))
+
+	key, err := store.GetByToken(ctx, "good")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	} else if !key.HasScope("read") || key.HasScope("write") || key.ExpiresAt != nil {
+		t.Errorf("unexpected key: %+v", key)
+	}
+
+	// Expired Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("key-2", "bot-123", "ci", "read", now, now.Add(-time.Minute), nil))
+
+	if _, err := store.GetByToken(ctx, "old"); err != ErrKeyExpired {
+		t.Errorf("expected ErrKeyExpired, got %v", err)
+	}
+
+	// Not Found Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("unknown")).
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.GetByToken(ctx, "unknown"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM api_keys WHERE id = $1`)).
+		WithArgs("key-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM api_keys WHERE id = $1`)).
+		WithArgs("key-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.Delete(ctx, "key-1"); err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if err := store.Delete(ctx, "key-1"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,47 @@
+package attempt
+
+import (
+	"context"
+	"time"
+)
+
+// Attempt tracks consecutive failed logins for a key, such as a username or a
+// client address.
+type Attempt struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"` // Zero when not locked
+}
+
+// Locked reports whether the key is locked out at the given time, and for how
+// much longer.
+func (a *Attempt) Locked(now time.Time) (bool, time.Duration) {
+	if a.LockedUntil.After(now) {
+		return true, a.LockedUntil.Sub(now)
+	}
+	return false, 0
+}
+
+// Store defines the interface for login attempt persistence.
+type Store interface {
+	// Get returns the attempts recorded for key. A key without failures
+	// yields an empty Attempt, not an error.
+	Get(ctx context.Context, key string) (*Attempt, error)
+
+	// RecordFailure counts a failed login for key at the given time and
+	// returns the updated record. Failures recorded before resetBefore no
+	// longer count, so the count starts over from one.
+	RecordFailure(ctx context.Context, key string, at, resetBefore time.Time) (*Attempt, error)
+
+	// Lock locks key out until the given time.
+	Lock(ctx context.Context, key string, until time.Time) error
+
+	// Reset forgets all failures of key, lifting any lockout.
+	Reset(ctx context.Context, key string) error
+
+	// DeleteStale deletes up to limit records whose last failure was before
+	// the given time and that are not locked out at now, and returns how
+	// many were removed.
+	DeleteStale(ctx context.Context, before, now time.Time, limit int) (int64, error)
+}
@@ -0,0 +1,97 @@
+package attempt
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Get(ctx context.Context, key string) (*Attempt, error) {
+	query := `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1`
+
+	a := Attempt{Key: key}
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, key).Scan(
+		&a.Failures,
+		&a.LastFailureAt,
+		&lockedUntil,
+	)
+	if err == sql.ErrNoRows {
+		return &a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a.LockedUntil = lockedUntil.Time
+
+	return &a, nil
+}
+
+func (s *SQLStore) RecordFailure(ctx context.Context, key string, at, resetBefore time.Time) (*Attempt, error) {
+	// Upsert so that concurrent failures for the same key are all counted.
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at < $3 THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures, last_failure_at, locked_until
+	`
+
+	a := Attempt{Key: key}
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, key, at, resetBefore).Scan(
+		&a.Failures,
+		&a.LastFailureAt,
+		&lockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	a.LockedUntil = lockedUntil.Time
+
+	return &a, nil
+}
+
+func (s *SQLStore) Lock(ctx context.Context, key string, until time.Time) error {
+	query := `UPDATE login_attempts SET locked_until = $1 WHERE key = $2`
+
+	_, err := s.db.ExecContext(ctx, query, until, key)
+	return err
+}
+
+func (s *SQLStore) Reset(ctx context.Context, key string) error {
+	query := `DELETE FROM login_attempts WHERE key = $1`
+
+	_, err := s.db.ExecContext(ctx, query, key)
+	return err
+}
+
+func (s *SQLStore) DeleteStale(ctx context.Context, before, now time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM login_attempts
+		WHERE key IN (
+			SELECT key FROM login_attempts
+			WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= $2)
+			LIMIT $3
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, now, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,163 @@
+package attempt
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	query := `SELECT failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1`
+
+	// Locked Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("user:alice").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at", "locked_until"}).
+			AddRow(6, now, now.Add(time.Minute)))
+
+	a, err := store.Get(ctx, "user:alice")
+	if err != nil {
+		t.Errorf("error was not expected while getting attempts: %s", err)
+	} else if locked, wait := a.Locked(now); !locked || wait != time.Minute {
+		t.Errorf("expected key to be locked for a minute, got %v %v", locked, wait)
+	}
+
+	// Unknown Key Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("user:bob").
+		WillReturnError(sql.ErrNoRows)
+
+	a, err = store.Get(ctx, "user:bob")
+	if err != nil {
+		t.Errorf("error was not expected for unknown key: %s", err)
+	} else if a.Failures != 0 {
+		t.Errorf("expected no failures, got %d", a.Failures)
+	} else if locked, _ := a.Locked(now); locked {
+		t.Errorf("expected unknown key not to be locked")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	resetBefore := now.Add(-time.Hour)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2) ON CONFLICT (key) DO UPDATE SET`)).
+		WithArgs("ip:10.0.0.1", now, resetBefore).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at", "locked_until"}).
+			AddRow(3, now, nil))
+
+	a, err := store.RecordFailure(ctx, "ip:10.0.0.1", now, resetBefore)
+	if err != nil {
+		t.Errorf("error was not expected while recording failure: %s", err)
+	} else if a.Failures != 3 || !a.LockedUntil.IsZero() {
+		t.Errorf("unexpected attempt %+v", a)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLockAndReset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	until := time.Now().Add(time.Minute)
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE login_attempts SET locked_until = $1 WHERE key = $2`)).
+		WithArgs(until, "user:alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM login_attempts WHERE key = $1`)).
+		WithArgs("user:alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.Lock(ctx, "user:alice", until); err != nil {
+		t.Errorf("error was not expected while locking: %s", err)
+	}
+	if err := store.Reset(ctx, "user:alice"); err != nil {
+		t.Errorf("error was not expected while resetting: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteStale(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-24 * time.Hour)
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM login_attempts WHERE key IN ( SELECT key FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until <= $2) LIMIT $3 )`)).
+		WithArgs(before, now, 500).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	n, err := store.DeleteStale(ctx, before, now, 500)
+	if err != nil {
+		t.Errorf("error was not expected while deleting stale attempts: %s", err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 rows deleted, got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,32 @@
+package cursor
+
+import (
+	"context"
+	"time"
+)
+
+// Cursor records the last room message a client acknowledged on a delivery
+// stream. A stream outlives single connections and sessions: a client passes
+// its stream ID back when reconnecting to resume where it left off.
+type Cursor struct {
+	UserID    string    `json:"user_id"`
+	StreamID  string    `json:"stream_id"`
+	RoomID    string    `json:"room_id"`
+	Seq       int64     `json:"seq"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store defines the interface for delivery cursor persistence. Streams are
+// scoped to a user, so a stream ID presented by someone else finds nothing.
+type Store interface {
+	// Ack moves the cursor of a stream in a room to seq. Cursors never move
+	// backwards, so acks may arrive in any order.
+	Ack(ctx context.Context, c *Cursor) error
+
+	// List returns the cursors of a user's stream.
+	List(ctx context.Context, userID, streamID string) ([]*Cursor, error)
+
+	// DeleteStale deletes up to limit cursors not acked since before and
+	// returns how many were removed.
+	DeleteStale(ctx context.Context, before time.Time, limit int) (int64, error)
+}
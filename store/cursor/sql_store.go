@@ -0,0 +1,74 @@
+package cursor
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Ack(ctx context.Context, c *Cursor) error {
+	query := `
+		INSERT INTO delivery_cursors (user_id, stream_id, room_id, seq, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, stream_id, room_id) DO UPDATE
+		SET seq = GREATEST(delivery_cursors.seq, EXCLUDED.seq), updated_at = EXCLUDED.updated_at
+	`
+
+	if c.UpdatedAt.IsZero() {
+		c.UpdatedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, query, c.UserID, c.StreamID, c.RoomID, c.Seq, c.UpdatedAt)
+	return err
+}
+
+func (s *SQLStore) List(ctx context.Context, userID, streamID string) ([]*Cursor, error) {
+	query := `
+		SELECT room_id, seq, updated_at
+		FROM delivery_cursors
+		WHERE user_id = $1 AND stream_id = $2
+		ORDER BY room_id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, streamID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var cursors []*Cursor
+	for rows.Next() {
+		c := Cursor{UserID: userID, StreamID: streamID}
+		if err := rows.Scan(&c.RoomID, &c.Seq, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, &c)
+	}
+	return cursors, rows.Err()
+}
+
+func (s *SQLStore) DeleteStale(ctx context.Context, before time.Time, limit int) (int64, error) {
+	// The table has no single-column key, so batches are picked by ctid.
+	query := `
+		DELETE FROM delivery_cursors
+		WHERE ctid IN (
+			SELECT ctid FROM delivery_cursors WHERE updated_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
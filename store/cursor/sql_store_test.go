@@ -0,0 +1,110 @@
+package cursor
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := &Cursor{UserID: "user-1", StreamID: "stream-1", RoomID: "room-1", Seq: 42, UpdatedAt: fixedTime}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO delivery_cursors (user_id, stream_id, room_id, seq, updated_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (user_id, stream_id, room_id) DO UPDATE SET seq = GREATEST(delivery_cursors.seq, EXCLUDED.seq), updated_at = EXCLUDED.updated_at`)).
+		WithArgs("user-1", "stream-1", "room-1", int64(42), fixedTime).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.Ack(ctx, c); err != nil {
+		t.Errorf("error was not expected while acking: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT room_id, seq, updated_at FROM delivery_cursors WHERE user_id = $1 AND stream_id = $2 ORDER BY room_id`)).
+		WithArgs("user-1", "stream-1").
+		WillReturnRows(sqlmock.NewRows([]string{"room_id", "seq", "updated_at"}).
+			AddRow("room-1", 42, fixedTime).
+			AddRow("room-2", 7, fixedTime))
+
+	cursors, err := store.List(ctx, "user-1", "stream-1")
+	if err != nil {
+		t.Fatalf("error was not expected while listing cursors: %s", err)
+	}
+	if len(cursors) != 2 {
+		t.Fatalf("expected 2 cursors, got %d", len(cursors))
+	}
+	if c := cursors[1]; c.RoomID != "room-2" || c.Seq != 7 || c.UserID != "user-1" || c.StreamID != "stream-1" {
+		t.Errorf("unexpected cursor %+v", c)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteStale(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	cutoff := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM delivery_cursors WHERE ctid IN ( SELECT ctid FROM delivery_cursors WHERE updated_at < $1 LIMIT $2 )`)).
+		WithArgs(cutoff, 500).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := store.DeleteStale(ctx, cutoff, 500)
+	if err != nil {
+		t.Errorf("error was not expected while deleting stale cursors: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 rows deleted, got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Package pgerr translates PostgreSQL errors into the sentinel errors of the
+// store packages, so callers can tell a taken username or a vanished parent
+// row from a broken database without knowing about the driver.
+package pgerr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// SQLSTATE codes of integrity constraint violations.
+const (
+	UniqueViolation     = "23505"
+	ForeignKeyViolation = "23503"
+	NotNullViolation    = "23502"
+	CheckViolation      = "23514"
+)
+
+// Rule maps errors with an SQLSTATE code, optionally only those raised by one
+// constraint or index, to a sentinel error.
+type Rule struct {
+	Code       string
+	Constraint string // Empty matches any constraint
+	Err        error
+}
+
+// Unique maps a unique violation of constraint to sentinel.
+func Unique(constraint string, sentinel error) Rule {
+	return Rule{Code: UniqueViolation, Constraint: constraint, Err: sentinel}
+}
+
+// ForeignKey maps a foreign key violation of constraint to sentinel.
+func ForeignKey(constraint string, sentinel error) Rule {
+	return Rule{Code: ForeignKeyViolation, Constraint: constraint, Err: sentinel}
+}
+
+// Map returns err translated by the first matching rule. The result wraps
+// both the sentinel and the driver error, so errors.Is finds the sentinel and
+// the log keeps the details. Errors no rule matches are returned unchanged.
+func Map(err error, rules ...Rule) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	for _, r := range rules {
+		if string(pqErr.Code) == r.Code && (r.Constraint == "" || pqErr.Constraint == r.Constraint) {
+			return fmt.Errorf("%w: %w", r.Err, err)
+		}
+	}
+	return err
+}
+
+// Code returns the SQLSTATE code of err, or "" if err does not come from
+// PostgreSQL.
+func Code(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
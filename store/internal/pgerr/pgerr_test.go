@@ -0,0 +1,53 @@
+package pgerr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+var (
+	errDuplicateName  = errors.New("duplicate name")
+	errDuplicateEmail = errors.New("duplicate email")
+	errMissingParent  = errors.New("missing parent")
+)
+
+func TestMap(t *testing.T) {
+	rules := []Rule{
+		Unique("idx_email", errDuplicateEmail),
+		Unique("", errDuplicateName),
+		ForeignKey("", errMissingParent),
+	}
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{&pq.Error{Code: UniqueViolation, Constraint: "idx_email"}, errDuplicateEmail},
+		{&pq.Error{Code: UniqueViolation, Constraint: "users_username_key"}, errDuplicateName},
+		{fmt.Errorf("inserting: %w", &pq.Error{Code: ForeignKeyViolation}), errMissingParent},
+	}
+	for _, tt := range tests {
+		got := Map(tt.err, rules...)
+		if !errors.Is(got, tt.want) {
+			t.Errorf("Map(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+		var pqErr *pq.Error
+		if !errors.As(got, &pqErr) {
+			t.Errorf("Map(%v) lost the driver error", tt.err)
+		}
+	}
+
+	unmatched := &pq.Error{Code: CheckViolation}
+	if got := Map(unmatched, rules...); got != error(unmatched) {
+		t.Errorf("expected unmatched error to be returned unchanged, got %v", got)
+	}
+	other := errors.New("connection refused")
+	if got := Map(other, rules...); got != other {
+		t.Errorf("expected non-postgres error to be returned unchanged, got %v", got)
+	}
+	if Code(other) != "" || Code(unmatched) != CheckViolation {
+		t.Errorf("unexpected codes %q, %q", Code(other), Code(unmatched))
+	}
+}
@@ -0,0 +1,56 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Message represents a chat message posted to a room. Seq numbers the
+// messages of each room from 1 without gaps, in the order they were stored.
+type Message struct {
+	ID       int64  `json:"id"`
+	RoomID   string `json:"room_id"`
+	Seq      int64  `json:"seq"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"` // Sender's username at the time of posting
+	Content  string `json:"content"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DirectMessage represents a one-to-one message between two users. It is kept
+// apart from room history.
+type DirectMessage struct {
+	ID             int64  `json:"id"`
+	SenderID       string `json:"sender_id"`
+	RecipientID    string `json:"recipient_id"`
+	SenderUsername string `json:"sender_username"` // Sender's username at the time of posting
+	Content        string `json:"content"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var ErrRoomNotFound = errors.New("room not found")
+
+// Store defines the interface for message history persistence.
+type Store interface {
+	// Create inserts a new message and sets its ID and Seq.
+	Create(ctx context.Context, msg *Message) error
+
+	// ListByRoom returns up to limit messages of a room with an ID lower than
+	// before, oldest first. A zero before returns the most recent messages.
+	ListByRoom(ctx context.Context, roomID string, before int64, limit int) ([]*Message, error)
+
+	// ListAfter returns up to limit messages of a room with a Seq greater
+	// than after, oldest first.
+	ListAfter(ctx context.Context, roomID string, after int64, limit int) ([]*Message, error)
+
+	// CreateDirect inserts a new direct message and sets its ID.
+	CreateDirect(ctx context.Context, msg *DirectMessage) error
+
+	// ListDirect returns up to limit direct messages exchanged between two
+	// users in either direction with an ID lower than before, oldest first. A
+	// zero before returns the most recent messages.
+	ListDirect(ctx context.Context, userID, peerID string, before int64, limit int) ([]*DirectMessage, error)
+}
@@ -0,0 +1,196 @@
+package message
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Create(ctx context.Context, msg *Message) error {
+	// Bumping the room's counter locks its row until the insert commits, so
+	// concurrent messages to a room get consecutive sequence numbers.
+	query := `
+		WITH next AS (
+			UPDATE rooms SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq
+		)
+		INSERT INTO messages (room_id, seq, user_id, username, content, created_at)
+		SELECT $1, last_seq, $2, $3, $4, $5 FROM next
+		RETURNING id, seq
+	`
+
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+
+	err := s.db.QueryRowContext(ctx, query,
+		msg.RoomID,
+		msg.UserID,
+		msg.Username,
+		msg.Content,
+		msg.CreatedAt,
+	).Scan(&msg.ID, &msg.Seq)
+	if err == sql.ErrNoRows {
+		return ErrRoomNotFound
+	}
+	return err
+}
+
+func (s *SQLStore) ListByRoom(ctx context.Context, roomID string, before int64, limit int) ([]*Message, error) {
+	// Select the newest page first, then reverse so callers get it in
+	// chronological order.
+	query := `
+		SELECT id, room_id, seq, user_id, username, content, created_at
+		FROM messages
+		WHERE room_id = $1 AND id < $2
+		ORDER BY id DESC
+		LIMIT $3
+	`
+
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	reverse(msgs)
+	return msgs, nil
+}
+
+func (s *SQLStore) ListAfter(ctx context.Context, roomID string, after int64, limit int) ([]*Message, error) {
+	query := `
+		SELECT id, room_id, seq, user_id, username, content, created_at
+		FROM messages
+		WHERE room_id = $1 AND seq > $2
+		ORDER BY seq
+		LIMIT $3
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// scanMessages reads and closes rows of messages.
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	defer func() { _ = rows.Close() }()
+
+	var msgs []*Message
+	for rows.Next() {
+		var msg Message
+		var userID sql.NullString // Sender may have been deleted
+
+		if err := rows.Scan(
+			&msg.ID,
+			&msg.RoomID,
+			&msg.Seq,
+			&userID,
+			&msg.Username,
+			&msg.Content,
+			&msg.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		msg.UserID = userID.String
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (s *SQLStore) CreateDirect(ctx context.Context, msg *DirectMessage) error {
+	query := `
+		INSERT INTO direct_messages (sender_id, recipient_id, sender_username, content, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+
+	return s.db.QueryRowContext(ctx, query,
+		msg.SenderID,
+		msg.RecipientID,
+		msg.SenderUsername,
+		msg.Content,
+		msg.CreatedAt,
+	).Scan(&msg.ID)
+}
+
+func (s *SQLStore) ListDirect(ctx context.Context, userID, peerID string, before int64, limit int) ([]*DirectMessage, error) {
+	query := `
+		SELECT id, sender_id, recipient_id, sender_username, content, created_at
+		FROM direct_messages
+		WHERE ((sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1))
+			AND id < $3
+		ORDER BY id DESC
+		LIMIT $4
+	`
+
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, userID, peerID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var msgs []*DirectMessage
+	for rows.Next() {
+		var msg DirectMessage
+		var senderID, recipientID sql.NullString
+
+		if err := rows.Scan(
+			&msg.ID,
+			&senderID,
+			&recipientID,
+			&msg.SenderUsername,
+			&msg.Content,
+			&msg.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		msg.SenderID = senderID.String
+		msg.RecipientID = recipientID.String
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	reverse(msgs)
+	return msgs, nil
+}
+
+// reverse turns a newest-first page into chronological order.
+func reverse[T any](s []T) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
@@ -0,0 +1,236 @@
+package message
+
+import (
+	"context"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg := &Message{
+		RoomID:    "room-1",
+		UserID:    "user-123",
+		Username:  "testuser",
+		Content:   "hello",
+		CreatedAt: fixedTime,
+	}
+
+	query := regexp.QuoteMeta(`WITH next AS ( UPDATE rooms SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq ) INSERT INTO messages (room_id, seq, user_id, username, content, created_at) SELECT $1, last_seq, $2, $3, $4, $5 FROM next RETURNING id, seq`)
+
+	mock.ExpectQuery(query).
+		WithArgs(msg.RoomID, msg.UserID, msg.Username, msg.Content, msg.CreatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seq"}).AddRow(42, 5))
+
+	err = store.Create(ctx, msg)
+	if err != nil {
+		t.Errorf("error was not expected while creating message: %s", err)
+	}
+	if msg.ID != 42 || msg.Seq != 5 {
+		t.Errorf("expected id 42 and seq 5, got %d and %d", msg.ID, msg.Seq)
+	}
+
+	// Unknown Room Case: no counter was bumped, so nothing is inserted
+	mock.ExpectQuery(query).
+		WithArgs("missing", msg.UserID, msg.Username, msg.Content, msg.CreatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seq"}))
+
+	err = store.Create(ctx, &Message{RoomID: "missing", UserID: msg.UserID, Username: msg.Username, Content: msg.Content, CreatedAt: fixedTime})
+	if err != ErrRoomNotFound {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListByRoom(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	query := regexp.QuoteMeta(`SELECT id, room_id, seq, user_id, username, content, created_at FROM messages WHERE room_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3`)
+
+	// Latest page, returned newest first by the database
+	rows := sqlmock.NewRows([]string{"id", "room_id", "seq", "user_id", "username", "content", "created_at"}).
+		AddRow(3, "room-1", 3, "user-123", "testuser", "third", fixedTime).
+		AddRow(2, "room-1", 2, nil, "deleted", "second", fixedTime)
+
+	mock.ExpectQuery(query).
+		WithArgs("room-1", int64(math.MaxInt64), 2).
+		WillReturnRows(rows)
+
+	msgs, err := store.ListByRoom(ctx, "room-1", 0, 2)
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].ID != 2 || msgs[1].ID != 3 {
+		t.Errorf("expected messages in chronological order, got %d, %d", msgs[0].ID, msgs[1].ID)
+	}
+	if msgs[0].UserID != "" {
+		t.Errorf("expected empty user id for deleted sender, got %s", msgs[0].UserID)
+	}
+
+	// Older page
+	mock.ExpectQuery(query).
+		WithArgs("room-1", int64(2), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "room_id", "seq", "user_id", "username", "content", "created_at"}).
+			AddRow(1, "room-1", 1, "user-123", "testuser", "first", fixedTime))
+
+	msgs, err = store.ListByRoom(ctx, "room-1", 2, 2)
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(msgs) != 1 || msgs[0].Content != "first" {
+		t.Errorf("unexpected page %+v", msgs)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListAfter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, room_id, seq, user_id, username, content, created_at FROM messages WHERE room_id = $1 AND seq > $2 ORDER BY seq LIMIT $3`)).
+		WithArgs("room-1", int64(1), 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "room_id", "seq", "user_id", "username", "content", "created_at"}).
+			AddRow(8, "room-1", 2, "user-123", "testuser", "second", fixedTime).
+			AddRow(9, "room-1", 3, "user-123", "testuser", "third", fixedTime))
+
+	msgs, err := store.ListAfter(ctx, "room-1", 1, 100)
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+	if len(msgs) != 2 || msgs[0].Seq != 2 || msgs[1].Seq != 3 {
+		t.Errorf("expected seqs 2 and 3 in order, got %+v", msgs)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateDirect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	msg := &DirectMessage{
+		SenderID:       "user-123",
+		RecipientID:    "user-456",
+		SenderUsername: "testuser",
+		Content:        "psst",
+		CreatedAt:      fixedTime,
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO direct_messages (sender_id, recipient_id, sender_username, content, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`)).
+		WithArgs(msg.SenderID, msg.RecipientID, msg.SenderUsername, msg.Content, msg.CreatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	err = store.CreateDirect(ctx, msg)
+	if err != nil {
+		t.Errorf("error was not expected while creating direct message: %s", err)
+	}
+	if msg.ID != 7 {
+		t.Errorf("expected id 7, got %d", msg.ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListDirect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"id", "sender_id", "recipient_id", "sender_username", "content", "created_at"}).
+		AddRow(9, "user-456", "user-123", "other", "hi back", fixedTime).
+		AddRow(7, "user-123", "user-456", "testuser", "psst", fixedTime)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, sender_id, recipient_id, sender_username, content, created_at FROM direct_messages WHERE ((sender_id = $1 AND recipient_id = $2) OR (sender_id = $2 AND recipient_id = $1)) AND id < $3 ORDER BY id DESC LIMIT $4`)).
+		WithArgs("user-123", "user-456", int64(math.MaxInt64), 10).
+		WillReturnRows(rows)
+
+	msgs, err := store.ListDirect(ctx, "user-123", "user-456", 0, 10)
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].ID != 7 || msgs[1].SenderID != "user-456" {
+		t.Errorf("unexpected page %+v, %+v", msgs[0], msgs[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
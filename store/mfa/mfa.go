@@ -0,0 +1,63 @@
+package mfa
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// TOTP is a user's authenticator app enrollment. It only protects logins once
+// confirmed.
+type TOTP struct {
+	UserID       string     `json:"user_id"`
+	Secret       string     `json:"-"`
+	LastUsedStep int64      `json:"-"` // Time step of the last accepted code
+	CreatedAt    time.Time  `json:"created_at"`
+	ConfirmedAt  *time.Time `json:"confirmed_at,omitempty"`
+}
+
+// Enabled reports whether the enrollment was confirmed.
+func (t *TOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+var (
+	ErrNotEnrolled          = errors.New("totp not enrolled")
+	ErrAlreadyEnabled       = errors.New("totp already enabled")
+	ErrCodeReused           = errors.New("totp code already used")
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+)
+
+// Store defines the interface for second factor persistence.
+type Store interface {
+	// GetTOTP returns the user's enrollment, confirmed or not.
+	GetTOTP(ctx context.Context, userID string) (*TOTP, error)
+
+	// BeginEnrollment stores a new unconfirmed secret for the user,
+	// replacing any earlier unconfirmed one. It fails with
+	// ErrAlreadyEnabled if the user already confirmed an enrollment.
+	BeginEnrollment(ctx context.Context, userID, secret string) error
+
+	// ConfirmEnrollment enables the pending enrollment, recording step as
+	// used, and replaces the user's recovery codes.
+	ConfirmEnrollment(ctx context.Context, userID string, step int64, recoveryCodes []string) error
+
+	// UseStep records that the code of the given time step was accepted. It
+	// fails with ErrCodeReused unless step is later than the last one used.
+	UseStep(ctx context.Context, userID string, step int64) error
+
+	// UseRecoveryCode consumes one of the user's recovery codes.
+	UseRecoveryCode(ctx context.Context, userID, code string) error
+
+	// Disable removes the user's enrollment and recovery codes.
+	Disable(ctx context.Context, userID string) error
+}
+
+// HashCode returns the representation of a recovery code stored at rest.
+// Recovery codes are random, so a plain SHA-256 suffices.
+func HashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,177 @@
+package mfa
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) GetTOTP(ctx context.Context, userID string) (*TOTP, error) {
+	query := `SELECT user_id, secret, last_used_step, created_at, confirmed_at FROM user_totp WHERE user_id = $1`
+
+	var t TOTP
+	var confirmedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.Secret,
+		&t.LastUsedStep,
+		&t.CreatedAt,
+		&confirmedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotEnrolled
+	} else if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		t.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return &t, nil
+}
+
+func (s *SQLStore) BeginEnrollment(ctx context.Context, userID, secret string) error {
+	// Only unconfirmed enrollments may be replaced; a confirmed one has to
+	// be disabled first.
+	query := `
+		INSERT INTO user_totp (user_id, secret, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			secret = EXCLUDED.secret,
+			created_at = EXCLUDED.created_at,
+			last_used_step = 0
+		WHERE user_totp.confirmed_at IS NULL
+	`
+
+	result, err := s.db.ExecContext(ctx, query, userID, secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAlreadyEnabled
+	}
+
+	return nil
+}
+
+func (s *SQLStore) ConfirmEnrollment(ctx context.Context, userID string, step int64, recoveryCodes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `
+		UPDATE user_totp SET confirmed_at = $1, last_used_step = $2
+		WHERE user_id = $3 AND confirmed_at IS NULL
+	`
+	result, err := tx.ExecContext(ctx, query, time.Now(), step, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotEnrolled
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) UseStep(ctx context.Context, userID string, step int64) error {
+	query := `UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1`
+
+	result, err := s.db.ExecContext(ctx, query, step, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrCodeReused
+	}
+
+	return nil
+}
+
+func (s *SQLStore) UseRecoveryCode(ctx context.Context, userID, code string) error {
+	query := `DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`
+
+	result, err := s.db.ExecContext(ctx, query, userID, HashCode(code))
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) Disable(ctx context.Context, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotEnrolled
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID string, codes []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		query := `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := tx.ExecContext(ctx, query, userID, HashCode(code)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package mfa
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestGetTOTP(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	query := `SELECT user_id, secret, last_used_step, created_at, confirmed_at FROM user_totp WHERE user_id = $1`
+
+	// Confirmed Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("user-123").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "last_used_step", "created_at", "confirmed_at"}).
+			AddRow("user-123", "JBSWY3DPEHPK3PXP", 42, now, now))
+
+	totp, err := store.GetTOTP(ctx, "user-123")
+	if err != nil {
+		t.Errorf("error was not expected while getting totp: %s", err)
+	} else if !totp.Enabled() || totp.LastUsedStep != 42 {
+		t.Errorf("unexpected enrollment %+v", totp)
+	}
+
+	// Not Enrolled Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("user-456").
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.GetTOTP(ctx, "user-456"); err != ErrNotEnrolled {
+		t.Errorf("expected ErrNotEnrolled, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBeginEnrollment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `INSERT INTO user_totp (user_id, secret, created_at) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET`
+
+	// Success Case
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs("user-123", "SECRET", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.BeginEnrollment(ctx, "user-123", "SECRET"); err != nil {
+		t.Errorf("error was not expected while beginning enrollment: %s", err)
+	}
+
+	// Already Enabled Case
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs("user-123", "OTHER", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.BeginEnrollment(ctx, "user-123", "OTHER"); err != ErrAlreadyEnabled {
+		t.Errorf("expected ErrAlreadyEnabled, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestConfirmEnrollment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE user_totp SET confirmed_at = $1, last_used_step = $2 WHERE user_id = $3 AND confirmed_at IS NULL`)).
+		WithArgs(sqlmock.AnyArg(), int64(100), "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM recovery_codes WHERE user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, code := range []string{"aaaa", "bbbb"} {
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`)).
+			WithArgs("user-123", HashCode(code)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	if err := store.ConfirmEnrollment(ctx, "user-123", 100, []string{"aaaa", "bbbb"}); err != nil {
+		t.Errorf("error was not expected while confirming enrollment: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUseStep(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1`
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(int64(101), "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs(int64(101), "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.UseStep(ctx, "user-123", 101); err != nil {
+		t.Errorf("error was not expected while using step: %s", err)
+	}
+	if err := store.UseStep(ctx, "user-123", 101); err != ErrCodeReused {
+		t.Errorf("expected ErrCodeReused, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`
+
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs("user-123", HashCode("aaaa")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(query)).
+		WithArgs("user-123", HashCode("aaaa")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.UseRecoveryCode(ctx, "user-123", "aaaa"); err != nil {
+		t.Errorf("error was not expected while using recovery code: %s", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "user-123", "aaaa"); err != ErrRecoveryCodeNotFound {
+		t.Errorf("expected ErrRecoveryCodeNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
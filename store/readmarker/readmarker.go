@@ -0,0 +1,37 @@
+package readmarker
+
+import (
+	"context"
+	"time"
+)
+
+// Marker records the last message of a room a user has read. It is shared by
+// all of the user's connections, unlike delivery cursors.
+type Marker struct {
+	UserID    string    `json:"user_id"`
+	RoomID    string    `json:"room_id"`
+	Seq       int64     `json:"seq"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Unread describes how far a user has read in one of their rooms. LastReadSeq
+// is zero if the user never marked the room read.
+type Unread struct {
+	RoomID      string `json:"room_id"`
+	LastReadSeq int64  `json:"last_read_seq"`
+	LastSeq     int64  `json:"last_seq"`
+	Count       int64  `json:"unread_count"`
+}
+
+// Store defines the interface for read marker persistence.
+type Store interface {
+	// Mark moves a user's marker in a room forward to m.Seq, capped at the
+	// last message of the room. It reports whether the marker moved, in
+	// which case m.Seq holds the stored sequence. Markers never move
+	// backwards, and nothing is stored for a room without messages.
+	Mark(ctx context.Context, m *Marker) (bool, error)
+
+	// Unread returns the read state of every room a user is a member of,
+	// ordered by room ID.
+	Unread(ctx context.Context, userID string) ([]*Unread, error)
+}
@@ -0,0 +1,72 @@
+package readmarker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Mark(ctx context.Context, m *Marker) (bool, error) {
+	// The WHERE of the update keeps markers from moving backwards; no row
+	// is returned then, nor when the room has no messages.
+	query := `
+		INSERT INTO read_markers (user_id, room_id, seq, updated_at)
+		SELECT $1, id, LEAST($3, last_seq), $4 FROM rooms WHERE id = $2 AND last_seq > 0
+		ON CONFLICT (user_id, room_id) DO UPDATE
+		SET seq = EXCLUDED.seq, updated_at = EXCLUDED.updated_at
+		WHERE read_markers.seq < EXCLUDED.seq
+		RETURNING seq
+	`
+
+	if m.UpdatedAt.IsZero() {
+		m.UpdatedAt = time.Now()
+	}
+
+	err := s.db.QueryRowContext(ctx, query, m.UserID, m.RoomID, m.Seq, m.UpdatedAt).Scan(&m.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLStore) Unread(ctx context.Context, userID string) ([]*Unread, error) {
+	query := `
+		SELECT r.id, COALESCE(m.seq, 0), r.last_seq
+		FROM room_members rm
+		JOIN rooms r ON r.id = rm.room_id
+		LEFT JOIN read_markers m ON m.user_id = rm.user_id AND m.room_id = rm.room_id
+		WHERE rm.user_id = $1
+		ORDER BY r.id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var unread []*Unread
+	for rows.Next() {
+		var u Unread
+		if err := rows.Scan(&u.RoomID, &u.LastReadSeq, &u.LastSeq); err != nil {
+			return nil, err
+		}
+		u.Count = max(u.LastSeq-u.LastReadSeq, 0)
+		unread = append(unread, &u)
+	}
+	return unread, rows.Err()
+}
@@ -0,0 +1,120 @@
+package readmarker
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const markQuery = `INSERT INTO read_markers (user_id, room_id, seq, updated_at) SELECT $1, id, LEAST($3, last_seq), $4 FROM rooms WHERE id = $2 AND last_seq > 0 ON CONFLICT (user_id, room_id) DO UPDATE SET seq = EXCLUDED.seq, updated_at = EXCLUDED.updated_at WHERE read_markers.seq < EXCLUDED.seq RETURNING seq`
+
+func TestMark(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := &Marker{UserID: "user-1", RoomID: "room-1", Seq: 99, UpdatedAt: fixedTime}
+
+	// The room only has 42 messages.
+	mock.ExpectQuery(regexp.QuoteMeta(markQuery)).
+		WithArgs("user-1", "room-1", int64(99), fixedTime).
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}).AddRow(42))
+
+	moved, err := store.Mark(ctx, m)
+	if err != nil {
+		t.Fatalf("error was not expected while marking: %s", err)
+	}
+	if !moved || m.Seq != 42 {
+		t.Errorf("expected marker moved to 42, got %v %d", moved, m.Seq)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMarkNotMoved(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := &Marker{UserID: "user-1", RoomID: "room-1", Seq: 7, UpdatedAt: fixedTime}
+
+	mock.ExpectQuery(regexp.QuoteMeta(markQuery)).
+		WithArgs("user-1", "room-1", int64(7), fixedTime).
+		WillReturnRows(sqlmock.NewRows([]string{"seq"}))
+
+	moved, err := store.Mark(ctx, m)
+	if err != nil {
+		t.Fatalf("error was not expected while marking: %s", err)
+	}
+	if moved {
+		t.Error("expected marker not to move")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUnread(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT r.id, COALESCE(m.seq, 0), r.last_seq FROM room_members rm JOIN rooms r ON r.id = rm.room_id LEFT JOIN read_markers m ON m.user_id = rm.user_id AND m.room_id = rm.room_id WHERE rm.user_id = $1 ORDER BY r.id`)).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "seq", "last_seq"}).
+			AddRow("room-1", 40, 42).
+			AddRow("room-2", 0, 5))
+
+	unread, err := store.Unread(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("error was not expected while listing unread: %s", err)
+	}
+	if len(unread) != 2 {
+		t.Fatalf("expected 2 rooms, got %d", len(unread))
+	}
+	if u := unread[0]; *u != (Unread{RoomID: "room-1", LastReadSeq: 40, LastSeq: 42, Count: 2}) {
+		t.Errorf("unexpected unread %+v", u)
+	}
+	if u := unread[1]; *u != (Unread{RoomID: "room-2", LastSeq: 5, Count: 5}) {
+		t.Errorf("unexpected unread %+v", u)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
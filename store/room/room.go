@@ -0,0 +1,52 @@
+package room
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Room represents a named chat room.
+type Room struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	ErrRoomNotFound      = errors.New("room not found")
+	ErrDuplicateRoomName = errors.New("room name already exists")
+	ErrNotMember         = errors.New("user is not a member of the room")
+)
+
+// Store defines the interface for room and room membership persistence.
+type Store interface {
+	// Create inserts a new room into the store.
+	Create(ctx context.Context, room *Room) error
+
+	// GetByID retrieves a room by its unique ID.
+	GetByID(ctx context.Context, id string) (*Room, error)
+
+	// GetByName retrieves a room by its name.
+	GetByName(ctx context.Context, name string) (*Room, error)
+
+	// List returns all rooms ordered by name.
+	List(ctx context.Context) ([]*Room, error)
+
+	// AddMember adds a user to a room. Adding an existing member is a no-op.
+	AddMember(ctx context.Context, roomID, userID string) error
+
+	// RemoveMember removes a user from a room.
+	RemoveMember(ctx context.Context, roomID, userID string) error
+
+	// ListMembers returns the IDs of all users in a room.
+	ListMembers(ctx context.Context, roomID string) ([]string, error)
+
+	// ListByUser returns the rooms a user is a member of, ordered by name.
+	ListByUser(ctx context.Context, userID string) ([]*Room, error)
+
+	// ListCoMembers returns the IDs of all users sharing at least one room
+	// with a user, including the user unless they are in no room.
+	ListCoMembers(ctx context.Context, userID string) ([]string, error)
+}
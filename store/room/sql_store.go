@@ -0,0 +1,197 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLStore implements Store using a database/sql connection.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a new SQLStore.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Create(ctx context.Context, room *Room) error {
+	// ON CONFLICT ... DO NOTHING returns no row when the name is taken, which
+	// lets us report duplicates without inspecting driver specific errors.
+	query := `
+		INSERT INTO rooms (name, created_by, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING id
+	`
+
+	if room.CreatedAt.IsZero() {
+		room.CreatedAt = time.Now()
+	}
+
+	err := s.db.QueryRowContext(ctx, query,
+		room.Name,
+		nullString(room.CreatedBy),
+		room.CreatedAt,
+	).Scan(&room.ID)
+
+	if err == sql.ErrNoRows {
+		return ErrDuplicateRoomName
+	}
+	return err
+}
+
+func (s *SQLStore) GetByID(ctx context.Context, id string) (*Room, error) {
+	query := `SELECT id, name, created_by, created_at FROM rooms WHERE id = $1`
+	return scanRoom(s.db.QueryRowContext(ctx, query, id))
+}
+
+func (s *SQLStore) GetByName(ctx context.Context, name string) (*Room, error) {
+	query := `SELECT id, name, created_by, created_at FROM rooms WHERE name = $1`
+	return scanRoom(s.db.QueryRowContext(ctx, query, name))
+}
+
+func (s *SQLStore) List(ctx context.Context) ([]*Room, error) {
+	query := `SELECT id, name, created_by, created_at FROM rooms ORDER BY name`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return scanRooms(rows)
+}
+
+func (s *SQLStore) AddMember(ctx context.Context, roomID, userID string) error {
+	query := `
+		INSERT INTO room_members (room_id, user_id, joined_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`
+
+	_, err := s.db.ExecContext(ctx, query, roomID, userID, time.Now())
+	return err
+}
+
+func (s *SQLStore) RemoveMember(ctx context.Context, roomID, userID string) error {
+	query := `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`
+
+	result, err := s.db.ExecContext(ctx, query, roomID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+func (s *SQLStore) ListMembers(ctx context.Context, roomID string) ([]string, error) {
+	query := `SELECT user_id FROM room_members WHERE room_id = $1 ORDER BY joined_at`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var members []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+func (s *SQLStore) ListByUser(ctx context.Context, userID string) ([]*Room, error) {
+	query := `
+		SELECT r.id, r.name, r.created_by, r.created_at
+		FROM rooms r
+		JOIN room_members m ON m.room_id = r.id
+		WHERE m.user_id = $1
+		ORDER BY r.name
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanRooms(rows)
+}
+
+func (s *SQLStore) ListCoMembers(ctx context.Context, userID string) ([]string, error) {
+	query := `
+		SELECT DISTINCT other.user_id
+		FROM room_members own
+		JOIN room_members other ON other.room_id = own.room_id
+		WHERE own.user_id = $1
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var members []string
+	for rows.Next() {
+		var memberID string
+		if err := rows.Scan(&memberID); err != nil {
+			return nil, err
+		}
+		members = append(members, memberID)
+	}
+	return members, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRoom(row rowScanner) (*Room, error) {
+	var room Room
+	var createdBy sql.NullString // Creator may have been deleted
+
+	err := row.Scan(
+		&room.ID,
+		&room.Name,
+		&createdBy,
+		&room.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	room.CreatedBy = createdBy.String
+	return &room, nil
+}
+
+func scanRooms(rows *sql.Rows) ([]*Room, error) {
+	defer func() { _ = rows.Close() }()
+
+	var rooms []*Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,278 @@
+package room
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCreate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := &Room{
+		Name:      "general",
+		CreatedBy: "user-123",
+		CreatedAt: fixedTime,
+	}
+
+	// Success Case
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO rooms (name, created_by, created_at) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING RETURNING id`)).
+		WithArgs(r.Name, r.CreatedBy, r.CreatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("room-1"))
+
+	err = store.Create(ctx, r)
+	if err != nil {
+		t.Errorf("error was not expected while creating room: %s", err)
+	}
+	if r.ID != "room-1" {
+		t.Errorf("expected id room-1, got %s", r.ID)
+	}
+
+	// Duplicate Case
+	dup := &Room{Name: "general", CreatedBy: "user-456", CreatedAt: fixedTime}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO rooms (name, created_by, created_at) VALUES ($1, $2, $3) ON CONFLICT (name) DO NOTHING RETURNING id`)).
+		WithArgs(dup.Name, dup.CreatedBy, dup.CreatedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	err = store.Create(ctx, dup)
+	if err != ErrDuplicateRoomName {
+		t.Errorf("expected ErrDuplicateRoomName, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetByID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Success Case (creator deleted)
+	rows := sqlmock.NewRows([]string{"id", "name", "created_by", "created_at"}).
+		AddRow("room-1", "general", nil, fixedTime)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, name, created_by, created_at FROM rooms WHERE id = $1`)).
+		WithArgs("room-1").
+		WillReturnRows(rows)
+
+	r, err := store.GetByID(ctx, "room-1")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if r == nil {
+		t.Errorf("expected room, got nil")
+	} else if r.Name != "general" || r.CreatedBy != "" {
+		t.Errorf("unexpected room %+v", r)
+	}
+
+	// Not Found Case
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, name, created_by, created_at FROM rooms WHERE id = $1`)).
+		WithArgs("unknown").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = store.GetByID(ctx, "unknown")
+	if err != ErrRoomNotFound {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetByName(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"id", "name", "created_by", "created_at"}).
+		AddRow("room-1", "general", "user-123", fixedTime)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, name, created_by, created_at FROM rooms WHERE name = $1`)).
+		WithArgs("general").
+		WillReturnRows(rows)
+
+	r, err := store.GetByName(ctx, "general")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if r == nil {
+		t.Errorf("expected room, got nil")
+	} else if r.ID != "room-1" || r.CreatedBy != "user-123" {
+		t.Errorf("unexpected room %+v", r)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListByUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := sqlmock.NewRows([]string{"id", "name", "created_by", "created_at"}).
+		AddRow("room-1", "general", "user-123", fixedTime).
+		AddRow("room-2", "random", "user-456", fixedTime)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT r.id, r.name, r.created_by, r.created_at FROM rooms r JOIN room_members m ON m.room_id = r.id WHERE m.user_id = $1 ORDER BY r.name`)).
+		WithArgs("user-123").
+		WillReturnRows(rows)
+
+	rooms, err := store.ListByUser(ctx, "user-123")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(rooms) != 2 {
+		t.Fatalf("expected 2 rooms, got %d", len(rooms))
+	}
+	if rooms[1].Name != "random" {
+		t.Errorf("expected second room random, got %s", rooms[1].Name)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListCoMembers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT other.user_id FROM room_members own JOIN room_members other ON other.room_id = own.room_id WHERE own.user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-123").AddRow("user-456"))
+
+	members, err := store.ListCoMembers(ctx, "user-123")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(members) != 2 || members[1] != "user-456" {
+		t.Errorf("expected user-123 and user-456, got %v", members)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	// Add
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO room_members (room_id, user_id, joined_at) VALUES ($1, $2, $3) ON CONFLICT (room_id, user_id) DO NOTHING`)).
+		WithArgs("room-1", "user-123", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	if err := store.AddMember(ctx, "room-1", "user-123"); err != nil {
+		t.Errorf("error was not expected while adding member: %s", err)
+	}
+
+	// List
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id FROM room_members WHERE room_id = $1 ORDER BY joined_at`)).
+		WithArgs("room-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-123"))
+
+	members, err := store.ListMembers(ctx, "room-1")
+	if err != nil {
+		t.Errorf("error was not expected while listing members: %s", err)
+	}
+	if len(members) != 1 || members[0] != "user-123" {
+		t.Errorf("unexpected members %v", members)
+	}
+
+	// Remove
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`)).
+		WithArgs("room-1", "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.RemoveMember(ctx, "room-1", "user-123"); err != nil {
+		t.Errorf("error was not expected while removing member: %s", err)
+	}
+
+	// Remove Not Member Case (0 rows affected)
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`)).
+		WithArgs("room-1", "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.RemoveMember(ctx, "room-1", "user-123"); err != ErrNotMember {
+		t.Errorf("expected ErrNotMember, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
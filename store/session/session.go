@@ -2,15 +2,61 @@ package session
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 )
 
 // Session represents a user authentication session.
+//
+// Only a hash of Token is persisted. Token is therefore set on sessions passed
+// to Create and returned by GetByToken, and empty everywhere else.
 type Session struct {
 	ID        string    `json:"id"`
 	UserID    string    `json:"user_id"`
-	Token     string    `json:"token"`
+	Token     string    `json:"-"`
+	FamilyID  string    `json:"family_id,omitempty"` // Refresh token family that issued the session, if any
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RefreshToken is a single-use credential that can be exchanged for a new
+// access session and a new refresh token of the same family. Like sessions,
+// only a hash of Token is persisted.
+type RefreshToken struct {
+	ID        string     `json:"id"`
+	FamilyID  string     `json:"family_id"`
+	UserID    string     `json:"user_id"`
+	Token     string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// Ticket is a short-lived, single-use credential for opening a websocket on
+// behalf of a session. Only a hash of Token is persisted.
+type Ticket struct {
+	Token     string    `json:"-"`
+	SessionID string    `json:"session_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// MFAChallenge is issued by a login whose password was correct when the user
+// still has to present a second factor. Only a hash of Token is persisted.
+type MFAChallenge struct {
+	Token     string    `json:"-"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PasswordReset lets whoever receives the reset email choose a new password.
+// Only a hash of Token is persisted.
+type PasswordReset struct {
+	Token     string    `json:"-"`
+	UserID    string    `json:"user_id"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -18,10 +64,110 @@ type Session struct {
 var (
 	ErrSessionNotFound = errors.New("session not found")
 	ErrSessionExpired  = errors.New("session expired")
+
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token already used")
+
+	ErrTicketNotFound = errors.New("ticket not found")
+	ErrTicketExpired  = errors.New("ticket expired")
+
+	ErrChallengeNotFound = errors.New("mfa challenge not found")
+	ErrChallengeExpired  = errors.New("mfa challenge expired")
+
+	ErrResetNotFound = errors.New("password reset not found")
+	ErrResetExpired  = errors.New("password reset expired")
+
+	// Returned when creating a credential for a user that does not exist,
+	// typically because it was deleted meanwhile.
+	ErrUserNotFound = errors.New("user not found")
+
+	// Returned when a new token hashes to one already stored.
+	ErrDuplicateToken = errors.New("token already exists")
 )
 
 // Store defines the interface for session persistence.
 type Store interface {
 	Create(ctx context.Context, session *Session) error
 	GetByToken(ctx context.Context, token string) (*Session, error)
+
+	// Delete removes a single session, logging it out.
+	Delete(ctx context.Context, id string) error
+
+	// ListByUser returns the unexpired sessions of a user, newest first.
+	ListByUser(ctx context.Context, userID string) ([]*Session, error)
+
+	// DeleteAllForUser removes every session and refresh token of a user.
+	DeleteAllForUser(ctx context.Context, userID string) error
+
+	// DeleteOthersForUser removes every session and refresh token of a user
+	// except keep and the rest of its refresh token family.
+	DeleteOthersForUser(ctx context.Context, userID string, keep *Session) error
+
+	// DeleteExpired removes up to limit sessions that expired before the
+	// given time and returns how many were removed.
+	DeleteExpired(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	// CreateRefreshToken inserts a refresh token and sets its ID. An empty
+	// FamilyID starts a new family and is filled in.
+	CreateRefreshToken(ctx context.Context, rt *RefreshToken) error
+
+	// RotateRefreshToken marks the refresh token identified by token as used
+	// and inserts next into the same family, filling in its ID, FamilyID and
+	// UserID. It returns the used token. If that token was already used it
+	// returns it together with ErrRefreshTokenReused so that the caller can
+	// revoke the family.
+	RotateRefreshToken(ctx context.Context, token string, next *RefreshToken) (*RefreshToken, error)
+
+	// RevokeFamily deletes every refresh token of a family and the sessions
+	// they issued.
+	RevokeFamily(ctx context.Context, familyID string) error
+
+	// DeleteExpiredRefreshTokens removes up to limit refresh tokens that
+	// expired before the given time and returns how many were removed.
+	DeleteExpiredRefreshTokens(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	// CreateTicket inserts a websocket ticket for an existing session.
+	CreateTicket(ctx context.Context, ticket *Ticket) error
+
+	// RedeemTicket deletes the ticket identified by token and returns the
+	// session it was minted for. A ticket can only be redeemed once.
+	RedeemTicket(ctx context.Context, token string) (*Session, error)
+
+	// DeleteExpiredTickets removes up to limit tickets that expired before
+	// the given time and returns how many were removed.
+	DeleteExpiredTickets(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	// CreateMFAChallenge inserts a challenge for completing a login.
+	CreateMFAChallenge(ctx context.Context, challenge *MFAChallenge) error
+
+	// GetMFAChallenge looks up an unexpired challenge by its token.
+	GetMFAChallenge(ctx context.Context, token string) (*MFAChallenge, error)
+
+	// DeleteMFAChallenge removes the challenge identified by token.
+	DeleteMFAChallenge(ctx context.Context, token string) error
+
+	// DeleteExpiredMFAChallenges removes up to limit challenges that expired
+	// before the given time and returns how many were removed.
+	DeleteExpiredMFAChallenges(ctx context.Context, before time.Time, limit int) (int64, error)
+
+	// CreatePasswordReset inserts a password reset for a user.
+	CreatePasswordReset(ctx context.Context, reset *PasswordReset) error
+
+	// RedeemPasswordReset deletes the reset identified by token, along with
+	// every other outstanding reset of its user, and returns it. A reset can
+	// only be redeemed once.
+	RedeemPasswordReset(ctx context.Context, token string) (*PasswordReset, error)
+
+	// DeleteExpiredPasswordResets removes up to limit resets that expired
+	// before the given time and returns how many were removed.
+	DeleteExpiredPasswordResets(ctx context.Context, before time.Time, limit int) (int64, error)
+}
+
+// HashToken returns the representation of a token stored at rest. Tokens are
+// long random strings, so a plain SHA-256 is enough to make a leaked hash
+// useless without slowing down lookups.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"time"
+
+	"github.com/nexus-im/nexus/store/internal/pgerr"
 )
 
 // SQLStore implements Store using a database/sql connection.
@@ -18,8 +20,8 @@ func NewSQLStore(db *sql.DB) *SQLStore {
 
 func (s *SQLStore) Create(ctx context.Context, sess *Session) error {
 	query := `
-		INSERT INTO sessions (user_id, token, created_at, expires_at)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO sessions (user_id, token_hash, family_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
 	`
 
 	if sess.CreatedAt.IsZero() {
@@ -28,24 +30,26 @@ func (s *SQLStore) Create(ctx context.Context, sess *Session) error {
 
 	_, err := s.db.ExecContext(ctx, query,
 		sess.UserID,
-		sess.Token,
+		HashToken(sess.Token),
+		nullString(sess.FamilyID),
 		sess.CreatedAt,
 		sess.ExpiresAt,
 	)
 
-	return err
+	return mapError(err)
 }
 
 func (s *SQLStore) GetByToken(ctx context.Context, token string) (*Session, error) {
-	query := `SELECT id, user_id, token, created_at, expires_at FROM sessions WHERE token = $1`
+	query := `SELECT id, user_id, family_id, created_at, expires_at FROM sessions WHERE token_hash = $1`
 
-	row := s.db.QueryRowContext(ctx, query, token)
+	row := s.db.QueryRowContext(ctx, query, HashToken(token))
 
-	var sess Session
+	sess := Session{Token: token}
+	var familyID sql.NullString
 	err := row.Scan(
 		&sess.ID,
 		&sess.UserID,
-		&sess.Token,
+		&familyID,
 		&sess.CreatedAt,
 		&sess.ExpiresAt,
 	)
@@ -55,6 +59,7 @@ func (s *SQLStore) GetByToken(ctx context.Context, token string) (*Session, erro
 	} else if err != nil {
 		return nil, err
 	}
+	sess.FamilyID = familyID.String
 
 	if time.Now().After(sess.ExpiresAt) {
 		return nil, ErrSessionExpired
@@ -62,3 +67,466 @@ func (s *SQLStore) GetByToken(ctx context.Context, token string) (*Session, erro
 
 	return &sess, nil
 }
+
+func (s *SQLStore) Delete(ctx context.Context, id string) error {
+	query := `DELETE FROM sessions WHERE id = $1`
+
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) ListByUser(ctx context.Context, userID string) ([]*Session, error) {
+	query := `
+		SELECT id, user_id, family_id, created_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > $2
+		ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var sessions []*Session
+	for rows.Next() {
+		var sess Session
+		var familyID sql.NullString
+		if err := rows.Scan(
+			&sess.ID,
+			&sess.UserID,
+			&familyID,
+			&sess.CreatedAt,
+			&sess.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sess.FamilyID = familyID.String
+		sessions = append(sessions, &sess)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLStore) DeleteAllForUser(ctx context.Context, userID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteOthersForUser(ctx context.Context, userID string, keep *Session) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	keepFamily := nullString(keep.FamilyID)
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE user_id = $1 AND family_id IS DISTINCT FROM $2::uuid
+	`, userID, keepFamily); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_id = $1 AND id <> $2 AND ($3::uuid IS NULL OR family_id IS DISTINCT FROM $3::uuid)
+	`, userID, keep.ID, keepFamily); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteExpired(ctx context.Context, before time.Time, limit int) (int64, error) {
+	// Delete in bounded batches so a large backlog never holds locks on the
+	// table for long.
+	query := `
+		DELETE FROM sessions
+		WHERE id IN (
+			SELECT id FROM sessions WHERE expires_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStore) CreateRefreshToken(ctx context.Context, rt *RefreshToken) error {
+	return createRefreshToken(ctx, s.db, rt)
+}
+
+func (s *SQLStore) RotateRefreshToken(ctx context.Context, token string, next *RefreshToken) (*RefreshToken, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Lock the row so two concurrent refreshes with the same token cannot
+	// both succeed.
+	query := `
+		SELECT id, family_id, user_id, created_at, expires_at, used_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`
+
+	current := RefreshToken{Token: token}
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, query, HashToken(token)).Scan(
+		&current.ID,
+		&current.FamilyID,
+		&current.UserID,
+		&current.CreatedAt,
+		&current.ExpiresAt,
+		&usedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		current.UsedAt = &usedAt.Time
+		return &current, ErrRefreshTokenReused
+	}
+	now := time.Now()
+	if now.After(current.ExpiresAt) {
+		return nil, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`, now, current.ID); err != nil {
+		return nil, err
+	}
+	current.UsedAt = &now
+
+	next.FamilyID = current.FamilyID
+	next.UserID = current.UserID
+	if err := createRefreshToken(ctx, tx, next); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &current, nil
+}
+
+func (s *SQLStore) RevokeFamily(ctx context.Context, familyID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE family_id = $1`, familyID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE family_id = $1`, familyID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteExpiredRefreshTokens(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM refresh_tokens
+		WHERE id IN (
+			SELECT id FROM refresh_tokens WHERE expires_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStore) CreateTicket(ctx context.Context, ticket *Ticket) error {
+	query := `
+		INSERT INTO ws_tickets (token_hash, session_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	if ticket.CreatedAt.IsZero() {
+		ticket.CreatedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, query,
+		HashToken(ticket.Token),
+		ticket.SessionID,
+		ticket.CreatedAt,
+		ticket.ExpiresAt,
+	)
+	return mapError(err)
+}
+
+func (s *SQLStore) RedeemTicket(ctx context.Context, token string) (*Session, error) {
+	// Deleting and reading in one statement makes redemption single use even
+	// when the same ticket is presented to several nodes at once.
+	query := `
+		WITH t AS (
+			DELETE FROM ws_tickets WHERE token_hash = $1
+			RETURNING session_id, expires_at
+		)
+		SELECT s.id, s.user_id, s.family_id, s.created_at, s.expires_at, t.expires_at
+		FROM t JOIN sessions s ON s.id = t.session_id
+	`
+
+	var sess Session
+	var familyID sql.NullString
+	var ticketExpiresAt time.Time
+	err := s.db.QueryRowContext(ctx, query, HashToken(token)).Scan(
+		&sess.ID,
+		&sess.UserID,
+		&familyID,
+		&sess.CreatedAt,
+		&sess.ExpiresAt,
+		&ticketExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrTicketNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	sess.FamilyID = familyID.String
+
+	now := time.Now()
+	if now.After(ticketExpiresAt) {
+		return nil, ErrTicketExpired
+	}
+	if now.After(sess.ExpiresAt) {
+		return nil, ErrSessionExpired
+	}
+
+	return &sess, nil
+}
+
+func (s *SQLStore) DeleteExpiredTickets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM ws_tickets
+		WHERE token_hash IN (
+			SELECT token_hash FROM ws_tickets WHERE expires_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStore) CreateMFAChallenge(ctx context.Context, challenge *MFAChallenge) error {
+	query := `
+		INSERT INTO mfa_challenges (token_hash, user_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	if challenge.CreatedAt.IsZero() {
+		challenge.CreatedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, query,
+		HashToken(challenge.Token),
+		challenge.UserID,
+		challenge.CreatedAt,
+		challenge.ExpiresAt,
+	)
+	return mapError(err)
+}
+
+func (s *SQLStore) GetMFAChallenge(ctx context.Context, token string) (*MFAChallenge, error) {
+	query := `SELECT user_id, created_at, expires_at FROM mfa_challenges WHERE token_hash = $1`
+
+	challenge := MFAChallenge{Token: token}
+	err := s.db.QueryRowContext(ctx, query, HashToken(token)).Scan(
+		&challenge.UserID,
+		&challenge.CreatedAt,
+		&challenge.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrChallengeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, ErrChallengeExpired
+	}
+
+	return &challenge, nil
+}
+
+func (s *SQLStore) DeleteMFAChallenge(ctx context.Context, token string) error {
+	query := `DELETE FROM mfa_challenges WHERE token_hash = $1`
+
+	result, err := s.db.ExecContext(ctx, query, HashToken(token))
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrChallengeNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) DeleteExpiredMFAChallenges(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM mfa_challenges
+		WHERE token_hash IN (
+			SELECT token_hash FROM mfa_challenges WHERE expires_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLStore) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	query := `
+		INSERT INTO password_resets (token_hash, user_id, created_at, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	if reset.CreatedAt.IsZero() {
+		reset.CreatedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, query,
+		HashToken(reset.Token),
+		reset.UserID,
+		reset.CreatedAt,
+		reset.ExpiresAt,
+	)
+	return mapError(err)
+}
+
+func (s *SQLStore) RedeemPasswordReset(ctx context.Context, token string) (*PasswordReset, error) {
+	// Like tickets, delete and read in one statement so a reset link works
+	// once even if it is opened twice at the same time.
+	query := `
+		WITH r AS (
+			DELETE FROM password_resets WHERE token_hash = $1
+			RETURNING user_id, created_at, expires_at
+		), others AS (
+			DELETE FROM password_resets
+			WHERE user_id IN (SELECT user_id FROM r) AND token_hash <> $1
+		)
+		SELECT user_id, created_at, expires_at FROM r
+	`
+
+	reset := PasswordReset{Token: token}
+	err := s.db.QueryRowContext(ctx, query, HashToken(token)).Scan(
+		&reset.UserID,
+		&reset.CreatedAt,
+		&reset.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrResetNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(reset.ExpiresAt) {
+		return nil, ErrResetExpired
+	}
+
+	return &reset, nil
+}
+
+func (s *SQLStore) DeleteExpiredPasswordResets(ctx context.Context, before time.Time, limit int) (int64, error) {
+	query := `
+		DELETE FROM password_resets
+		WHERE token_hash IN (
+			SELECT token_hash FROM password_resets WHERE expires_at < $1 LIMIT $2
+		)
+	`
+
+	result, err := s.db.ExecContext(ctx, query, before, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func createRefreshToken(ctx context.Context, q queryer, rt *RefreshToken) error {
+	query := `
+		INSERT INTO refresh_tokens (family_id, user_id, token_hash, created_at, expires_at)
+		VALUES (COALESCE($1::uuid, gen_random_uuid()), $2, $3, $4, $5)
+		RETURNING id, family_id
+	`
+
+	if rt.CreatedAt.IsZero() {
+		rt.CreatedAt = time.Now()
+	}
+
+	err := q.QueryRowContext(ctx, query,
+		nullString(rt.FamilyID),
+		rt.UserID,
+		HashToken(rt.Token),
+		rt.CreatedAt,
+		rt.ExpiresAt,
+	).Scan(&rt.ID, &rt.FamilyID)
+	return mapError(err)
+}
+
+// mapError translates constraint violations on insert. Tickets refer to a
+// session, every other credential to a user; the only unique columns are
+// token hashes.
+func mapError(err error) error {
+	return pgerr.Map(err,
+		pgerr.ForeignKey("ws_tickets_session_id_fkey", ErrSessionNotFound),
+		pgerr.ForeignKey("", ErrUserNotFound),
+		pgerr.Unique("", ErrDuplicateToken),
+	)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
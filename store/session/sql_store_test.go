@@ -2,11 +2,14 @@ package session
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 )
 
 func TestCreate(t *testing.T) {
@@ -31,8 +34,8 @@ func TestCreate(t *testing.T) {
 		ExpiresAt: fixedTime.Add(time.Hour),
 	}
 
-	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (user_id, token, created_at, expires_at) VALUES ($1, $2, $3, $4)`)).
-		WithArgs(sess.UserID, sess.Token, sess.CreatedAt, sess.ExpiresAt).
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (user_id, token_hash, family_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`)).
+		WithArgs(sess.UserID, HashToken(sess.Token), nil, sess.CreatedAt, sess.ExpiresAt).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err = store.Create(ctx, sess)
@@ -45,6 +48,48 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateConstraintViolations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO sessions (user_id, token_hash, family_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`)).
+		WillReturnError(&pq.Error{Code: "23503", Constraint: "sessions_user_id_fkey"})
+	err = store.Create(ctx, &Session{UserID: "deleted", Token: "token-abc", CreatedAt: fixedTime, ExpiresAt: fixedTime.Add(time.Hour)})
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO ws_tickets (token_hash, session_id, created_at, expires_at) VALUES ($1, $2, $3, $4)`)).
+		WillReturnError(&pq.Error{Code: "23503", Constraint: "ws_tickets_session_id_fkey"})
+	err = store.CreateTicket(ctx, &Ticket{Token: "ticket", SessionID: "revoked", CreatedAt: fixedTime, ExpiresAt: fixedTime.Add(time.Minute)})
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)`)).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "password_resets_pkey"})
+	err = store.CreatePasswordReset(ctx, &PasswordReset{Token: "reset", UserID: "user-123", CreatedAt: fixedTime, ExpiresAt: fixedTime.Add(time.Hour)})
+	if !errors.Is(err, ErrDuplicateToken) {
+		t.Errorf("expected ErrDuplicateToken, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestGetByToken(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -62,11 +107,11 @@ func TestGetByToken(t *testing.T) {
 	token := "token-abc"
 	now := time.Now()
 
-	rows := sqlmock.NewRows([]string{"id", "user_id", "token", "created_at", "expires_at"}).
-		AddRow("session-1", "user-123", token, now, now.Add(time.Hour))
+	rows := sqlmock.NewRows([]string{"id", "user_id", "family_id", "created_at", "expires_at"}).
+		AddRow("session-1", "user-123", "family-1", now, now.Add(time.Hour))
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, token, created_at, expires_at FROM sessions WHERE token = $1`)).
-		WithArgs(token).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, family_id, created_at, expires_at FROM sessions WHERE token_hash = $1`)).
+		WithArgs(HashToken(token)).
 		WillReturnRows(rows)
 
 	sess, err := store.GetByToken(ctx, token)
@@ -77,6 +122,8 @@ func TestGetByToken(t *testing.T) {
 		t.Errorf("expected session, got nil")
 	} else if sess.Token != token {
 		t.Errorf("expected token %s, got %s", token, sess.Token)
+	} else if sess.FamilyID != "family-1" {
+		t.Errorf("expected family family-1, got %s", sess.FamilyID)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -101,11 +148,11 @@ func TestGetByTokenExpired(t *testing.T) {
 	token := "token-expired"
 	now := time.Now()
 
-	rows := sqlmock.NewRows([]string{"id", "user_id", "token", "created_at", "expires_at"}).
-		AddRow("session-2", "user-123", token, now, now.Add(-time.Hour))
+	rows := sqlmock.NewRows([]string{"id", "user_id", "family_id", "created_at", "expires_at"}).
+		AddRow("session-2", "user-123", nil, now, now.Add(-time.Hour))
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, token, created_at, expires_at FROM sessions WHERE token = $1`)).
-		WithArgs(token).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, family_id, created_at, expires_at FROM sessions WHERE token_hash = $1`)).
+		WithArgs(HashToken(token)).
 		WillReturnRows(rows)
 
 	_, err = store.GetByToken(ctx, token)
@@ -117,3 +164,492 @@ func TestGetByTokenExpired(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	// Success Case
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE id = $1`)).
+		WithArgs("session-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.Delete(ctx, "session-1"); err != nil {
+		t.Errorf("error was not expected while deleting session: %s", err)
+	}
+
+	// Not Found Case (0 rows affected)
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE id = $1`)).
+		WithArgs("unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.Delete(ctx, "unknown"); err != ErrSessionNotFound {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListByUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "user_id", "family_id", "created_at", "expires_at"}).
+		AddRow("session-2", "user-123", "family-1", now, now.Add(time.Hour)).
+		AddRow("session-1", "user-123", nil, now.Add(-time.Hour), now.Add(time.Hour))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, user_id, family_id, created_at, expires_at FROM sessions WHERE user_id = $1 AND expires_at > $2 ORDER BY created_at DESC`)).
+		WithArgs("user-123", sqlmock.AnyArg()).
+		WillReturnRows(rows)
+
+	sessions, err := store.ListByUser(ctx, "user-123")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	if sessions[0].ID != "session-2" {
+		t.Errorf("expected newest session first, got %s", sessions[0].ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteAllForUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM refresh_tokens WHERE user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	if err := store.DeleteAllForUser(ctx, "user-123"); err != nil {
+		t.Errorf("error was not expected while deleting sessions: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteOthersForUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	keep := &Session{ID: "session-1", UserID: "user-123", FamilyID: "family-1"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM refresh_tokens WHERE user_id = $1 AND family_id IS DISTINCT FROM $2::uuid`)).
+		WithArgs("user-123", "family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE user_id = $1 AND id <> $2 AND ($3::uuid IS NULL OR family_id IS DISTINCT FROM $3::uuid)`)).
+		WithArgs("user-123", "session-1", "family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := store.DeleteOthersForUser(ctx, "user-123", keep); err != nil {
+		t.Errorf("error was not expected while deleting sessions: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	cutoff := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE id IN ( SELECT id FROM sessions WHERE expires_at < $1 LIMIT $2 )`)).
+		WithArgs(cutoff, 500).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+
+	n, err := store.DeleteExpired(ctx, cutoff, 500)
+	if err != nil {
+		t.Errorf("error was not expected while deleting expired sessions: %s", err)
+	}
+	if n != 42 {
+		t.Errorf("expected 42 rows deleted, got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	// Must match the migration's encode(sha256(convert_to(token, 'UTF8')), 'hex')
+	// so that converted sessions stay valid.
+	want := "096157b339cf419dbc0c8def49fc2be924dc130fbacdfa7b879bee0a3078cec4"
+	if got := HashToken("token-abc"); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+const insertRefreshTokenQuery = `INSERT INTO refresh_tokens (family_id, user_id, token_hash, created_at, expires_at) VALUES (COALESCE($1::uuid, gen_random_uuid()), $2, $3, $4, $5) RETURNING id, family_id`
+
+const selectRefreshTokenQuery = `SELECT id, family_id, user_id, created_at, expires_at, used_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`
+
+func TestCreateRefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	rt := &RefreshToken{
+		UserID:    "user-123",
+		Token:     "refresh-abc",
+		CreatedAt: fixedTime,
+		ExpiresAt: fixedTime.Add(24 * time.Hour),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(insertRefreshTokenQuery)).
+		WithArgs(nil, rt.UserID, HashToken(rt.Token), rt.CreatedAt, rt.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id"}).AddRow("refresh-1", "family-1"))
+
+	if err := store.CreateRefreshToken(ctx, rt); err != nil {
+		t.Errorf("error was not expected while creating refresh token: %s", err)
+	}
+	if rt.ID != "refresh-1" || rt.FamilyID != "family-1" {
+		t.Errorf("expected id and new family to be set, got %+v", rt)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	columns := []string{"id", "family_id", "user_id", "created_at", "expires_at", "used_at"}
+
+	// Success Case
+	next := &RefreshToken{Token: "refresh-def", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectRefreshTokenQuery)).
+		WithArgs(HashToken("refresh-abc")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("refresh-1", "family-1", "user-123", now, now.Add(time.Hour), nil))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`)).
+		WithArgs(sqlmock.AnyArg(), "refresh-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(insertRefreshTokenQuery)).
+		WithArgs("family-1", "user-123", HashToken("refresh-def"), next.CreatedAt, next.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "family_id"}).AddRow("refresh-2", "family-1"))
+	mock.ExpectCommit()
+
+	used, err := store.RotateRefreshToken(ctx, "refresh-abc", next)
+	if err != nil {
+		t.Errorf("error was not expected while rotating refresh token: %s", err)
+	}
+	if used == nil || used.ID != "refresh-1" || used.UsedAt == nil {
+		t.Errorf("expected used token to be returned, got %+v", used)
+	}
+	if next.ID != "refresh-2" || next.FamilyID != "family-1" || next.UserID != "user-123" {
+		t.Errorf("expected next token to join the family, got %+v", next)
+	}
+
+	// Reuse Case
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectRefreshTokenQuery)).
+		WithArgs(HashToken("refresh-abc")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("refresh-1", "family-1", "user-123", now, now.Add(time.Hour), now))
+	mock.ExpectRollback()
+
+	used, err = store.RotateRefreshToken(ctx, "refresh-abc", &RefreshToken{Token: "refresh-ghi"})
+	if err != ErrRefreshTokenReused {
+		t.Errorf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if used == nil || used.FamilyID != "family-1" {
+		t.Errorf("expected reused token to identify its family, got %+v", used)
+	}
+
+	// Expired Case
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectRefreshTokenQuery)).
+		WithArgs(HashToken("refresh-old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("refresh-0", "family-0", "user-123", now, now.Add(-time.Hour), nil))
+	mock.ExpectRollback()
+
+	if _, err := store.RotateRefreshToken(ctx, "refresh-old", &RefreshToken{Token: "refresh-jkl"}); err != ErrRefreshTokenExpired {
+		t.Errorf("expected ErrRefreshTokenExpired, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRevokeFamily(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM refresh_tokens WHERE family_id = $1`)).
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM sessions WHERE family_id = $1`)).
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := store.RevokeFamily(ctx, "family-1"); err != nil {
+		t.Errorf("error was not expected while revoking family: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedeemTicket(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	query := `WITH t AS ( DELETE FROM ws_tickets WHERE token_hash = $1 RETURNING session_id, expires_at ) SELECT s.id, s.user_id, s.family_id, s.created_at, s.expires_at, t.expires_at FROM t JOIN sessions s ON s.id = t.session_id`
+	columns := []string{"id", "user_id", "family_id", "created_at", "expires_at", "expires_at"}
+
+	// Success Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("ticket-abc")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("session-1", "user-123", nil, now, now.Add(time.Hour), now.Add(time.Minute)))
+
+	sess, err := store.RedeemTicket(ctx, "ticket-abc")
+	if err != nil {
+		t.Errorf("error was not expected while redeeming ticket: %s", err)
+	} else if sess.ID != "session-1" || sess.UserID != "user-123" {
+		t.Errorf("unexpected session %+v", sess)
+	}
+
+	// Already Redeemed Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("ticket-abc")).
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.RedeemTicket(ctx, "ticket-abc"); err != ErrTicketNotFound {
+		t.Errorf("expected ErrTicketNotFound, got %v", err)
+	}
+
+	// Expired Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("ticket-old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("session-1", "user-123", nil, now, now.Add(time.Hour), now.Add(-time.Second)))
+
+	if _, err := store.RedeemTicket(ctx, "ticket-old"); err != ErrTicketExpired {
+		t.Errorf("expected ErrTicketExpired, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMFAChallenge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	challenge := &MFAChallenge{Token: "challenge-abc", UserID: "user-123", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO mfa_challenges (token_hash, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)`)).
+		WithArgs(HashToken("challenge-abc"), "user-123", challenge.CreatedAt, challenge.ExpiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, created_at, expires_at FROM mfa_challenges WHERE token_hash = $1`)).
+		WithArgs(HashToken("challenge-abc")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "created_at", "expires_at"}).AddRow("user-123", now, now.Add(time.Minute)))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM mfa_challenges WHERE token_hash = $1`)).
+		WithArgs(HashToken("challenge-abc")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT user_id, created_at, expires_at FROM mfa_challenges WHERE token_hash = $1`)).
+		WithArgs(HashToken("challenge-abc")).
+		WillReturnError(sql.ErrNoRows)
+
+	if err := store.CreateMFAChallenge(ctx, challenge); err != nil {
+		t.Errorf("error was not expected while creating challenge: %s", err)
+	}
+	got, err := store.GetMFAChallenge(ctx, "challenge-abc")
+	if err != nil {
+		t.Errorf("error was not expected while getting challenge: %s", err)
+	} else if got.UserID != "user-123" {
+		t.Errorf("expected user-123, got %s", got.UserID)
+	}
+	if err := store.DeleteMFAChallenge(ctx, "challenge-abc"); err != nil {
+		t.Errorf("error was not expected while deleting challenge: %s", err)
+	}
+	if _, err := store.GetMFAChallenge(ctx, "challenge-abc"); err != ErrChallengeNotFound {
+		t.Errorf("expected ErrChallengeNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedeemPasswordReset(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	now := time.Now()
+	query := `WITH r AS ( DELETE FROM password_resets WHERE token_hash = $1 RETURNING user_id, created_at, expires_at ), others AS ( DELETE FROM password_resets WHERE user_id IN (SELECT user_id FROM r) AND token_hash <> $1 ) SELECT user_id, created_at, expires_at FROM r`
+	columns := []string{"user_id", "created_at", "expires_at"}
+
+	// Success Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("reset-abc")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-123", now, now.Add(time.Hour)))
+
+	reset, err := store.RedeemPasswordReset(ctx, "reset-abc")
+	if err != nil {
+		t.Errorf("error was not expected while redeeming reset: %s", err)
+	} else if reset.UserID != "user-123" {
+		t.Errorf("unexpected reset %+v", reset)
+	}
+
+	// Already Redeemed Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("reset-abc")).
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.RedeemPasswordReset(ctx, "reset-abc"); err != ErrResetNotFound {
+		t.Errorf("expected ErrResetNotFound, got %v", err)
+	}
+
+	// Expired Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs(HashToken("reset-old")).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-123", now.Add(-2*time.Hour), now.Add(-time.Hour)))
+
+	if _, err := store.RedeemPasswordReset(ctx, "reset-old"); err != ErrResetExpired {
+		t.Errorf("expected ErrResetExpired, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
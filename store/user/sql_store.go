@@ -3,7 +3,11 @@ package user
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/nexus-im/nexus/store/internal/pgerr"
 )
 
 // SQLStore implements Store using a database/sql connection.
@@ -18,8 +22,8 @@ func NewSQLStore(db *sql.DB) *SQLStore {
 
 func (s *SQLStore) Create(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (username, password_hash, created_at, last_seen)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO users (username, password_hash, email, is_bot, owner_id, created_at, last_seen)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id
 	`
 	// Handle databases that might use ? instead of $1 (like SQLite) by default?
@@ -34,61 +38,216 @@ func (s *SQLStore) Create(ctx context.Context, user *User) error {
 	err := s.db.QueryRowContext(ctx, query,
 		user.Username,
 		user.PasswordHash,
+		nullString(user.Email),
+		user.IsBot,
+		nullString(user.OwnerID),
 		user.CreatedAt,
 		user.LastSeen,
 	).Scan(&user.ID)
 
 	if err != nil {
-		// In a real app, we'd check for unique constraint violation here
-		return err
+		return mapError(err)
 	}
 
 	return nil
 }
 
 func (s *SQLStore) GetByID(ctx context.Context, id string) (*User, error) {
-	query := `SELECT id, username, password_hash, created_at, last_seen FROM users WHERE id = $1`
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return scanUser(s.db.QueryRowContext(ctx, query, id))
+}
 
-	row := s.db.QueryRowContext(ctx, query, id)
+func (s *SQLStore) GetByUsername(ctx context.Context, username string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(username) = lower($1)`
+	return scanUser(s.db.QueryRowContext(ctx, query, username))
+}
 
-	var user User
-	var lastSeen sql.NullTime // Handle nullable LastSeen
+func (s *SQLStore) GetByEmail(ctx context.Context, address string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(email) = lower($1)`
+	return scanUser(s.db.QueryRowContext(ctx, query, address))
+}
 
-	err := row.Scan(
-		&user.ID,
-		&user.Username,
-		&user.PasswordHash,
-		&user.CreatedAt,
-		&lastSeen,
-	)
+func (s *SQLStore) UpdateLastSeen(ctx context.Context, id string, lastSeen time.Time) error {
+	query := `UPDATE users SET last_seen = $1 WHERE id = $2`
+
+	result, err := s.db.ExecContext(ctx, query, lastSeen, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2`
+
+	result, err := s.db.ExecContext(ctx, query, passwordHash, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLStore) UpdateProfile(ctx context.Context, id string, update ProfileUpdate) (*User, error) {
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if update.DisplayName != nil {
+		set("display_name", nullString(*update.DisplayName))
+	}
+	if update.Bio != nil {
+		set("bio", nullString(*update.Bio))
+	}
+	if update.AvatarURL != nil {
+		set("avatar_url", nullString(*update.AvatarURL))
+	}
+	if update.SetStatus {
+		var status Status
+		if update.Status != nil {
+			status = *update.Status
+		}
+		set("status_text", nullString(status.Text))
+		set("status_emoji", nullString(status.Emoji))
+		set("status_expires_at", status.ExpiresAt)
+	}
+	if len(sets) == 0 {
+		return s.GetByID(ctx, id)
+	}
+
+	args = append(args, id)
+	query := `UPDATE users SET ` + strings.Join(sets, ", ") + fmt.Sprintf(` WHERE id = $%d RETURNING `, len(args)) + userColumns
+	return scanUser(s.db.QueryRowContext(ctx, query, args...))
+}
+
+func (s *SQLStore) SetAvatar(ctx context.Context, avatar *Avatar) error {
+	query := `
+		INSERT INTO user_avatars (user_id, content_type, data, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET content_type = EXCLUDED.content_type, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at
+	`
+
+	if avatar.UpdatedAt.IsZero() {
+		avatar.UpdatedAt = time.Now()
+	}
+
+	_, err := s.db.ExecContext(ctx, query, avatar.UserID, avatar.ContentType, avatar.Data, avatar.UpdatedAt)
+	return pgerr.Map(err, pgerr.ForeignKey("", ErrUserNotFound))
+}
+
+func (s *SQLStore) GetAvatar(ctx context.Context, userID string) (*Avatar, error) {
+	query := `SELECT content_type, data, updated_at FROM user_avatars WHERE user_id = $1`
 
+	avatar := Avatar{UserID: userID}
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&avatar.ContentType, &avatar.Data, &avatar.UpdatedAt)
 	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
+		return nil, ErrAvatarNotFound
 	} else if err != nil {
 		return nil, err
 	}
+	return &avatar, nil
+}
 
-	if lastSeen.Valid {
-		user.LastSeen = lastSeen.Time
+func (s *SQLStore) DeleteAvatar(ctx context.Context, userID string) error {
+	query := `DELETE FROM user_avatars WHERE user_id = $1`
+
+	_, err := s.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (s *SQLStore) GetByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)`
+	return scanUser(s.db.QueryRowContext(ctx, query, provider, subject))
+}
+
+func (s *SQLStore) CreateWithIdentity(ctx context.Context, user *User, provider, subject string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	return &user, nil
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (username, password_hash, email, is_bot, owner_id, created_at, last_seen)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`,
+		user.Username,
+		user.PasswordHash,
+		nullString(user.Email),
+		user.IsBot,
+		nullString(user.OwnerID),
+		user.CreatedAt,
+		user.LastSeen,
+	).Scan(&user.ID)
+	if err != nil {
+		return mapError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (provider, subject, user_id, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, provider, subject, user.ID, user.CreatedAt)
+	if err != nil {
+		return mapError(err)
+	}
+
+	return tx.Commit()
 }
 
-func (s *SQLStore) GetByUsername(ctx context.Context, username string) (*User, error) {
-	query := `SELECT id, username, password_hash, created_at, last_seen FROM users WHERE username = $1`
+// userColumns are the columns scanUser reads, in order.
+const userColumns = `id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at`
 
-	row := s.db.QueryRowContext(ctx, query, username)
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+func scanUser(row rowScanner) (*User, error) {
 	var user User
-	var lastSeen sql.NullTime
+	var email, ownerID sql.NullString
+	var lastSeen sql.NullTime // Handle nullable LastSeen
+	var displayName, bio, avatarURL, statusText, statusEmoji sql.NullString
+	var statusExpiresAt sql.NullTime
 
 	err := row.Scan(
 		&user.ID,
 		&user.Username,
 		&user.PasswordHash,
+		&email,
+		&user.IsBot,
+		&ownerID,
 		&user.CreatedAt,
 		&lastSeen,
+		&displayName,
+		&bio,
+		&avatarURL,
+		&statusText,
+		&statusEmoji,
+		&statusExpiresAt,
 	)
 
 	if err == sql.ErrNoRows {
@@ -97,28 +256,37 @@ func (s *SQLStore) GetByUsername(ctx context.Context, username string) (*User, e
 		return nil, err
 	}
 
+	user.Email = email.String
+	user.OwnerID = ownerID.String
 	if lastSeen.Valid {
 		user.LastSeen = lastSeen.Time
 	}
 
+	user.DisplayName = displayName.String
+	user.Bio = bio.String
+	user.AvatarURL = avatarURL.String
+	if statusText.Valid || statusEmoji.Valid {
+		user.Status = &Status{Text: statusText.String, Emoji: statusEmoji.String}
+		if statusExpiresAt.Valid {
+			user.Status.ExpiresAt = &statusExpiresAt.Time
+		}
+	}
+
 	return &user, nil
 }
 
-func (s *SQLStore) UpdateLastSeen(ctx context.Context, id string, lastSeen time.Time) error {
-	query := `UPDATE users SET last_seen = $1 WHERE id = $2`
-
-	result, err := s.db.ExecContext(ctx, query, lastSeen, id)
-	if err != nil {
-		return err
-	}
-
-	rows, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if rows == 0 {
-		return ErrUserNotFound
-	}
+// mapError translates constraint violations into the package's errors. Any
+// other unique violation is on the username, through the users_username_key
+// constraint or the case-insensitive idx_users_username_lower index.
+func mapError(err error) error {
+	return pgerr.Map(err,
+		pgerr.Unique("idx_users_email_lower", ErrDuplicateEmail),
+		pgerr.Unique("user_identities_pkey", ErrDuplicateIdentity),
+		pgerr.Unique("", ErrDuplicateUsername),
+		pgerr.ForeignKey("users_owner_id_fkey", ErrOwnerNotFound),
+	)
+}
 
-	return nil
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
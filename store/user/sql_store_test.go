@@ -3,11 +3,13 @@ package user
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 )
 
 func TestCreate(t *testing.T) {
@@ -34,8 +36,8 @@ func TestCreate(t *testing.T) {
 	}
 
 	// Expectation
-	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, password_hash, created_at, last_seen) VALUES ($1, $2, $3, $4) RETURNING id`)).
-		WithArgs(u.Username, u.PasswordHash, u.CreatedAt, u.LastSeen).
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, password_hash, email, is_bot, owner_id, created_at, last_seen) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`)).
+		WithArgs(u.Username, u.PasswordHash, nil, false, nil, u.CreatedAt, u.LastSeen).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(u.ID))
 
 	err = store.Create(ctx, u)
@@ -48,6 +50,45 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateConstraintViolations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		pqErr *pq.Error
+		want  error
+	}{
+		{&pq.Error{Code: "23505", Constraint: "users_username_key"}, ErrDuplicateUsername},
+		{&pq.Error{Code: "23505", Constraint: "idx_users_username_lower"}, ErrDuplicateUsername},
+		{&pq.Error{Code: "23505", Constraint: "idx_users_email_lower"}, ErrDuplicateEmail},
+		{&pq.Error{Code: "23503", Constraint: "users_owner_id_fkey"}, ErrOwnerNotFound},
+	}
+	for _, tt := range tests {
+		u := &User{Username: "testuser", PasswordHash: "hashedsecret", CreatedAt: fixedTime, LastSeen: fixedTime}
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, password_hash, email, is_bot, owner_id, created_at, last_seen) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`)).
+			WillReturnError(tt.pqErr)
+
+		if err := store.Create(ctx, u); !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.pqErr.Constraint, tt.want, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestGetByID(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -66,10 +107,10 @@ func TestGetByID(t *testing.T) {
 	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
 
 	// Success Case
-	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "created_at", "last_seen"}).
-		AddRow(userID, "testuser", "hashedsecret", fixedTime, fixedTime)
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}).
+		AddRow(userID, "testuser", "hashedsecret", nil, false, nil, fixedTime, fixedTime, nil, nil, nil, nil, nil, nil)
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, created_at, last_seen FROM users WHERE id = $1`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE id = $1`)).
 		WithArgs(userID).
 		WillReturnRows(rows)
 
@@ -83,8 +124,21 @@ func TestGetByID(t *testing.T) {
 		t.Errorf("expected id %s, got %s", userID, u.ID)
 	}
 
+	// Bot Case
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE id = $1`)).
+		WithArgs("bot-123").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}).
+			AddRow("bot-123", "deploybot", "", nil, true, userID, fixedTime, nil, nil, nil, nil, nil, nil, nil))
+
+	bot, err := store.GetByID(ctx, "bot-123")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	} else if !bot.IsBot || bot.OwnerID != userID {
+		t.Errorf("expected bot owned by %s, got %+v", userID, bot)
+	}
+
 	// Not Found Case
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, created_at, last_seen FROM users WHERE id = $1`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE id = $1`)).
 		WithArgs("unknown").
 		WillReturnError(sql.ErrNoRows)
 
@@ -116,10 +170,10 @@ func TestGetByUsername(t *testing.T) {
 	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
 
 	// Success Case
-	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "created_at", "last_seen"}).
-		AddRow("user-123", username, "hashedsecret", fixedTime, fixedTime)
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}).
+		AddRow("user-123", username, "hashedsecret", nil, false, nil, fixedTime, fixedTime, nil, nil, nil, nil, nil, nil)
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, created_at, last_seen FROM users WHERE username = $1`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE lower(username) = lower($1)`)).
 		WithArgs(username).
 		WillReturnRows(rows)
 
@@ -179,3 +233,277 @@ func TestUpdateLastSeen(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestGetByEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE lower(email) = lower($1)`
+
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("Alice@Example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}).
+			AddRow("user-123", "alice", "hashedsecret", "alice@example.com", false, nil, time.Now(), nil, nil, nil, nil, nil, nil, nil))
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("nobody@example.com").
+		WillReturnError(sql.ErrNoRows)
+
+	u, err := store.GetByEmail(ctx, "Alice@Example.com")
+	if err != nil {
+		t.Errorf("error was not expected: %s", err)
+	} else if u.Email != "alice@example.com" {
+		t.Errorf("expected email alice@example.com, got %s", u.Email)
+	}
+	if _, err := store.GetByEmail(ctx, "nobody@example.com"); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdatePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET password_hash = $1 WHERE id = $2`)).
+		WithArgs("newhash", "user-123").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE users SET password_hash = $1 WHERE id = $2`)).
+		WithArgs("newhash", "unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := store.UpdatePassword(ctx, "user-123", "newhash"); err != nil {
+		t.Errorf("error was not expected: %s", err)
+	}
+	if err := store.UpdatePassword(ctx, "unknown", "newhash"); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetByIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	query := `SELECT id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at FROM users WHERE id = (SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2)`
+
+	// Success Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("corp", "1234").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}).
+			AddRow("user-123", "alice", "", nil, false, nil, time.Now(), nil, nil, nil, nil, nil, nil, nil))
+
+	u, err := store.GetByIdentity(ctx, "corp", "1234")
+	if err != nil {
+		t.Errorf("error was not expected while getting user: %s", err)
+	} else if u.ID != "user-123" {
+		t.Errorf("expected user-123, got %s", u.ID)
+	}
+
+	// Not Linked Case
+	mock.ExpectQuery(regexp.QuoteMeta(query)).
+		WithArgs("corp", "5678").
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.GetByIdentity(ctx, "corp", "5678"); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateWithIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	u := &User{Username: "alice", CreatedAt: fixedTime, LastSeen: fixedTime}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO users (username, password_hash, email, is_bot, owner_id, created_at, last_seen) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`)).
+		WithArgs("alice", "", nil, false, nil, fixedTime, fixedTime).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_identities (provider, subject, user_id, created_at) VALUES ($1, $2, $3, $4)`)).
+		WithArgs("corp", "1234", "user-123", fixedTime).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := store.CreateWithIdentity(ctx, u, "corp", "1234"); err != nil {
+		t.Errorf("error was not expected while creating user: %s", err)
+	}
+	if u.ID != "user-123" {
+		t.Errorf("expected ID to be set, got %s", u.ID)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	columns := []string{"id", "username", "password_hash", "email", "is_bot", "owner_id", "created_at", "last_seen", "display_name", "bio", "avatar_url", "status_text", "status_emoji", "status_expires_at"}
+	expires := time.Date(2023, 1, 1, 18, 0, 0, 0, time.UTC)
+	displayName := "Alice A."
+
+	// Only the named fields are set.
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE users SET display_name = $1, status_text = $2, status_emoji = $3, status_expires_at = $4 WHERE id = $5 RETURNING id, username, password_hash, email, is_bot, owner_id, created_at, last_seen, display_name, bio, avatar_url, status_text, status_emoji, status_expires_at`)).
+		WithArgs("Alice A.", "In a meeting", "📅", &expires, "user-123").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("user-123", "alice", "", nil, false, nil, expires, nil, "Alice A.", "Hi", nil, "In a meeting", "📅", expires))
+
+	u, err := store.UpdateProfile(ctx, "user-123", ProfileUpdate{
+		DisplayName: &displayName,
+		Status:      &Status{Text: "In a meeting", Emoji: "📅", ExpiresAt: &expires},
+		SetStatus:   true,
+	})
+	if err != nil {
+		t.Fatalf("error was not expected while updating profile: %s", err)
+	}
+	if u.DisplayName != "Alice A." || u.Bio != "Hi" || u.Status == nil || u.Status.Text != "In a meeting" || !u.Status.ExpiresAt.Equal(expires) {
+		t.Errorf("unexpected profile %+v", u.Profile)
+	}
+	if !u.Status.Expired(expires) || u.Status.Expired(expires.Add(-time.Second)) {
+		t.Errorf("expected status to expire at %v", expires)
+	}
+
+	// Clearing the status
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE users SET status_text = $1, status_emoji = $2, status_expires_at = $3 WHERE id = $4 RETURNING`)).
+		WithArgs(nil, nil, nil, "user-123").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("user-123", "alice", "", nil, false, nil, expires, nil, "Alice A.", "Hi", nil, nil, nil, nil))
+
+	if u, err := store.UpdateProfile(ctx, "user-123", ProfileUpdate{SetStatus: true}); err != nil || u.Status != nil {
+		t.Errorf("expected status to be cleared, got %+v (%v)", u, err)
+	}
+
+	// Not Found Case
+	bio := ""
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE users SET bio = $1 WHERE id = $2 RETURNING`)).
+		WithArgs(nil, "unknown").
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.UpdateProfile(ctx, "unknown", ProfileUpdate{Bio: &bio}); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil {
+			t.Logf("error closing db: %v", closeErr)
+		}
+	}()
+
+	store := NewSQLStore(db)
+	ctx := context.Background()
+
+	fixedTime := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	avatar := &Avatar{UserID: "user-123", ContentType: "image/png", Data: []byte("png"), UpdatedAt: fixedTime}
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO user_avatars (user_id, content_type, data, updated_at) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO UPDATE SET content_type = EXCLUDED.content_type, data = EXCLUDED.data, updated_at = EXCLUDED.updated_at`)).
+		WithArgs("user-123", "image/png", []byte("png"), fixedTime).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.SetAvatar(ctx, avatar); err != nil {
+		t.Errorf("error was not expected while setting avatar: %s", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT content_type, data, updated_at FROM user_avatars WHERE user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnRows(sqlmock.NewRows([]string{"content_type", "data", "updated_at"}).AddRow("image/png", []byte("png"), fixedTime))
+
+	got, err := store.GetAvatar(ctx, "user-123")
+	if err != nil {
+		t.Errorf("error was not expected while getting avatar: %s", err)
+	} else if got.ContentType != "image/png" || string(got.Data) != "png" {
+		t.Errorf("unexpected avatar %+v", got)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT content_type, data, updated_at FROM user_avatars WHERE user_id = $1`)).
+		WithArgs("user-456").
+		WillReturnError(sql.ErrNoRows)
+
+	if _, err := store.GetAvatar(ctx, "user-456"); err != ErrAvatarNotFound {
+		t.Errorf("expected ErrAvatarNotFound, got %v", err)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM user_avatars WHERE user_id = $1`)).
+		WithArgs("user-123").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.DeleteAvatar(ctx, "user-123"); err != nil {
+		t.Errorf("error was not expected while deleting avatar: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
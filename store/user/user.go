@@ -10,14 +10,62 @@ import (
 type User struct {
 	ID           string    `json:"id"`
 	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"` // Never export password hash to JSON
+	PasswordHash string    `json:"-"`               // Never export password hash to JSON
+	Email        string    `json:"email,omitempty"` // Where password reset links are sent
+	IsBot        bool      `json:"is_bot"`
+	OwnerID      string    `json:"owner_id,omitempty"` // User who manages the bot; empty for humans
 	CreatedAt    time.Time `json:"created_at"`
 	LastSeen     time.Time `json:"last_seen"`
+	Profile
+}
+
+// Profile is what users tell others about themselves. All fields are
+// optional.
+type Profile struct {
+	DisplayName string  `json:"display_name,omitempty"`
+	Bio         string  `json:"bio,omitempty"`
+	AvatarURL   string  `json:"avatar_url,omitempty"` // External image or the uploaded Avatar
+	Status      *Status `json:"status,omitempty"`
+}
+
+// ProfileUpdate names the profile fields to change. Nil fields, and Status
+// unless SetStatus is true, are left as they are; a nil Status with SetStatus
+// clears it.
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+	Status      *Status
+	SetStatus   bool
+}
+
+// Status is a short custom status such as "In a meeting" with an emoji.
+type Status struct {
+	Text      string     `json:"text,omitempty"`
+	Emoji     string     `json:"emoji,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Never if nil
+}
+
+// Expired reports whether the status no longer applies at now.
+func (s *Status) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// Avatar is a profile picture uploaded by the user.
+type Avatar struct {
+	UserID      string
+	ContentType string
+	Data        []byte
+	UpdatedAt   time.Time
 }
 
 var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrDuplicateUsername = errors.New("username already exists")
+	ErrDuplicateEmail    = errors.New("email already in use")
+	ErrDuplicateIdentity = errors.New("identity already linked")
+	ErrOwnerNotFound     = errors.New("bot owner not found")
+	ErrAvatarNotFound    = errors.New("avatar not found")
 )
 
 // Store defines the interface for CRUD operations on User accounts.
@@ -28,9 +76,38 @@ type Store interface {
 	// GetByID retrieves a user by their unique ID.
 	GetByID(ctx context.Context, id string) (*User, error)
 
-	// GetByUsername retrieves a user by their username.
+	// GetByUsername retrieves a user by their username, ignoring case.
 	GetByUsername(ctx context.Context, username string) (*User, error)
 
+	// GetByEmail retrieves a user by their email address, ignoring case.
+	GetByEmail(ctx context.Context, email string) (*User, error)
+
+	// UpdatePassword replaces the password hash of a user.
+	UpdatePassword(ctx context.Context, id, passwordHash string) error
+
 	// UpdateLastSeen updates the LastSeen timestamp for a user.
 	UpdateLastSeen(ctx context.Context, id string, lastSeen time.Time) error
+
+	// UpdateProfile changes only the profile fields named by update, so
+	// concurrent updates of different fields do not undo each other, and
+	// returns the updated user.
+	UpdateProfile(ctx context.Context, id string, update ProfileUpdate) (*User, error)
+
+	// SetAvatar stores the uploaded avatar of a user, replacing any earlier
+	// one.
+	SetAvatar(ctx context.Context, avatar *Avatar) error
+
+	// GetAvatar retrieves the uploaded avatar of a user.
+	GetAvatar(ctx context.Context, userID string) (*Avatar, error)
+
+	// DeleteAvatar removes the uploaded avatar of a user, if any.
+	DeleteAvatar(ctx context.Context, userID string) error
+
+	// GetByIdentity retrieves the user linked to an account at an external
+	// identity provider.
+	GetByIdentity(ctx context.Context, provider, subject string) (*User, error)
+
+	// CreateWithIdentity inserts a new user linked to an account at an
+	// external identity provider.
+	CreateWithIdentity(ctx context.Context, user *User, provider, subject string) error
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/nexus-im/nexus/store/attempt"
+	"github.com/nexus-im/nexus/store/cursor"
+	"github.com/nexus-im/nexus/store/session"
+)
+
+// Counters for the expired session sweeper, exposed on /debug/vars.
+var (
+	sessionSweepRuns    = expvar.NewInt("session_sweep_runs")
+	sessionSweepErrors  = expvar.NewInt("session_sweep_errors")
+	sessionSweepRemoved = expvar.NewInt("session_sweep_removed")
+	refreshSweepRemoved = expvar.NewInt("refresh_token_sweep_removed")
+	ticketSweepRemoved  = expvar.NewInt("ws_ticket_sweep_removed")
+	mfaSweepRemoved     = expvar.NewInt("mfa_challenge_sweep_removed")
+	resetSweepRemoved   = expvar.NewInt("password_reset_sweep_removed")
+	cursorSweepRemoved  = expvar.NewInt("delivery_cursor_sweep_removed")
+	attemptSweepRemoved = expvar.NewInt("login_attempt_sweep_removed")
+)
+
+// sessionSweeper periodically deletes expired sessions, refresh tokens,
+// websocket tickets, MFA challenges and password resets, which are already
+// rejected but would otherwise accumulate forever. Delivery cursors not acked
+// for cursorTTL are deleted too, if cursors is set, and login failures that
+// no longer count nor lock anyone out, if attempts is set.
+type sessionSweeper struct {
+	store     session.Store
+	interval  time.Duration
+	batchSize int
+
+	cursors   cursor.Store
+	cursorTTL time.Duration
+
+	attempts attempt.Store
+}
+
+// run sweeps every interval until ctx is cancelled.
+func (s *sessionSweeper) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx)
+		}
+	}
+}
+
+// sweep deletes expired sessions, then the other expired credentials, and
+// returns how many sessions were removed.
+func (s *sessionSweeper) sweep(ctx context.Context) int64 {
+	sessionSweepRuns.Add(1)
+	cutoff := time.Now()
+
+	total := s.deleteBatches(ctx, "sessions", sessionSweepRemoved, func(ctx context.Context) (int64, error) {
+		return s.store.DeleteExpired(ctx, cutoff, s.batchSize)
+	})
+	s.deleteBatches(ctx, "refresh tokens", refreshSweepRemoved, func(ctx context.Context) (int64, error) {
+		return s.store.DeleteExpiredRefreshTokens(ctx, cutoff, s.batchSize)
+	})
+	s.deleteBatches(ctx, "websocket tickets", ticketSweepRemoved, func(ctx context.Context) (int64, error) {
+		return s.store.DeleteExpiredTickets(ctx, cutoff, s.batchSize)
+	})
+	s.deleteBatches(ctx, "MFA challenges", mfaSweepRemoved, func(ctx context.Context) (int64, error) {
+		return s.store.DeleteExpiredMFAChallenges(ctx, cutoff, s.batchSize)
+	})
+	s.deleteBatches(ctx, "password resets", resetSweepRemoved, func(ctx context.Context) (int64, error) {
+		return s.store.DeleteExpiredPasswordResets(ctx, cutoff, s.batchSize)
+	})
+	if s.cursors != nil {
+		s.deleteBatches(ctx, "delivery cursors", cursorSweepRemoved, func(ctx context.Context) (int64, error) {
+			return s.cursors.DeleteStale(ctx, cutoff.Add(-s.cursorTTL), s.batchSize)
+		})
+	}
+	if s.attempts != nil {
+		s.deleteBatches(ctx, "login attempts", attemptSweepRemoved, func(ctx context.Context) (int64, error) {
+			return s.attempts.DeleteStale(ctx, cutoff.Add(-loginFailureWindow), cutoff, s.batchSize)
+		})
+	}
+	return total
+}
+
+// deleteBatches calls del until a batch comes back short and returns how many
+// rows were removed in total.
+func (s *sessionSweeper) deleteBatches(ctx context.Context, what string, removed *expvar.Int, del func(context.Context) (int64, error)) int64 {
+	var total int64
+	for ctx.Err() == nil {
+		batchCtx, cancel := context.WithTimeout(ctx, storeTimeout)
+		n, err := del(batchCtx)
+		cancel()
+		if err != nil {
+			sessionSweepErrors.Add(1)
+			log.Printf("Error sweeping expired %s: %v", what, err)
+			break
+		}
+
+		total += n
+		removed.Add(n)
+		if n < int64(s.batchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Removed %d expired %s", total, what)
+	}
+	return total
+}
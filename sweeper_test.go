@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/cursor"
+	"github.com/nexus-im/nexus/store/session"
+)
+
+func TestSessionSweeper(t *testing.T) {
+	store := newMemSessionStore()
+	for i := 0; i < 5; i++ {
+		_ = store.Create(context.Background(), &session.Session{
+			Token:     fmt.Sprintf("expired-%d", i),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+	}
+	_ = store.Create(context.Background(), &session.Session{
+		Token:     "live",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	s := &sessionSweeper{store: store, interval: time.Hour, batchSize: 2}
+	removedBefore := sessionSweepRemoved.Value()
+
+	if n := s.sweep(context.Background()); n != 5 {
+		t.Errorf("expected 5 sessions removed, got %d", n)
+	}
+	if got := sessionSweepRemoved.Value() - removedBefore; got != 5 {
+		t.Errorf("expected removed counter to grow by 5, got %d", got)
+	}
+	if _, err := store.GetByToken(context.Background(), "live"); err != nil {
+		t.Errorf("expected live session to survive, got %v", err)
+	}
+}
+
+func TestSessionSweeperCursors(t *testing.T) {
+	cursors := newMemCursorStore()
+	_ = cursors.Ack(context.Background(), &cursor.Cursor{UserID: "alice", StreamID: "old", RoomID: "room-1", Seq: 1, UpdatedAt: time.Now().Add(-48 * time.Hour)})
+	_ = cursors.Ack(context.Background(), &cursor.Cursor{UserID: "alice", StreamID: "new", RoomID: "room-1", Seq: 1, UpdatedAt: time.Now()})
+
+	s := &sessionSweeper{store: newMemSessionStore(), interval: time.Hour, batchSize: 2, cursors: cursors, cursorTTL: 24 * time.Hour}
+	s.sweep(context.Background())
+
+	if got, _ := cursors.List(context.Background(), "alice", "old"); len(got) != 0 {
+		t.Errorf("expected stale cursor to be removed, got %d", len(got))
+	}
+	if got, _ := cursors.List(context.Background(), "alice", "new"); len(got) != 1 {
+		t.Errorf("expected recent cursor to survive, got %d", len(got))
+	}
+}
+
+func TestSessionSweeperLoginAttempts(t *testing.T) {
+	attempts := newMemAttemptStore()
+	old := time.Now().Add(-2 * loginFailureWindow)
+	_, _ = attempts.RecordFailure(context.Background(), "ip:203.0.113.7", old, old)
+	_, _ = attempts.RecordFailure(context.Background(), "user:mallory", old, old)
+	_ = attempts.Lock(context.Background(), "user:mallory", time.Now().Add(time.Hour))
+	_, _ = attempts.RecordFailure(context.Background(), "user:alice", time.Now(), old)
+
+	s := &sessionSweeper{store: newMemSessionStore(), interval: time.Hour, batchSize: 2, attempts: attempts}
+	removedBefore := attemptSweepRemoved.Value()
+	s.sweep(context.Background())
+
+	if got := attemptSweepRemoved.Value() - removedBefore; got != 1 {
+		t.Errorf("expected one login attempt removed, got %d", got)
+	}
+	if a, _ := attempts.Get(context.Background(), "ip:203.0.113.7"); a.Failures != 0 {
+		t.Errorf("expected stale attempt to be removed, got %+v", a)
+	}
+	// Still locked out, and still counting.
+	for _, key := range []string{"user:mallory", "user:alice"} {
+		if a, _ := attempts.Get(context.Background(), key); a.Failures != 1 {
+			t.Errorf("expected %s to survive, got %+v", key, a)
+		}
+	}
+}
+
+func TestDebugVarsRequiresAdmin(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/debug/vars", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected metrics to be disabled without an admin token, got %d", resp.StatusCode)
+	}
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = "" })
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/debug/vars", "token-bob", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a user token, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/debug/vars", "admin-secret", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
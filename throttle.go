@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexus-im/nexus/policy"
+)
+
+// Login throttling. Failed logins are counted per username and per client
+// address. Once a key has used up its free failures, every further failure
+// locks it out, each time twice as long as before, up to loginMaxLockout.
+// The per-address allowance is larger since many users may share an address.
+const (
+	loginFreeFailuresUser = 5
+	loginFreeFailuresIP   = 20
+	loginBaseLockout      = 30 * time.Second
+	loginMaxLockout       = time.Hour
+
+	// Failures older than this no longer count.
+	loginFailureWindow = 24 * time.Hour
+)
+
+// Usernames are case-insensitive, so "Alice" and "alice" share a key.
+func userAttemptKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipAttemptKey(ip string) string         { return "ip:" + ip }
+
+// clientIP returns the address of the peer that sent r. Forwarding headers
+// are not trusted as any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginLockout returns how much longer the most restrictive of keys is
+// locked out, or zero if none is.
+func loginLockout(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		a, err := attemptStore.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if locked, d := a.Locked(now); locked && d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login against the username and the
+// client address, locking out whichever has run out of free failures.
+func recordLoginFailure(ctx context.Context, username, ip string) error {
+	now := time.Now()
+	for _, k := range []struct {
+		key  string
+		free int
+	}{
+		{userAttemptKey(username), loginFreeFailuresUser},
+		{ipAttemptKey(ip), loginFreeFailuresIP},
+	} {
+		a, err := attemptStore.RecordFailure(ctx, k.key, now, now.Add(-loginFailureWindow))
+		if err != nil {
+			return err
+		}
+		if a.Failures <= k.free {
+			continue
+		}
+		lockout := loginLockoutFor(a.Failures - k.free)
+		if err := attemptStore.Lock(ctx, k.key, now.Add(lockout)); err != nil {
+			return err
+		}
+		log.Printf("Locked out %s for %v after %d failed logins", k.key, lockout, a.Failures)
+	}
+	return nil
+}
+
+// loginLockoutFor returns the lockout after the n-th failure beyond the free
+// allowance.
+func loginLockoutFor(n int) time.Duration {
+	d := loginBaseLockout
+	for i := 1; i < n && d < loginMaxLockout; i++ {
+		d *= 2
+	}
+	return min(d, loginMaxLockout)
+}
+
+// writeTooManyAttempts rejects a login attempt on a locked out key.
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed login attempts", http.StatusTooManyRequests)
+}
+
+// handleUnlock lifts the lockout of a username and/or a client address. It is
+// only available when NEXUS_ADMIN_TOKEN is set, and must be called with that
+// token as the bearer token.
+func handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" && req.IP == "" {
+		http.Error(w, "Username or ip is required", http.StatusBadRequest)
+		return
+	}
+
+	// Login counts failures under the normalized name, so every spelling
+	// of it must unlock the same key.
+	req.Username = policy.NormalizeUsername(req.Username)
+	var keys []string
+	if req.Username != "" {
+		keys = append(keys, userAttemptKey(req.Username))
+	}
+	if req.IP != "" {
+		keys = append(keys, ipAttemptKey(req.IP))
+	}
+	for _, key := range keys {
+		if err := attemptStore.Reset(r.Context(), key); err != nil {
+			log.Printf("Error unlocking %s: %v", key, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Unlocked %s", key)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireAdmin checks the request's bearer token against the admin token. On
+// failure it writes the error response and returns false. Without an admin
+// token configured, admin endpoints do not exist.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
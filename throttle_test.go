@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/user"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLockoutFor(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, loginBaseLockout},
+		{2, 2 * loginBaseLockout},
+		{3, 4 * loginBaseLockout},
+		{100, loginMaxLockout},
+	}
+	for _, tt := range tests {
+		if got := loginLockoutFor(tt.n); got != tt.want {
+			t.Errorf("loginLockoutFor(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.Create(t.Context(), &user.User{Username: "carol", PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(password string) *http.Response {
+		return doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"`+password+`"}`)
+	}
+
+	for i := 0; i < loginFreeFailuresUser; i++ {
+		if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	// One more failure trips the lockout, after which even the right
+	// password is refused.
+	if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	resp := login("secret")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", resp.StatusCode)
+	}
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > int(loginBaseLockout.Seconds()) {
+		t.Errorf("unexpected Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+
+	// Unlocking requires the admin token.
+	adminToken = ""
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/admin/unlock", "admin-secret", `{"username":"carol"}`); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected admin endpoint to be disabled without a token, got %d", resp.StatusCode)
+	}
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = "" })
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/admin/unlock", "token-bob", `{"username":"carol"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a user token, got %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/admin/unlock", "admin-secret", `{"username":"carol"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	if resp := login("secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected login to succeed once unlocked, got %d", resp.StatusCode)
+	}
+}
+
+func TestUnlockNormalizesUsername(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	createCarol(t, "")
+	adminToken = "admin-secret"
+	t.Cleanup(func() { adminToken = "" })
+
+	for i := 0; i <= loginFreeFailuresUser; i++ {
+		login(t, srv.URL, "wrong")
+	}
+	if resp := login(t, srv.URL, "secret"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", resp.StatusCode)
+	}
+
+	// The name is unlocked in the form login counts it under.
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/admin/unlock", "admin-secret", `{"username":" ｃａｒｏｌ "}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if resp := login(t, srv.URL, "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected login to succeed once unlocked, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	// Spread guesses over many usernames so no single one is locked out.
+	for i := 0; i <= loginFreeFailuresIP; i++ {
+		body := `{"username":"user` + strconv.Itoa(i) + `","password":"guess"}`
+		if resp := doRequest(t, http.MethodPost, srv.URL+"/api/login", "", body); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"fresh","password":"guess"}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected address to be locked out, got %d", resp.StatusCode)
+	}
+}
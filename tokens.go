@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nexus-im/nexus/store/session"
+)
+
+// wsTicketTTL is how long a websocket ticket can be redeemed after it is
+// minted. Clients request one right before connecting.
+const wsTicketTTL = 30 * time.Second
+
+// tokenResponse is returned by login and refresh. The access token
+// authenticates API requests and websockets until it expires; the refresh
+// token can be exchanged exactly once for a new pair.
+type tokenResponse struct {
+	Token            string `json:"token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// issueTokens starts a new refresh token family for userID and creates an
+// access session in it.
+func issueTokens(ctx context.Context, userID string) (*tokenResponse, error) {
+	refresh, err := generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rt := &session.RefreshToken{
+		UserID:    userID,
+		Token:     refresh,
+		CreatedAt: now,
+		ExpiresAt: now.Add(*refreshTokenTTL),
+	}
+	if err := sessionStore.CreateRefreshToken(ctx, rt); err != nil {
+		return nil, err
+	}
+	return issueAccessToken(ctx, rt)
+}
+
+// issueAccessToken creates an access session in the family of the freshly
+// created refresh token rt.
+func issueAccessToken(ctx context.Context, rt *session.RefreshToken) (*tokenResponse, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &session.Session{
+		UserID:    rt.UserID,
+		Token:     token,
+		FamilyID:  rt.FamilyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(*accessTokenTTL),
+	}
+	if err := sessionStore.Create(ctx, sess); err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		Token:            token,
+		ExpiresIn:        int(accessTokenTTL.Seconds()),
+		RefreshToken:     rt.Token,
+		RefreshExpiresIn: int(time.Until(rt.ExpiresAt).Seconds()),
+	}, nil
+}
+
+// handleRefresh exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token is single use: presenting one a second
+// time means it was stolen or replayed, so the whole family is revoked and
+// every websocket opened with it is closed.
+func handleRefresh(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	next, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	rt := &session.RefreshToken{
+		Token:     next,
+		CreatedAt: now,
+		ExpiresAt: now.Add(*refreshTokenTTL),
+	}
+
+	used, err := sessionStore.RotateRefreshToken(r.Context(), req.RefreshToken, rt)
+	switch {
+	case errors.Is(err, session.ErrRefreshTokenReused):
+		log.Printf("Refresh token reuse detected for user %s, revoking family %s", used.UserID, used.FamilyID)
+		if err := revokeFamily(r.Context(), hub, used.UserID, used.FamilyID); err != nil {
+			log.Printf("Error revoking family %s: %v", used.FamilyID, err)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case errors.Is(err, session.ErrRefreshTokenNotFound), errors.Is(err, session.ErrRefreshTokenExpired):
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		log.Printf("Error rotating refresh token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := issueAccessToken(r.Context(), rt)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// revokeFamily deletes a refresh token family with its sessions and closes the
+// websockets opened with them, including those whose session has already
+// expired and been swept.
+func revokeFamily(ctx context.Context, hub *Hub, userID, familyID string) error {
+	if err := sessionStore.RevokeFamily(ctx, familyID); err != nil {
+		return err
+	}
+	hub.revoke <- revocation{userID: userID, familyID: familyID}
+	return nil
+}
+
+// handleWsTicket mints a single-use ticket for opening a websocket with the
+// session used to authenticate the request. Unlike the session token, a
+// ticket is harmless once it shows up in a URL or a log.
+func handleWsTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess, _, ok := requireAuth(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := generateSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	ticket := &session.Ticket{
+		Token:     token,
+		SessionID: sess.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(wsTicketTTL),
+	}
+	if err := sessionStore.CreateTicket(r.Context(), ticket); err != nil {
+		if errors.Is(err, session.ErrSessionNotFound) {
+			// Revoked between authenticating and creating the ticket.
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Error creating websocket ticket: %v", err)
+		http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ticket":     token,
+		"expires_in": int(wsTicketTTL.Seconds()),
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nexus-im/nexus/store/user"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func decodeTokens(t *testing.T, resp *http.Response) tokenResponse {
+	t.Helper()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var tokens tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Fatalf("expected access and refresh tokens, got %+v", tokens)
+	}
+	return tokens
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	srv, hub, _ := newSessionTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.Create(t.Context(), &user.User{Username: "carol", PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+
+	login := decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"secret"}`))
+	if login.ExpiresIn != int(accessTokenTTL.Seconds()) {
+		t.Errorf("expected access token to live %v, got %ds", *accessTokenTTL, login.ExpiresIn)
+	}
+
+	refreshed := decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`))
+	if refreshed.RefreshToken == login.RefreshToken {
+		t.Errorf("expected refresh token to rotate")
+	}
+
+	// The new access token works, and so does the old one until it expires.
+	for _, token := range []string{login.Token, refreshed.Token} {
+		if resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", token, ""); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected access token to be accepted, got %d", resp.StatusCode)
+		}
+	}
+
+	sess, err := sessionStore.GetByToken(t.Context(), refreshed.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(hub, sess.UserID)
+	c.session = sess
+	register(t, hub, c)
+
+	// Replaying the used refresh token revokes the whole family.
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 on reuse, got %d", resp.StatusCode)
+	}
+	expectClosed(t, c)
+
+	for _, token := range []string{login.Token, refreshed.Token} {
+		if resp := doRequest(t, http.MethodGet, srv.URL+"/api/sessions", token, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected revoked access token to be rejected, got %d", resp.StatusCode)
+		}
+	}
+	resp = doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+refreshed.RefreshToken+`"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked refresh token to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestLogoutRevokesRefreshFamily(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := userStore.Create(t.Context(), &user.User{Username: "carol", PasswordHash: string(hash)}); err != nil {
+		t.Fatal(err)
+	}
+
+	login := decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/login", "", `{"username":"carol","password":"secret"}`))
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/logout", login.Token, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp := doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+login.RefreshToken+`"}`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected refresh after logout to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestRevokeFamilyClosesSweptSessions(t *testing.T) {
+	srv, _, _ := newSessionTestServer(t)
+	roomStore = newMemRoomStore()
+	createCarol(t, "")
+
+	first := decodeTokens(t, login(t, srv.URL, "secret"))
+	conn, _, err := dialToken(t, wsURL(srv), first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readEvent(t, conn)
+
+	// The access session expires and is swept; its websocket stays open.
+	if _, err := sessionStore.DeleteExpired(t.Context(), time.Now().Add(24*time.Hour), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reusing a refresh token revokes the family, which still closes it.
+	decodeTokens(t, doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+first.RefreshToken+`"}`))
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/api/token/refresh", "", `{"refresh_token":"`+first.RefreshToken+`"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected reuse to be rejected, got %d", resp.StatusCode)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("expected close code %d, got %v", websocket.ClosePolicyViolation, err)
+		}
+		break
+	}
+}
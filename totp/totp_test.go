@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238, Appendix B (SHA-1).
+func TestHOTPRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		if got := hotp(key, uint64(step), 8); got != tt.want {
+			t.Errorf("hotp at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	code, err := CodeAt(secret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok := Validate(secret, code, now, 1); !ok || step != Step(now) {
+		t.Errorf("expected current code to validate at step %d, got %d %v", Step(now), step, ok)
+	}
+
+	// One step of drift is tolerated, two are not.
+	if _, ok := Validate(secret, code, now.Add(Period), 1); !ok {
+		t.Errorf("expected code from the previous step to validate")
+	}
+	if _, ok := Validate(secret, code, now.Add(2*Period), 1); ok {
+		t.Errorf("expected code from two steps ago to be rejected")
+	}
+
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Errorf("expected short code to be rejected")
+	}
+	if _, ok := Validate("not base32!", code, now, 1); ok {
+		t.Errorf("expected invalid secret to be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Nexus", "alice", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Nexus:alice?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, want := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Nexus", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("expected %s in %s", want, uri)
+		}
+	}
+}